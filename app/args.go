@@ -4,9 +4,15 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/abingzo/bups/common/crypt"
 	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/schedule"
+	"github.com/abingzo/bups/common/sign"
+	"github.com/abingzo/bups/iocc"
+	"io"
 	"os"
 	"strings"
+	"time"
 )
 
 /*
@@ -15,19 +21,14 @@ import (
 	一个正确的程序参数: ./bups --option pluginInstallList
 */
 
-// 为了更好地展示插件的类型
-var showTypeTable = map[plugin.Type]string{
-	plugin.Init: "Init",
-	plugin.BHandle: "Handle",
-	plugin.BCallBack: "Callback",
-	plugin.BCollect: "Collect",
-}
-
 // args.go 所需要的程序参数
 var pluginName = flag.String("plugin", "", "调用的插件的名字")
 var caller = flag.String("caller", "", "直接调用一个插件,没有参数传递")
 var pluginArgs = flag.String("args", "", "传递的插件参数，比如:'<--s stop>'")
-var option = flag.String("option", "", "应用程序选项: pluginInstallList 列出所有安装的插件")
+var option = flag.String("option", "", "应用程序选项: pluginInstallList 列出所有安装的插件, schedule 显示调度规则和下一次启动的时间, history 显示运行历史, watchdog 检查是否有任务超过阈值没有成功的备份, keygen 生成加密归档使用的密钥对, signkeygen 生成签名归档使用的密钥对")
+var jobName = flag.String("job", "", "选项作用的任务，为空时表示所有任务")
+var limit = flag.Int("limit", 20, "history选项输出的最大条数，0表示不限制")
+var format = flag.String("format", "table", "history选项的输出格式: table json")
 
 // ArgsProcess 插件收到的标准参数:
 // 原参数:/User/harder/bups --plugin daemon --args '<--s start>'
@@ -39,11 +40,42 @@ func ArgsProcess(ctx *plugin.Context,getInfo func() *Info) bool {
 	switch *option {
 	case "pluginInstallList":
 		tag = true
-		ctx.RangeAllPlugin(func(k int, v plugin.Plugin) {
-			fmt.Printf("Handler:%d --> PluginName:%12s --> PluginType:%s\n", k, v.GetName(), showTypeTable[v.GetType()])
+		ctx.RangeJobPlugin(func(k int, job string, v plugin.Plugin) {
+			fmt.Printf("Handler:%d --> PluginName:%12s --> PluginType:%s --> Job:%s\n", k, v.GetName(), v.GetType(), job)
 		})
 	case "":
 		break
+	case "schedule":
+		tag = true
+		for _, job := range iocc.GetConfig().Jobs() {
+			sched, err := schedule.ForJob(job)
+			if err != nil {
+				fmt.Printf("Job:%s --> %s\n", job.Name, err.Error())
+				continue
+			}
+			fmt.Printf("Job:%s --> Schedule:%s --> NextRun:%s\n", job.Name, sched, sched.Next(time.Now()).Format(time.RFC3339))
+		}
+	case "history":
+		tag = true
+		if err := showHistory(); err != nil {
+			fmt.Printf("%s\n", err.Error())
+		}
+	case "watchdog":
+		tag = true
+		// 以非0状态退出，便于外部的定时任务检查
+		if checkWatchdog() {
+			os.Exit(1)
+		}
+	case "keygen":
+		tag = true
+		if err := keygen(os.Stdout); err != nil {
+			fmt.Printf("%s\n", err.Error())
+		}
+	case "signkeygen":
+		tag = true
+		if err := signKeygen(os.Stdout); err != nil {
+			fmt.Printf("%s\n", err.Error())
+		}
 	case "version":
 		tag = true
 		v := getInfo()
@@ -63,20 +95,48 @@ func ArgsProcess(ctx *plugin.Context,getInfo func() *Info) bool {
 		tag = true
 		ctx.RangeArgsPlugin(func(k int, v plugin.Plugin) {
 			if v.GetName() == *pluginName {
-				v.Start(MainAppArgsToPlugin(*pluginArgs))
+				if err := plugin.Start(v, MainAppArgsToPlugin(*pluginArgs)); err != nil {
+					fmt.Printf("%s: %s\n", v.GetName(), err.Error())
+				}
 			}
 		})
 	} else if *caller != "" {
 		tag = true
 		ctx.RangeAllPlugin(func(k int, v plugin.Plugin) {
 			if v.GetName() == *caller {
-				v.Start(nil)
+				if err := plugin.Start(v, nil); err != nil {
+					fmt.Printf("%s: %s\n", v.GetName(), err.Error())
+				}
 			}
 		})
 	}
 	return tag
 }
 
+// 生成X25519的密钥对，输出的格式可以直接保存为私钥文件
+// 公钥写入配置的recipients中，私钥应该离线保存
+func keygen(w io.Writer) error {
+	identity, err := crypt.GenerateIdentity()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339), identity.Recipient(), identity)
+	return err
+}
+
+// 生成ed25519的签名密钥对
+// 私钥保存在产生备份的主机上，公钥配置为恢复时信任的公钥
+func signKeygen(w io.Writer) error {
+	key, err := sign.GenerateKey()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339), key.Public(), key)
+	return err
+}
+
 // MainAppArgsToPlugin 该函数将主程序参数转换为插件参数
 func MainAppArgsToPlugin(s string) []string {
 	args := []string{os.Args[0]}
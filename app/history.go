@@ -0,0 +1,37 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/history"
+	"github.com/abingzo/bups/common/path"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/iocc"
+	"os"
+)
+
+// RecordHistory 每次流水线完成时将结果写入运行历史
+func RecordHistory(ctx *plugin.Context) {
+	store := history.NewStore(path.DEFAULT_PATH_HISTORY_FILE)
+	ctx.OnRunComplete(func(run *plugin.Run) {
+		if err := store.Append(history.FromRun(run)); err != nil {
+			iocc.GetErrorLog().ErrorFromString(fmt.Sprintf("%s: write history failed: %s", run, err))
+		}
+	})
+}
+
+// 输出运行历史，--job筛选任务，--limit限制条数，--format选择table或json
+func showHistory() error {
+	entries, err := history.NewStore(path.DEFAULT_PATH_HISTORY_FILE).List(*jobName, *limit)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "table":
+		return history.WriteTable(os.Stdout, entries)
+	case "json":
+		return history.WriteJSON(os.Stdout, entries)
+	default:
+		return errors.New("not support format: " + *format)
+	}
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"fmt"
+	"github.com/abingzo/bups/common/history"
+	"github.com/abingzo/bups/common/metrics"
+	"github.com/abingzo/bups/common/path"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/iocc"
+	"net/http"
+)
+
+// ServeMetrics 收集每次运行的指标，配置了project.metrics.listen时在独立的端口导出
+func ServeMetrics(ctx *plugin.Context) *metrics.Registry {
+	registry := metrics.NewRegistry()
+	// 从运行历史中恢复最近一次成功的时间
+	if entries, err := history.NewStore(path.DEFAULT_PATH_HISTORY_FILE).List("", 0); err != nil {
+		iocc.GetErrorLog().ErrorFromString(fmt.Sprintf("metrics: read history failed: %s", err))
+	} else {
+		registry.Seed(entries)
+	}
+	ctx.OnRunComplete(registry.Observe)
+	cfg := iocc.GetConfig().Project.Metrics
+	if cfg.Listen == "" {
+		return registry
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, registry)
+	go func() {
+		iocc.GetAccessLog().Info(fmt.Sprintf("metrics: listen on %s%s", cfg.Listen, cfg.Path))
+		if err := http.ListenAndServe(cfg.Listen, mux); err != nil {
+			iocc.GetErrorLog().ErrorFromString(fmt.Sprintf("metrics: %s", err))
+		}
+	}()
+	return registry
+}
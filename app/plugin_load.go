@@ -40,14 +40,29 @@ func LoaderPlugin(path string) *plugin.Context {
 	// TODO 解耦注册插件的代码
 	// 注册插件
 	PluginRegister()
-	// 加载插件
+	// 加载Init插件，它们不属于任何任务
 	for _, v := range iocc.GetPluginList() {
 		tmpPlg := v()
 		_, ok := hashTable[tmpPlg.GetName()]
-		if ok {
+		if ok && tmpPlg.GetType() == plugin.Init {
 			ctx.RegisterRaw(tmpPlg)
 		}
 	}
+	// 每个任务加载一份独立的流水线插件
+	for _, job := range mainConfig.Jobs() {
+		ctx.SetHooks(job.Name, job.Hook)
+		jobTable := make(map[string]struct{}, len(job.Install))
+		for _, v := range job.Install {
+			jobTable[v] = struct{}{}
+		}
+		for _, v := range iocc.GetPluginList() {
+			tmpPlg := v()
+			_, ok := jobTable[tmpPlg.GetName()]
+			if ok && tmpPlg.GetType() != plugin.Init {
+				ctx.RegisterJob(job.Name, tmpPlg)
+			}
+		}
+	}
 	return ctx
 }
 
@@ -6,6 +6,8 @@ import (
 	"github.com/abingzo/bups/plugins/backup"
 	"github.com/abingzo/bups/plugins/daemon"
 	"github.com/abingzo/bups/plugins/encrypt"
+	"github.com/abingzo/bups/plugins/mail"
+	"github.com/abingzo/bups/plugins/notify"
 	"github.com/abingzo/bups/plugins/recovery"
 	"github.com/abingzo/bups/plugins/upload"
 	"github.com/abingzo/bups/plugins/web_config"
@@ -16,6 +18,8 @@ func PluginRegister() {
 	iocc.RegisterPlugin(backup.New)
 	iocc.RegisterPlugin(daemon.New)
 	iocc.RegisterPlugin(encrypt.New)
+	iocc.RegisterPlugin(mail.New)
+	iocc.RegisterPlugin(notify.New)
 	iocc.RegisterPlugin(recovery.New)
 	iocc.RegisterPlugin(upload.New)
 	iocc.RegisterPlugin(web_config.New)
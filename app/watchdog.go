@@ -0,0 +1,69 @@
+package app
+
+import (
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/history"
+	"github.com/abingzo/bups/common/path"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/watchdog"
+	"github.com/abingzo/bups/iocc"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StartWatchdog 跟踪每个任务最近一次成功的运行，超过阈值时告警
+// 没有任务配置watchdog.threshold时不启动
+func StartWatchdog(ctx *plugin.Context) {
+	w := newWatchdog()
+	if !w.Enabled() {
+		return
+	}
+	ctx.OnRunComplete(w.Observe)
+	go w.Run(nil)
+}
+
+// 检查运行历史中每个任务最近一次成功的时间，用于主程序之外的定时检查
+// 主程序停止运行时内部的watchdog同样无法告警，返回是否有任务超过阈值
+func checkWatchdog() bool {
+	w := newWatchdog()
+	// 没有成功过的任务从零时开始计算，即一定会告警
+	w.SetStart(time.Time{})
+	alerts := w.Check()
+	for _, v := range alerts {
+		fmt.Println(v.String())
+	}
+	return len(alerts) > 0
+}
+
+func newWatchdog() *watchdog.Watchdog {
+	w := watchdog.New(iocc.GetConfig().Jobs(), alert)
+	if entries, err := history.NewStore(path.DEFAULT_PATH_HISTORY_FILE).List("", 0); err != nil {
+		iocc.GetErrorLog().ErrorFromString(fmt.Sprintf("watchdog: read history failed: %s", err))
+	} else {
+		w.Seed(entries)
+	}
+	return w
+}
+
+// 告警写入错误日志，配置了command和url时执行命令并POST告警
+func alert(a watchdog.Alert, cfg config.Watchdog) {
+	errorLog := iocc.GetErrorLog()
+	errorLog.ErrorFromString(a.String())
+	if cfg.Command != "" {
+		output, err := plugin.RunCommand(cfg.Command, cfg.TimeoutDuration(),
+			"BUPS_JOB="+a.Job,
+			"BUPS_LAST_SUCCESS="+a.LastSuccess.Format(time.RFC3339),
+			"BUPS_GAP="+strconv.FormatInt(int64(a.Gap.Seconds()), 10),
+		)
+		if err != nil {
+			errorLog.ErrorFromString(fmt.Sprintf("watchdog: command %q failed: %s: %s", cfg.Command, err, output))
+		}
+	}
+	if cfg.URL != "" {
+		if err := watchdog.Post(&http.Client{Timeout: 10 * time.Second}, cfg.URL, a); err != nil {
+			errorLog.ErrorFromString(err.Error())
+		}
+	}
+}
@@ -0,0 +1,439 @@
+// Package archiver 将文件和目录写入归档，备份和加密插件共用
+//
+// 归档由容器格式和压缩算法组成:
+// zip只支持deflate(gzip)和不压缩，tar可以使用gzip、zstd、xz或者不压缩
+//
+// tar使用PAX格式记录完整的POSIX元数据: 权限、属主、纳秒精度的修改时间、
+// 符号链接、硬链接和扩展属性，zip只保留权限、修改时间和符号链接
+// 套接字、命名管道和设备文件不会被归档
+package archiver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 容器格式
+const (
+	FormatZip = "zip"
+	FormatTar = "tar"
+)
+
+// 压缩算法
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionXz   = "xz"
+	CompressionNone = "none"
+)
+
+// Options 归档的格式，Level为0时使用压缩算法默认的级别
+type Options struct {
+	Format      string
+	Compression string
+	Level       int
+}
+
+// PAX记录中扩展属性的前缀
+const paxXattr = "SCHILY.xattr."
+
+// Default 与之前的版本兼容的zip+deflate
+var Default = Options{Format: FormatZip, Compression: CompressionGzip}
+
+// FromConfig 使用任务中的归档配置
+func FromConfig(cfg config.Archive) Options {
+	return Options{Format: cfg.Format, Compression: cfg.Compression, Level: cfg.Level}
+}
+
+// withDefault 为空的字段使用默认值
+func (o Options) withDefault() Options {
+	if o.Format == "" {
+		o.Format = Default.Format
+	}
+	if o.Compression == "" {
+		o.Compression = CompressionGzip
+	}
+	return o
+}
+
+// Validate 检查格式和压缩算法的组合以及压缩级别
+func (o Options) Validate() error {
+	o = o.withDefault()
+	switch o.Format {
+	case FormatZip:
+		if o.Compression != CompressionGzip && o.Compression != CompressionNone {
+			return fmt.Errorf("archiver: zip does not support %s compression", o.Compression)
+		}
+	case FormatTar:
+		switch o.Compression {
+		case CompressionGzip, CompressionZstd, CompressionXz, CompressionNone:
+		default:
+			return fmt.Errorf("archiver: not support compression %s", o.Compression)
+		}
+	default:
+		return fmt.Errorf("archiver: not support format %s", o.Format)
+	}
+	// gzip和xz的级别为1-9，zstd的级别为1-22
+	max := 9
+	if o.Compression == CompressionZstd {
+		max = 22
+	}
+	if o.Level < 0 || o.Level > max {
+		return fmt.Errorf("archiver: invalid %s compression level %d", o.Compression, o.Level)
+	}
+	return nil
+}
+
+// Ext 归档的扩展名，比如.zip .tar.gz .tar.zst .tar.xz
+func (o Options) Ext() string {
+	o = o.withDefault()
+	if o.Format == FormatZip {
+		return ".zip"
+	}
+	switch o.Compression {
+	case CompressionGzip:
+		return ".tar.gz"
+	case CompressionZstd:
+		return ".tar.zst"
+	case CompressionXz:
+		return ".tar.xz"
+	default:
+		return ".tar"
+	}
+}
+
+func (o Options) String() string {
+	o = o.withDefault()
+	return o.Format + "+" + o.Compression
+}
+
+// 容器中的一个条目
+type entry struct {
+	name string
+	info os.FileInfo
+	// 文件在磁盘上的路径，需要内容时打开
+	path string
+	// 符号链接的目标
+	link string
+	// 硬链接指向的归档内的名字，为空时不是硬链接
+	hardlink string
+	xattrs   map[string]string
+}
+
+type container interface {
+	add(e *entry) error
+	Close() error
+}
+
+// Writer 写入一个归档文件
+type Writer struct {
+	// Create创建的文件，NewWriter时为nil
+	file *os.File
+	// 归档写入的文件，AddTree跳过它以免读取正在写入的归档
+	self      os.FileInfo
+	container container
+	// 压缩流，zip时为nil
+	compressor io.WriteCloser
+	// 已经写入的有多个链接的文件，用于识别硬链接
+	links map[fileID]string
+	// OnSkip 跳过套接字、命名管道等特殊文件时调用
+	OnSkip func(path string, info os.FileInfo)
+	// Filter 为nil时AddTree写入全部的文件
+	Filter Filter
+}
+
+// Filter 决定AddTree是否跳过一个文件，rel为相对于src的路径，src本身为"."
+// 目录被跳过时不再进入其中
+type Filter interface {
+	Skip(path string, rel string, info os.FileInfo) (bool, error)
+}
+
+// Create 创建归档文件
+func Create(path string, opts Options) (*Writer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(file, opts)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	w.file = file
+	return w, nil
+}
+
+// NewWriter 将归档写入dst，比如加密的写入器，Close不关闭dst
+func NewWriter(dst io.Writer, opts Options) (*Writer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefault()
+	w := &Writer{links: make(map[fileID]string)}
+	if file, ok := dst.(*os.File); ok {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			w.self = info
+		}
+	}
+	if opts.Format == FormatZip {
+		w.container = newZipContainer(dst, opts)
+		return w, nil
+	}
+	var err error
+	if w.compressor, err = newCompressor(dst, opts); err != nil {
+		return nil, err
+	}
+	w.container = &tarContainer{w: tar.NewWriter(w.compressor)}
+	return w, nil
+}
+
+// 不压缩时的写入器，Close不关闭下层的文件
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newCompressor(w io.Writer, opts Options) (io.WriteCloser, error) {
+	switch opts.Compression {
+	case CompressionGzip:
+		level := gzip.DefaultCompression
+		if opts.Level != 0 {
+			level = opts.Level
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if opts.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(opts.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	case CompressionXz:
+		// xz的级别对应字典的大小
+		cfg := xz.WriterConfig{}
+		if opts.Level != 0 {
+			cfg.DictCap = 1 << (18 + opts.Level)
+		}
+		return cfg.NewWriter(w)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// AddFile 将单个文件以name写入归档
+func (w *Writer) AddFile(name string, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return w.container.add(&entry{name: name, info: info, path: path})
+}
+
+// AddTree 写入一个文件或者目录，归档内的名字以src的最后一级目录开头
+// Example: /User/harder/blog -> blog/index.php
+// 符号链接不会被跟随，特殊文件被跳过并调用OnSkip，归档文件自身被跳过
+func (w *Writer) AddTree(src string) error {
+	base := filepath.Dir(src)
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if w.Filter != nil {
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			skip, err := w.Filter.Skip(path, rel, info)
+			if err != nil {
+				return err
+			}
+			if skip && info.IsDir() {
+				return filepath.SkipDir
+			}
+			if skip {
+				return nil
+			}
+		}
+		if w.self != nil && os.SameFile(info, w.self) {
+			return nil
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(path, base+string(filepath.Separator)))
+		e := &entry{name: name, info: info, path: path}
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			e.name += "/"
+		case mode&os.ModeSymlink != 0:
+			if e.link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			// 同一个文件的其它链接记录为硬链接
+			if id, ok := linkID(info); ok {
+				if first, ok := w.links[id]; ok {
+					e.hardlink = first
+				} else {
+					w.links[id] = name
+				}
+			}
+		default:
+			if w.OnSkip != nil {
+				w.OnSkip(path, info)
+			}
+			return nil
+		}
+		if e.xattrs, err = listXattrs(path); err != nil {
+			return fmt.Errorf("archiver: read xattrs of %s: %w", path, err)
+		}
+		return w.container.add(e)
+	})
+}
+
+// TreeRoot AddTree写入的文件在归档中共同的目录，比如/User/harder/blog为blog，./为空
+func TreeRoot(src string) string {
+	name := filepath.ToSlash(strings.TrimPrefix(filepath.Join(src, "x"), filepath.Dir(src)+string(filepath.Separator)))
+	return strings.TrimSuffix(strings.TrimSuffix(name, "x"), "/")
+}
+
+// Close 依次关闭容器、压缩流和文件
+func (w *Writer) Close() error {
+	err := w.container.Close()
+	if w.compressor != nil {
+		if cerr := w.compressor.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if w.file == nil {
+		return err
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ArchiveTree 将src归档到dst
+func ArchiveTree(src string, dst string, opts Options) error {
+	w, err := Create(dst, opts)
+	if err != nil {
+		return err
+	}
+	if err := w.AddTree(src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+type zipContainer struct {
+	w      *zip.Writer
+	method uint16
+}
+
+func newZipContainer(w io.Writer, opts Options) *zipContainer {
+	c := &zipContainer{w: zip.NewWriter(w), method: zip.Deflate}
+	if opts.Compression == CompressionNone {
+		c.method = zip.Store
+	} else if opts.Level != 0 {
+		level := opts.Level
+		c.w.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+	return c
+}
+
+// zip没有硬链接，硬链接写入完整的内容，符号链接的内容为链接的目标
+func (c *zipContainer) add(e *entry) error {
+	header, err := zip.FileInfoHeader(e.info)
+	if err != nil {
+		return err
+	}
+	header.Name = e.name
+	if !e.info.IsDir() {
+		header.Method = c.method
+	}
+	writer, err := c.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	switch {
+	case e.info.IsDir():
+		return nil
+	case e.link != "":
+		_, err = io.WriteString(writer, e.link)
+		return err
+	default:
+		return copyFile(writer, e.path, e.info.Size())
+	}
+}
+
+// 只复制遍历时的大小，归档期间增长的部分不会写入，变小的文件返回错误
+func copyFile(w io.Writer, path string, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = io.CopyN(w, file, size); err == io.EOF {
+		return fmt.Errorf("archiver: %s was truncated while archiving", path)
+	}
+	return err
+}
+
+func (c *zipContainer) Close() error {
+	return c.w.Close()
+}
+
+type tarContainer struct {
+	w *tar.Writer
+}
+
+// tar的属主由FileInfoHeader从文件的系统信息中读取
+func (c *tarContainer) add(e *entry) error {
+	header, err := tar.FileInfoHeader(e.info, e.link)
+	if err != nil {
+		return err
+	}
+	header.Name = e.name
+	// PAX格式保留纳秒精度的时间和扩展属性
+	header.Format = tar.FormatPAX
+	if e.hardlink != "" {
+		header.Typeflag = tar.TypeLink
+		header.Linkname = e.hardlink
+		header.Size = 0
+	}
+	if len(e.xattrs) != 0 {
+		header.PAXRecords = make(map[string]string, len(e.xattrs))
+		for k, v := range e.xattrs {
+			header.PAXRecords[paxXattr+k] = v
+		}
+	}
+	if err := c.w.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg || header.Size == 0 {
+		return nil
+	}
+	return copyFile(c.w, e.path, header.Size)
+}
+
+func (c *tarContainer) Close() error {
+	return c.w.Close()
+}
@@ -0,0 +1,413 @@
+package archiver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrUnknownFormat 无法从文件名判断归档的格式
+var ErrUnknownFormat = errors.New("archiver: unknown archive format")
+
+// Detect 根据文件名判断归档的格式
+func Detect(name string) (Options, error) {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return Options{Format: FormatZip, Compression: CompressionGzip}, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return Options{Format: FormatTar, Compression: CompressionGzip}, nil
+	case strings.HasSuffix(name, ".tar.zst"):
+		return Options{Format: FormatTar, Compression: CompressionZstd}, nil
+	case strings.HasSuffix(name, ".tar.xz"):
+		return Options{Format: FormatTar, Compression: CompressionXz}, nil
+	case strings.HasSuffix(name, ".tar"):
+		return Options{Format: FormatTar, Compression: CompressionNone}, nil
+	default:
+		return Options{}, ErrUnknownFormat
+	}
+}
+
+// ExtractOptions 解压的选项
+type ExtractOptions struct {
+	// 恢复文件的属主，通常只有root可以设置
+	SameOwner bool
+	// OnWarn 元数据无法恢复时调用，比如没有权限设置属主或者文件系统不支持扩展属性
+	// 为nil时这些错误被忽略
+	OnWarn func(name string, err error)
+}
+
+// Extract 将归档解压到dst，格式由文件名判断，并恢复归档中记录的元数据
+func Extract(src string, dst string, opts ExtractOptions) error {
+	format, err := Detect(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	if format.Format == FormatZip {
+		return extractZip(src, dst, opts)
+	}
+	tr, closer, err := openTar(src, format.Compression)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	return extractTar(tr, dst, opts)
+}
+
+// 打开tar归档，返回的函数依次关闭解压流和文件
+func openTar(src string, compression string) (*tar.Reader, func(), error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r io.Reader = file
+	closer := func() { file.Close() }
+	switch compression {
+	case CompressionGzip:
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		r = gr
+		closer = func() { gr.Close(); file.Close() }
+	case CompressionZstd:
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		r = zr
+		closer = func() { zr.Close(); file.Close() }
+	case CompressionXz:
+		if r, err = xz.NewReader(file); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+	return tar.NewReader(r), closer, nil
+}
+
+// ReadFile 读取归档中一个文件的内容，文件不存在时返回os.ErrNotExist
+func ReadFile(src string, name string) ([]byte, error) {
+	format, err := Detect(src)
+	if err != nil {
+		return nil, err
+	}
+	if format.Format == FormatZip {
+		r, err := zip.OpenReader(src)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.Name != name {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		}
+		return nil, os.ErrNotExist
+	}
+	tr, closer, err := openTar(src, format.Compression)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == name {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// SafeJoin 将归档内的名字转换为dst下的路径，拒绝绝对路径、..以及经过符号链接的路径
+func SafeJoin(dst string, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archiver: illegal path %s in archive", name)
+	}
+	if clean == "." {
+		return dst, nil
+	}
+	// 父目录中不能有符号链接，否则文件可能被写到dst之外
+	parent := dst
+	parts := strings.Split(clean, string(filepath.Separator))
+	for _, p := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, p)
+		info, err := os.Lstat(parent)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("archiver: path %s in archive goes through a symlink", name)
+		}
+	}
+	return filepath.Join(dst, clean), nil
+}
+
+// MakeDir 创建解压的目录，已经存在的符号链接和文件被删除，不会跟随符号链接
+// path应当由SafeJoin得到，dst本身不被替换
+func MakeDir(dst string, path string) error {
+	if path == dst {
+		return os.MkdirAll(dst, 0755)
+	}
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.IsDir():
+		return nil
+	case err == nil:
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	return os.MkdirAll(path, 0700)
+}
+
+// 打开解压的目录用于设置元数据
+// 目录在解压期间可能被之后的条目替换为符号链接，因此重新检查父目录，并以不跟随符号链接的方式打开
+// dst由调用者指定，是符号链接时依然跟随
+func openDirEntry(dst string, name string) (*os.File, error) {
+	path, err := SafeJoin(dst, name)
+	if err != nil {
+		return nil, err
+	}
+	if path == dst {
+		return os.Open(dst)
+	}
+	return openDirNoFollow(path)
+}
+
+// SetDirMeta 不跟随符号链接设置解压的目录的权限和修改时间
+func SetDirMeta(dst string, name string, mode os.FileMode, modTime time.Time) error {
+	dir, err := openDirEntry(dst, name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := dir.Chmod(mode); err != nil {
+		return err
+	}
+	return futimes(dir, modTime, modTime)
+}
+
+func extractTar(tr *tar.Reader, dst string, opts ExtractOptions) error {
+	// 写入目录中的文件会改变目录的修改时间，目录的元数据在最后设置
+	dirs := make([]*tar.Header, 0)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target, err := SafeJoin(dst, header.Name)
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeDir {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			// 覆盖已经存在的文件，不跟随符号链接
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := MakeDir(dst, target); err != nil {
+				return err
+			}
+			dirs = append(dirs, header)
+			continue
+		case tar.TypeReg:
+			if err := writeFile(target, tr, 0600); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			first, err := SafeJoin(dst, header.Linkname)
+			if err != nil {
+				return err
+			}
+			// 硬链接与第一个文件共享元数据，不需要再设置
+			if err := os.Link(first, target); err != nil {
+				return err
+			}
+			continue
+		default:
+			// 不恢复特殊文件
+			continue
+		}
+		applyMeta(target, header, opts)
+	}
+	// 由深到浅设置目录的元数据
+	for i := len(dirs) - 1; i >= 0; i-- {
+		applyDirMeta(dst, dirs[i], opts)
+	}
+	return nil
+}
+
+func writeFile(path string, r io.Reader, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 恢复属主、扩展属性、权限和修改时间
+// 设置属主会清除setuid位，因此在设置权限之前设置属主
+func applyMeta(path string, header *tar.Header, opts ExtractOptions) {
+	warn := func(err error) {
+		if err != nil && opts.OnWarn != nil {
+			opts.OnWarn(header.Name, err)
+		}
+	}
+	symlink := header.Typeflag == tar.TypeSymlink
+	if opts.SameOwner {
+		warn(os.Lchown(path, header.Uid, header.Gid))
+	}
+	for k, v := range header.PAXRecords {
+		if strings.HasPrefix(k, paxXattr) {
+			warn(setXattr(path, strings.TrimPrefix(k, paxXattr), v))
+		}
+	}
+	// 符号链接的权限和时间没有意义，Chmod和Chtimes会跟随符号链接
+	if symlink {
+		return
+	}
+	warn(os.Chmod(path, header.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)))
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	warn(os.Chtimes(path, atime, header.ModTime))
+}
+
+// 与applyMeta相同，但只通过不跟随符号链接打开的目录设置元数据
+func applyDirMeta(dst string, header *tar.Header, opts ExtractOptions) {
+	warn := func(err error) {
+		if err != nil && opts.OnWarn != nil {
+			opts.OnWarn(header.Name, err)
+		}
+	}
+	dir, err := openDirEntry(dst, header.Name)
+	if err != nil {
+		warn(err)
+		return
+	}
+	defer dir.Close()
+	if opts.SameOwner {
+		warn(dir.Chown(header.Uid, header.Gid))
+	}
+	for k, v := range header.PAXRecords {
+		if strings.HasPrefix(k, paxXattr) {
+			warn(fsetXattr(dir, strings.TrimPrefix(k, paxXattr), v))
+		}
+	}
+	warn(dir.Chmod(header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)))
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	warn(futimes(dir, atime, header.ModTime))
+}
+
+func extractZip(src string, dst string, opts ExtractOptions) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	dirs := make([]*zip.File, 0)
+	for _, f := range r.File {
+		target, err := SafeJoin(dst, f.Name)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode()
+		if mode.IsDir() {
+			if err := MakeDir(dst, target); err != nil {
+				return err
+			}
+			dirs = append(dirs, f)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		if mode&os.ModeSymlink != 0 {
+			link, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(string(link), target); err != nil {
+				return err
+			}
+			continue
+		}
+		err = writeFile(target, rc, 0600)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(target, mode.Perm()); err != nil && opts.OnWarn != nil {
+			opts.OnWarn(f.Name, err)
+		}
+		if err := os.Chtimes(target, f.Modified, f.Modified); err != nil && opts.OnWarn != nil {
+			opts.OnWarn(f.Name, err)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := SetDirMeta(dst, dirs[i].Name, dirs[i].Mode().Perm(), dirs[i].Modified); err != nil && opts.OnWarn != nil {
+			opts.OnWarn(dirs[i].Name, err)
+		}
+	}
+	return nil
+}
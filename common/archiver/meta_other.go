@@ -0,0 +1,45 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package archiver
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// 不支持的平台上不识别硬链接，硬链接被归档为普通文件
+type fileID struct{}
+
+func linkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func listXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func setXattr(path string, name string, value string) error {
+	return errors.New("archiver: xattrs are not supported on this platform")
+}
+
+// 不支持O_NOFOLLOW的平台上先检查路径不是符号链接再打开
+func openDirNoFollow(path string) (*os.File, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("archiver: " + path + " is not a directory")
+	}
+	return os.Open(path)
+}
+
+func fsetXattr(file *os.File, name string, value string) error {
+	return errors.New("archiver: xattrs are not supported on this platform")
+}
+
+func futimes(file *os.File, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(file.Name(), atime, mtime)
+}
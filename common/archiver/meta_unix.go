@@ -0,0 +1,89 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package archiver
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+	"time"
+)
+
+// 文件的设备号和inode，用于识别硬链接
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// 有多个链接的普通文件返回它的标识
+func linkID(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink <= 1 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// 读取文件的扩展属性，不跟随符号链接，文件系统不支持时返回空
+func listXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, ignoreXattrErr(err)
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, ignoreXattrErr(err)
+	}
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			return nil, ignoreXattrErr(err)
+		}
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(path, string(name), value); err != nil {
+			return nil, ignoreXattrErr(err)
+		}
+		xattrs[string(name)] = string(value[:size])
+	}
+	return xattrs, nil
+}
+
+func ignoreXattrErr(err error) error {
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP || err == unix.EPERM || err == unix.EACCES {
+		return nil
+	}
+	return err
+}
+
+// 设置扩展属性，不跟随符号链接
+func setXattr(path string, name string, value string) error {
+	return unix.Lsetxattr(path, name, []byte(value), 0)
+}
+
+// 以不跟随符号链接的方式打开目录，路径的最后一级是符号链接或者不是目录时返回错误
+func openDirNoFollow(path string) (*os.File, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// 设置打开的文件的扩展属性
+func fsetXattr(file *os.File, name string, value string) error {
+	return unix.Fsetxattr(int(file.Fd()), name, []byte(value), 0)
+}
+
+// 设置打开的文件的访问和修改时间，精度为微秒
+func futimes(file *os.File, atime time.Time, mtime time.Time) error {
+	return unix.Futimes(int(file.Fd()), []unix.Timeval{
+		unix.NsecToTimeval(atime.UnixNano()),
+		unix.NsecToTimeval(mtime.UnixNano()),
+	})
+}
@@ -1,25 +1,296 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"github.com/BurntSushi/toml"
 	"io"
 	"os"
 	"strings"
+	"time"
 )
 
 type AutoGenerated struct {
 	Project struct {
 		Install  []string `toml:"install"`
-		LoppTime int      `toml:"lopp_time"`
+		// 没有配置schedule时作为固定的间隔，以分钟计算
+		LoppTime int `toml:"lopp_time"`
 		Log      struct {
 			AccessLog string `toml:"access_log"`
 			ErrorLog  string `toml:"error_log"`
 		} `toml:"log"`
+		Schedule Schedule `toml:"schedule"`
+		Hook     []Hook   `toml:"hook"`
+		Metrics  Metrics  `toml:"metrics"`
+		Watchdog Watchdog `toml:"watchdog"`
+		Archive  Archive  `toml:"archive"`
 	} `toml:"project"`
-	Plugin map[string]map[string]map[string]interface{} `toml:"plugin"`
+	Plugin Plugins `toml:"plugin"`
+	// 多个独立的备份任务，没有配置时使用project作为唯一的任务
+	Job []Job `toml:"job"`
 	// 插件获取配置相关
 	pluginName string
 	scope      string
+	// 当前配置所属的任务
+	job string
+}
+
+// DefaultJob 没有配置[[job]]时唯一任务的名字
+const DefaultJob = "default"
+
+// Job 一个备份任务，拥有独立的调度规则、插件列表和插件配置
+// 未配置的字段继承project中的配置
+type Job struct {
+	Name     string   `toml:"name"`
+	Install  []string `toml:"install"`
+	LoppTime int      `toml:"lopp_time"`
+	Schedule Schedule `toml:"schedule"`
+	// 配置了钩子的任务不再继承project中的钩子
+	Hook []Hook `toml:"hook"`
+	// 没有配置threshold时继承project中的配置
+	Watchdog Watchdog `toml:"watchdog"`
+	// 没有配置format和compression时继承project中的配置
+	Archive Archive `toml:"archive"`
+	// 覆盖plugin中的配置，以plugin.name.scope为单位整体替换
+	Plugin Plugins `toml:"plugin"`
+}
+
+// Plugins 插件的配置，由plugin.name.scope组成
+// [[plugin.name.scope]]形式的表数组被转换为以每一项的name为键的表，与[plugin.name.scope.name]等价
+type Plugins map[string]map[string]map[string]interface{}
+
+// UnmarshalTOML 实现toml.Unmarshaler
+func (p *Plugins) UnmarshalTOML(data interface{}) error {
+	plugins, ok := data.(map[string]interface{})
+	if !ok {
+		return errors.New("config: plugin must be a table")
+	}
+	*p = make(Plugins, len(plugins))
+	for name, v := range plugins {
+		scopes, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("config: plugin.%s must be a table", name)
+		}
+		(*p)[name] = make(map[string]map[string]interface{}, len(scopes))
+		for scope, v := range scopes {
+			table, err := scopeTable(v)
+			if err != nil {
+				return fmt.Errorf("config: plugin.%s.%s %w", name, scope, err)
+			}
+			(*p)[name][scope] = table
+		}
+	}
+	return nil
+}
+
+func scopeTable(v interface{}) (map[string]interface{}, error) {
+	var entries []map[string]interface{}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return value, nil
+	case []map[string]interface{}:
+		entries = value
+	case []interface{}:
+		for _, e := range value {
+			entry, ok := e.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("must be a table or an array of tables")
+			}
+			entries = append(entries, entry)
+		}
+	default:
+		return nil, errors.New("must be a table or an array of tables")
+	}
+	table := make(map[string]interface{}, len(entries))
+	for _, entry := range entries {
+		name, ok := entry["name"].(string)
+		if !ok || name == "" {
+			return nil, errors.New("entry has no name")
+		}
+		if _, ok := table[name]; ok {
+			return nil, fmt.Errorf("has duplicate name %s", name)
+		}
+		table[name] = entry
+	}
+	return table, nil
+}
+
+// 钩子的执行时机
+const (
+	HookBeforeCollect  = "before_collect"
+	HookAfterCollect   = "after_collect"
+	HookBeforeHandle   = "before_handle"
+	HookAfterHandle    = "after_handle"
+	HookBeforeCallBack = "before_callback"
+	HookAfterCallBack  = "after_callback"
+	HookOnFailure      = "on_failure"
+)
+
+// Hook 在流水线的某个阶段前后执行的命令
+type Hook struct {
+	Stage   string `toml:"stage"`
+	Command string `toml:"command"`
+	// 超时的时间，以秒计算，为0时使用默认的60秒
+	Timeout int `toml:"timeout"`
+	// 命令以非0状态退出或者超时的时候是否中止本次运行
+	Abort bool `toml:"abort"`
+}
+
+// TimeoutDuration 钩子的超时时间
+func (h *Hook) TimeoutDuration() time.Duration {
+	if h.Timeout <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(h.Timeout) * time.Second
+}
+
+func validHookStage(stage string) bool {
+	switch stage {
+	case HookBeforeCollect, HookAfterCollect, HookBeforeHandle, HookAfterHandle,
+		HookBeforeCallBack, HookAfterCallBack, HookOnFailure:
+		return true
+	default:
+		return false
+	}
+}
+
+// Interval lopp_time对应的固定间隔
+func (j *Job) Interval() time.Duration {
+	return time.Duration(j.LoppTime) * time.Minute
+}
+
+// Metrics 导出Prometheus指标的配置
+type Metrics struct {
+	// 监听的地址，比如127.0.0.1:9101，为空时不导出指标
+	Listen string `toml:"listen"`
+	// 指标的路径，默认为/metrics
+	Path string `toml:"path"`
+}
+
+// Watchdog 长时间没有成功的备份时发出告警
+type Watchdog struct {
+	// 允许的最长没有成功备份的时间，比如"26h"，为空时不检查
+	Threshold string `toml:"threshold"`
+	// 检查的间隔，默认为"10m"
+	Interval string `toml:"interval"`
+	// 告警时执行的命令
+	Command string `toml:"command"`
+	// 命令的超时时间，以秒计算，为0时使用默认的60秒
+	Timeout int `toml:"timeout"`
+	// 告警时POST的地址
+	URL string `toml:"url"`
+}
+
+// ThresholdDuration 没有配置或者配置错误时返回0
+func (w *Watchdog) ThresholdDuration() time.Duration {
+	d, _ := time.ParseDuration(w.Threshold)
+	return d
+}
+
+// IntervalDuration 检查的间隔
+func (w *Watchdog) IntervalDuration() time.Duration {
+	d, err := time.ParseDuration(w.Interval)
+	if err != nil || d <= 0 {
+		return 10 * time.Minute
+	}
+	return d
+}
+
+// TimeoutDuration 告警命令的超时时间
+func (w *Watchdog) TimeoutDuration() time.Duration {
+	if w.Timeout <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(w.Timeout) * time.Second
+}
+
+// Archive 备份和加密插件产生的归档的格式
+type Archive struct {
+	// 容器格式: zip(默认) tar
+	Format string `toml:"format"`
+	// 压缩算法: gzip(默认) zstd xz none，zip只支持gzip和none
+	Compression string `toml:"compression"`
+	// 压缩级别，为0时使用压缩算法默认的级别
+	Level int `toml:"level"`
+}
+
+// Schedule 调度相关的配置
+type Schedule struct {
+	// 5或6个字段的cron表达式
+	Cron string `toml:"cron"`
+	// 计算cron使用的时区，比如Asia/Shanghai，为空时使用本地时区
+	Timezone string `toml:"timezone"`
+}
+
+// Jobs 返回所有的任务，未配置的字段已经从project中继承
+// 没有配置[[job]]时返回名为default的唯一任务
+func (a *AutoGenerated) Jobs() []Job {
+	if len(a.Job) == 0 {
+		return []Job{a.inherit(Job{Name: DefaultJob})}
+	}
+	jobs := make([]Job, len(a.Job))
+	for k, v := range a.Job {
+		jobs[k] = a.inherit(v)
+	}
+	return jobs
+}
+
+func (a *AutoGenerated) inherit(job Job) Job {
+	if len(job.Install) == 0 {
+		job.Install = a.Project.Install
+	}
+	if job.Schedule.Cron == "" && job.LoppTime == 0 {
+		job.Schedule = a.Project.Schedule
+		job.LoppTime = a.Project.LoppTime
+	}
+	if len(job.Hook) == 0 {
+		job.Hook = a.Project.Hook
+	}
+	if job.Watchdog.Threshold == "" {
+		job.Watchdog = a.Project.Watchdog
+	}
+	if job.Archive.Format == "" && job.Archive.Compression == "" {
+		job.Archive = a.Project.Archive
+	}
+	return job
+}
+
+// UseJob 将配置切换到某个任务，任务中的插件配置会覆盖全局的插件配置
+// 每个插件持有独立的配置对象，所以可以直接修改
+func (a *AutoGenerated) UseJob(name string) {
+	a.job = name
+	for _, v := range a.Job {
+		if v.Name != name {
+			continue
+		}
+		job := a.inherit(v)
+		a.Project.Install = job.Install
+		a.Project.Schedule = job.Schedule
+		a.Project.LoppTime = job.LoppTime
+		a.Project.Hook = job.Hook
+		a.Project.Watchdog = job.Watchdog
+		a.Project.Archive = job.Archive
+		if a.Plugin == nil {
+			a.Plugin = make(Plugins, len(job.Plugin))
+		}
+		for pluginName, scopes := range job.Plugin {
+			if a.Plugin[pluginName] == nil {
+				a.Plugin[pluginName] = make(map[string]map[string]interface{}, len(scopes))
+			}
+			for scope, data := range scopes {
+				a.Plugin[pluginName][scope] = data
+			}
+		}
+		return
+	}
+}
+
+// JobName 返回当前配置所属的任务
+func (a *AutoGenerated) JobName() string {
+	if a.job == "" {
+		return DefaultJob
+	}
+	return a.job
 }
 
 func (a *AutoGenerated) SetPluginName(name string) {
@@ -34,6 +305,12 @@ func (a *AutoGenerated) PluginGetData(key string) interface{} {
 	return a.Plugin[a.pluginName][a.scope][key]
 }
 
+// PluginData 插件某一项配置的所有数据，不改变SetPluginName和SetPluginScope设置的当前插件
+// 插件读取其它插件的配置时使用，共用同一个配置对象的插件不会读到别人的配置
+func (a *AutoGenerated) PluginData(name string, scope string) map[string]interface{} {
+	return a.Plugin[name][scope]
+}
+
 // RangePluginData 遍历插件的配置
 func (a *AutoGenerated) RangePluginData(fn func(k string, v interface{})) {
 	for k, v := range a.Plugin[a.pluginName][a.scope] {
@@ -59,22 +336,80 @@ func Read(reader io.Reader) *AutoGenerated {
 	}
 	ag.Project.Log.AccessLog = handleIns(ag.Project.Log.AccessLog)
 	ag.Project.Log.ErrorLog = handleIns(ag.Project.Log.ErrorLog)
+	handlePluginIns(ag.Plugin)
+	handleHookIns(ag.Project.Hook)
+	handleWatchdogIns(&ag.Project.Watchdog)
+	names := make(map[string]struct{}, len(ag.Job))
+	for k := range ag.Job {
+		if ag.Job[k].Name == "" {
+			panic("job name is empty")
+		}
+		if _, ok := names[ag.Job[k].Name]; ok {
+			panic("duplicate job name: " + ag.Job[k].Name)
+		}
+		names[ag.Job[k].Name] = struct{}{}
+		for k2 := range ag.Job[k].Install {
+			ag.Job[k].Install[k2] = handleIns(ag.Job[k].Install[k2])
+		}
+		handlePluginIns(ag.Job[k].Plugin)
+		handleHookIns(ag.Job[k].Hook)
+		handleWatchdogIns(&ag.Job[k].Watchdog)
+	}
+	return ag
+}
+
+func handleHookIns(hooks []Hook) {
+	for k := range hooks {
+		if !validHookStage(hooks[k].Stage) {
+			panic("not support hook stage: " + hooks[k].Stage)
+		}
+		hooks[k].Command = handleIns(hooks[k].Command)
+	}
+}
+
+func handleWatchdogIns(w *Watchdog) {
+	for _, v := range []string{w.Threshold, w.Interval} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			panic("invalid watchdog duration: " + v)
+		}
+	}
+	w.Command = handleIns(w.Command)
+	w.URL = handleIns(w.URL)
+}
+
+func handlePluginIns(plugin Plugins) {
 	// Range
-	for k  := range ag.Plugin {
-		for k2 := range ag.Plugin[k] {
-			for k3,v := range ag.Plugin[k][k2] {
-				if s,ok := v.(string); ok {
-					ag.Plugin[k][k2][k3] = handleIns(s)
-				} else if ss,ok := v.([]string); ok {
-					for k := range ss {
-						ss[k] = handleIns(ss[k])
-					}
-					ag.Plugin[k][k2][k3] = ss
-				}
+	for k  := range plugin {
+		for k2 := range plugin[k] {
+			for k3,v := range plugin[k][k2] {
+				plugin[k][k2][k3] = handleValueIns(v)
 			}
 		}
 	}
-	return ag
+}
+
+// 处理字符串、数组以及嵌套的表中的指令
+func handleValueIns(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		return handleIns(value)
+	case []string:
+		for k := range value {
+			value[k] = handleIns(value[k])
+		}
+	case []interface{}:
+		for k := range value {
+			value[k] = handleValueIns(value[k])
+		}
+	case map[string]interface{}:
+		for k := range value {
+			value[k] = handleValueIns(value[k])
+		}
+	}
+	return v
 }
 
 // 未处理的指令会返回原值
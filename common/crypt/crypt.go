@@ -0,0 +1,356 @@
+// Package crypt 实现备份归档的流式认证加密
+//
+// 加密后的文件由文件头和若干个密文块组成:
+//
+//	magic(7字节"BUPSENC") | 版本(1字节) | 文件头长度(4字节大端) | 文件头(JSON)
+//	密文块 | 密文块 | ... | 最后一个密文块
+//
+// 明文被切分为固定大小的块，每一块使用AES-256-GCM独立加密，整个文件头作为附加数据参与认证
+// 块的nonce由文件头中随机的前缀、块的序号和是否为最后一块的标志组成，
+// 因此密文块被调换顺序、删除或者截断都会导致解密失败
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	Magic = "BUPSENC"
+	// Version 当前写入的文件格式的版本
+	Version = 1
+	// KeySize AES-256的密钥长度
+	KeySize = 32
+	// DefaultChunkSize 默认的明文块大小
+	DefaultChunkSize = 64 * 1024
+	CipherAES256GCM  = "aes-256-gcm"
+
+	noncePrefixSize = 7
+	maxChunkSize    = 16 * 1024 * 1024
+	maxHeaderSize   = 64 * 1024
+)
+
+// ErrUnsupported 文件的版本或者算法不被支持
+var ErrUnsupported = errors.New("crypt: unsupported file format")
+
+// Header 加密文件的文件头，记录解密需要的所有参数
+type Header struct {
+	Version   int    `json:"version"`
+	Cipher    string `json:"cipher"`
+	ChunkSize int    `json:"chunk_size"`
+	// 密钥的标识，解密时用于选择密钥
+	KeyID string `json:"key_id"`
+	// 密钥由口令派生时的参数
+	KDF *KDF `json:"kdf,omitempty"`
+	// 使用公钥加密时，随机的文件密钥为每一个接收者加密之后的结果
+	Recipients  []*Stanza `json:"recipients,omitempty"`
+	NoncePrefix []byte    `json:"nonce_prefix"`
+}
+
+// NewHeader 创建使用随机nonce前缀的文件头，chunkSize<=0时使用默认的块大小
+func NewHeader(keyID string, kdf *KDF, chunkSize int) (*Header, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("crypt: chunk size %d is too large", chunkSize)
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	return &Header{
+		Version:     Version,
+		Cipher:      CipherAES256GCM,
+		ChunkSize:   chunkSize,
+		KeyID:       keyID,
+		KDF:         kdf,
+		NoncePrefix: prefix,
+	}, nil
+}
+
+func (h *Header) validate() error {
+	if h.Version != Version || h.Cipher != CipherAES256GCM {
+		return fmt.Errorf("%w: version %d cipher %s", ErrUnsupported, h.Version, h.Cipher)
+	}
+	if h.ChunkSize <= 0 || h.ChunkSize > maxChunkSize || len(h.NoncePrefix) != noncePrefixSize {
+		return fmt.Errorf("%w: invalid chunk size or nonce", ErrUnsupported)
+	}
+	return nil
+}
+
+// 编码文件头，返回的字节同时作为每一块的附加数据
+func (h *Header) encode() ([]byte, error) {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(Magic)+5+len(data)))
+	buf.WriteString(Magic)
+	buf.WriteByte(byte(h.Version))
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// ReadHeader 读取并解析文件头，返回文件头及其原始字节
+func ReadHeader(r io.Reader) (*Header, []byte, error) {
+	prefix := make([]byte, len(Magic)+5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, fmt.Errorf("crypt: read header: %w", err)
+	}
+	if string(prefix[:len(Magic)]) != Magic {
+		return nil, nil, errors.New("crypt: not an encrypted file")
+	}
+	if prefix[len(Magic)] != Version {
+		return nil, nil, fmt.Errorf("%w: version %d", ErrUnsupported, prefix[len(Magic)])
+	}
+	size := binary.BigEndian.Uint32(prefix[len(Magic)+1:])
+	if size > maxHeaderSize {
+		return nil, nil, errors.New("crypt: header is too large")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, fmt.Errorf("crypt: read header: %w", err)
+	}
+	h := new(Header)
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, nil, fmt.Errorf("crypt: decode header: %w", err)
+	}
+	if err := h.validate(); err != nil {
+		return nil, nil, err
+	}
+	return h, append(prefix, data...), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("crypt: key must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 第counter块的nonce，最后一块的标志位为1
+func nonce(prefix []byte, counter uint32, last bool) []byte {
+	n := make([]byte, noncePrefixSize+5)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[noncePrefixSize:], counter)
+	if last {
+		n[len(n)-1] = 1
+	}
+	return n
+}
+
+// Writer 流式加密的写入器，Close时写入最后一块，不关闭下层的io.Writer
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  *Header
+	aad     []byte
+	buf     []byte
+	counter uint32
+	closed  bool
+}
+
+// NewWriter 写入文件头并返回加密的写入器
+func NewWriter(w io.Writer, key []byte, header *Header) (*Writer, error) {
+	if err := header.validate(); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	aad, err := header.encode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(aad); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		header: header,
+		aad:    aad,
+		buf:    make([]byte, 0, header.ChunkSize),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("crypt: write to closed writer")
+	}
+	n := 0
+	for len(p) > 0 {
+		// 缓冲区满并且还有数据时，缓冲区中的块一定不是最后一块
+		if len(w.buf) == w.header.ChunkSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *Writer) seal(last bool) error {
+	if w.counter == math.MaxUint32 {
+		return errors.New("crypt: too many chunks")
+	}
+	out := w.aead.Seal(nil, nonce(w.header.NoncePrefix, w.counter, last), w.buf, w.aad)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(out)
+	return err
+}
+
+// Close 写入最后一块，空的明文同样会写入一个认证的块
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// Reader 流式解密的读取器，返回的明文都已经通过认证
+type Reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  *Header
+	aad     []byte
+	chunk   []byte
+	plain   []byte
+	counter uint32
+	done    bool
+}
+
+// KeyFunc 根据文件头返回解密使用的密钥
+type KeyFunc func(header *Header) ([]byte, error)
+
+// NewReader 读取文件头，通过keyFn获得密钥并返回解密的读取器
+func NewReader(r io.Reader, keyFn KeyFunc) (*Reader, error) {
+	header, aad, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keyFn(header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		r:      bufio.NewReaderSize(r, header.ChunkSize+aead.Overhead()+1),
+		aead:   aead,
+		header: header,
+		aad:    aad,
+		chunk:  make([]byte, header.ChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// Header 加密文件的文件头
+func (r *Reader) Header() *Header {
+	return r.header
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// 读取并解密下一块
+func (r *Reader) open() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	last := false
+	switch err {
+	case nil:
+		// 满块之后没有数据说明这是最后一块
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return errors.New("crypt: file is truncated")
+	default:
+		return err
+	}
+	plain, err := r.aead.Open(r.chunk[:0], nonce(r.header.NoncePrefix, r.counter, last), r.chunk[:n], r.aad)
+	if err != nil {
+		return fmt.Errorf("crypt: chunk %d: authentication failed, wrong key or corrupted file", r.counter)
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+// PassphraseKey 返回使用口令派生密钥的KeyFunc
+func PassphraseKey(passphrase []byte) KeyFunc {
+	return func(header *Header) ([]byte, error) {
+		if header.KDF == nil {
+			return nil, errors.New("crypt: file is not encrypted with a passphrase")
+		}
+		return header.KDF.Derive(passphrase)
+	}
+}
+
+// EncryptWithPassphrase 使用口令加密src并写入dst
+func EncryptWithPassphrase(dst io.Writer, src io.Reader, passphrase []byte, keyID string, kdfName string, chunkSize int) error {
+	w, err := NewPassphraseWriter(dst, passphrase, keyID, kdfName, chunkSize)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// NewPassphraseWriter 返回使用口令加密的写入器，Close之后密文才完整
+func NewPassphraseWriter(dst io.Writer, passphrase []byte, keyID string, kdfName string, chunkSize int) (*Writer, error) {
+	kdf, err := NewKDF(kdfName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := kdf.Derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	header, err := NewHeader(keyID, kdf, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(dst, key, header)
+}
@@ -0,0 +1,91 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"strings"
+)
+
+// 支持的密钥派生函数
+const (
+	KDFScrypt   = "scrypt"
+	KDFArgon2id = "argon2id"
+)
+
+// 解密时允许的最大参数，防止伪造的文件头消耗过多的内存
+const (
+	maxScryptN      = 1 << 20
+	maxArgon2Memory = 1 << 20 // KiB
+	maxArgon2Time   = 16
+)
+
+// KDF 从口令派生密钥的函数及其参数，参数记录在文件头中
+type KDF struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+	// scrypt的参数
+	N int `json:"n,omitempty"`
+	R int `json:"r,omitempty"`
+	P int `json:"p,omitempty"`
+	// argon2id的参数，Memory以KiB计算
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+}
+
+// NewKDF 使用默认的参数和随机的盐创建密钥派生函数
+func NewKDF(name string) (*KDF, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	switch name {
+	case KDFScrypt:
+		return &KDF{Name: name, Salt: salt, N: 1 << 15, R: 8, P: 1}, nil
+	case KDFArgon2id, "":
+		return &KDF{Name: KDFArgon2id, Salt: salt, Time: 3, Memory: 64 * 1024, Threads: 4}, nil
+	default:
+		return nil, fmt.Errorf("crypt: not support kdf %s", name)
+	}
+}
+
+// Derive 从口令派生32字节的密钥
+func (k *KDF) Derive(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("crypt: passphrase is empty")
+	}
+	if len(k.Salt) < 8 {
+		return nil, errors.New("crypt: kdf salt is too short")
+	}
+	switch k.Name {
+	case KDFScrypt:
+		if k.N <= 1 || k.N > maxScryptN || k.R <= 0 || k.P <= 0 || k.R*k.P >= 1<<30 {
+			return nil, fmt.Errorf("crypt: invalid scrypt parameters n=%d r=%d p=%d", k.N, k.R, k.P)
+		}
+		return scrypt.Key(passphrase, k.Salt, k.N, k.R, k.P, KeySize)
+	case KDFArgon2id:
+		if k.Time == 0 || k.Time > maxArgon2Time || k.Memory == 0 || k.Memory > maxArgon2Memory || k.Threads == 0 {
+			return nil, fmt.Errorf("crypt: invalid argon2id parameters time=%d memory=%d threads=%d", k.Time, k.Memory, k.Threads)
+		}
+		return argon2.IDKey(passphrase, k.Salt, k.Time, k.Memory, k.Threads, KeySize), nil
+	default:
+		return nil, fmt.Errorf("crypt: not support kdf %s", k.Name)
+	}
+}
+
+// ReadKeyFile 从文件中读取口令，忽略末尾的换行
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return nil, fmt.Errorf("crypt: key file %s is empty", path)
+	}
+	return []byte(passphrase), nil
+}
@@ -0,0 +1,241 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// 公钥和私钥的文本格式，与age的风格一致
+const (
+	PublicKeyPrefix = "bups1"
+	SecretKeyPrefix = "BUPS-SECRET-KEY-1"
+	StanzaX25519    = "X25519"
+
+	x25519Info = "bups-x25519"
+)
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Stanza 文件密钥为一个接收者加密之后的结果，记录在文件头中
+type Stanza struct {
+	Type string `json:"type"`
+	// 临时的公钥
+	Ephemeral []byte `json:"ephemeral"`
+	// 加密的文件密钥
+	Body []byte `json:"body"`
+}
+
+// Recipient X25519的接收者，即公钥，加密的主机只需要持有公钥
+type Recipient struct {
+	pub []byte
+}
+
+// ParseRecipient 解析bups1开头的公钥
+func ParseRecipient(s string) (*Recipient, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(strings.ToLower(s), PublicKeyPrefix) {
+		return nil, fmt.Errorf("crypt: recipient %q does not start with %s", s, PublicKeyPrefix)
+	}
+	pub, err := keyEncoding.DecodeString(strings.ToUpper(s[len(PublicKeyPrefix):]))
+	if err != nil || len(pub) != curve25519.PointSize {
+		return nil, fmt.Errorf("crypt: invalid recipient %q", s)
+	}
+	return &Recipient{pub: pub}, nil
+}
+
+func (r *Recipient) String() string {
+	return PublicKeyPrefix + strings.ToLower(keyEncoding.EncodeToString(r.pub))
+}
+
+// Wrap 为接收者加密文件密钥
+// 使用临时私钥与接收者的公钥协商共享密钥，再通过HKDF派生加密文件密钥的密钥
+func (r *Recipient) Wrap(fileKey []byte) (*Stanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, r.pub)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := x25519WrapKey(shared, ephemeralPub, r.pub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	// 每个包装密钥只使用一次，nonce可以为0
+	body := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+	return &Stanza{Type: StanzaX25519, Ephemeral: ephemeralPub, Body: body}, nil
+}
+
+func x25519WrapKey(shared, ephemeralPub, pub []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeralPub)+len(pub))
+	salt = append(salt, ephemeralPub...)
+	salt = append(salt, pub...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519Info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Identity X25519的私钥，应该离线保存
+type Identity struct {
+	secret []byte
+	pub    []byte
+}
+
+// GenerateIdentity 生成新的密钥对
+func GenerateIdentity() (*Identity, error) {
+	secret := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return newIdentity(secret)
+}
+
+func newIdentity(secret []byte) (*Identity, error) {
+	pub, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{secret: secret, pub: pub}, nil
+}
+
+// ParseIdentity 解析BUPS-SECRET-KEY-1开头的私钥
+func ParseIdentity(s string) (*Identity, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(strings.ToUpper(s), SecretKeyPrefix) {
+		return nil, errors.New("crypt: identity does not start with " + SecretKeyPrefix)
+	}
+	secret, err := keyEncoding.DecodeString(strings.ToUpper(s[len(SecretKeyPrefix):]))
+	if err != nil || len(secret) != curve25519.ScalarSize {
+		return nil, errors.New("crypt: invalid identity")
+	}
+	return newIdentity(secret)
+}
+
+// ReadIdentities 从文件中读取私钥，忽略空行和#开头的注释
+func ReadIdentities(path string) ([]*Identity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	identities := make([]*Identity, 0, 1)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		identity, err := ParseIdentity(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("crypt: no identity in %s", path)
+	}
+	return identities, nil
+}
+
+func (i *Identity) String() string {
+	return SecretKeyPrefix + keyEncoding.EncodeToString(i.secret)
+}
+
+// Recipient 私钥对应的公钥
+func (i *Identity) Recipient() *Recipient {
+	return &Recipient{pub: i.pub}
+}
+
+// Unwrap 解密为该私钥加密的文件密钥
+func (i *Identity) Unwrap(s *Stanza) ([]byte, error) {
+	if s.Type != StanzaX25519 || len(s.Ephemeral) != curve25519.PointSize {
+		return nil, errors.New("crypt: not a x25519 stanza")
+	}
+	shared, err := curve25519.X25519(i.secret, s.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := x25519WrapKey(shared, s.Ephemeral, i.pub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), s.Body, nil)
+	if err != nil || len(fileKey) != KeySize {
+		return nil, errors.New("crypt: stanza is not for this identity")
+	}
+	return fileKey, nil
+}
+
+// IdentityKey 返回使用私钥解密文件密钥的KeyFunc，依次尝试每一个私钥和每一个接收者
+func IdentityKey(identities ...*Identity) KeyFunc {
+	return func(header *Header) ([]byte, error) {
+		if len(header.Recipients) == 0 {
+			return nil, errors.New("crypt: file is not encrypted to recipients")
+		}
+		for _, identity := range identities {
+			for _, stanza := range header.Recipients {
+				if fileKey, err := identity.Unwrap(stanza); err == nil {
+					return fileKey, nil
+				}
+			}
+		}
+		return nil, errors.New("crypt: no identity matches the recipients of the file")
+	}
+}
+
+// EncryptToRecipients 使用随机的文件密钥加密src，文件密钥为每一个接收者单独加密
+func EncryptToRecipients(dst io.Writer, src io.Reader, recipients []*Recipient, keyID string, chunkSize int) error {
+	w, err := NewRecipientsWriter(dst, recipients, keyID, chunkSize)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// NewRecipientsWriter 返回加密到接收者的写入器，Close之后密文才完整
+func NewRecipientsWriter(dst io.Writer, recipients []*Recipient, keyID string, chunkSize int) (*Writer, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("crypt: no recipient")
+	}
+	fileKey := make([]byte, KeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	header, err := NewHeader(keyID, nil, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range recipients {
+		stanza, err := v.Wrap(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		header.Recipients = append(header.Recipients, stanza)
+	}
+	return NewWriter(dst, fileKey, header)
+}
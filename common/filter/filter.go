@@ -0,0 +1,319 @@
+// Package filter 决定备份目录时哪些文件被排除
+//
+// 规则使用与.gitignore相同的语义:
+//   - 空行和#开头的行被忽略，\#和\!转义开头的#和!
+//   - !开头的规则重新包含之前被排除的文件，但是不能包含被排除的目录中的文件
+//   - /结尾的规则只匹配目录
+//   - 开头或者中间有/的规则相对于规则所在的目录，否则匹配任意一级的文件名
+//   - *和?不匹配/，**/匹配零或多级目录，/**匹配目录中的全部内容
+//
+// re:开头的规则为正则表达式，匹配相对于规则所在目录的路径(以/分隔)
+// 后面的规则优先于前面的规则，目录中的忽略文件(.bupsignore)优先于上级目录和配置中的规则
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultIgnoreFile 目录中的忽略文件的默认名字
+const DefaultIgnoreFile = ".bupsignore"
+
+// 正则表达式规则的前缀
+const regexPrefix = "re:"
+
+// Rule 一条排除或者包含的规则
+type Rule struct {
+	// 规则所在的目录，相对于备份的根目录，为空时是根目录
+	Base string
+	// 重新包含匹配的文件
+	Negate bool
+	// 只匹配目录
+	DirOnly bool
+	re      *regexp.Regexp
+	pattern string
+}
+
+// ParseRule 解析一条规则，空行和注释返回nil
+func ParseRule(line string, base string) (*Rule, error) {
+	line = strings.TrimRight(line, "\r")
+	// 行末没有转义的空格被忽略
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	r := &Rule{Base: strings.Trim(filepath.ToSlash(base), "/"), pattern: line}
+	if strings.HasPrefix(line, "!") {
+		r.Negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	var err error
+	if strings.HasPrefix(line, regexPrefix) {
+		if r.re, err = regexp.Compile(line[len(regexPrefix):]); err != nil {
+			return nil, fmt.Errorf("filter: invalid rule %q: %w", r.pattern, err)
+		}
+		return r, nil
+	}
+	if strings.HasSuffix(line, "/") {
+		r.DirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, fmt.Errorf("filter: invalid rule %q", r.pattern)
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	expr := "^" + globToRegexp(line) + "$"
+	if !anchored {
+		expr = "^(?:.*/)?" + globToRegexp(line) + "$"
+	}
+	if r.re, err = regexp.Compile(expr); err != nil {
+		return nil, fmt.Errorf("filter: invalid rule %q: %w", r.pattern, err)
+	}
+	return r, nil
+}
+
+// 将gitignore的通配符转换为正则表达式
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' && (i == 0 || glob[i-1] == '/') {
+				switch {
+				case i+2 == len(glob):
+					// 结尾的/**匹配目录中的全部内容
+					b.WriteString(".*")
+					i++
+					continue
+				case glob[i+2] == '/':
+					// **/匹配零或多级目录
+					b.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				}
+			}
+			b.WriteString("[^/]*")
+			for i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// Match 规则是否匹配rel，rel为相对于备份的根目录的路径，以/分隔
+func (r *Rule) Match(rel string, isDir bool) bool {
+	if r.DirOnly && !isDir {
+		return false
+	}
+	if r.Base != "" {
+		if !strings.HasPrefix(rel, r.Base+"/") {
+			return false
+		}
+		rel = rel[len(r.Base)+1:]
+	}
+	return r.re.MatchString(rel)
+}
+
+func (r *Rule) String() string {
+	return r.pattern
+}
+
+// Filter 备份一个目录时使用的过滤器，实现archiver.Filter
+// 同一个Filter不能被多个目录同时使用
+type Filter struct {
+	Rules []*Rule
+	// 大于MaxSize字节的文件被跳过，为0时不限制
+	MaxSize int64
+	// 修改时间距离现在小于SkipNewer的文件被跳过，避免备份正在写入的文件
+	SkipNewer time.Duration
+	// 目录中的忽略文件的名字，为空时不读取
+	IgnoreFile string
+	// 计算SkipNewer的当前时间，为零值时使用第一次过滤的时间
+	Now time.Time
+	// 跳过的文件数和字节数，跳过的目录计算其中全部的文件
+	SkippedFiles int64
+	SkippedBytes int64
+}
+
+// New 使用排除和包含的规则创建过滤器，包含的规则在排除的规则之后生效
+func New(exclude []string, include []string) (*Filter, error) {
+	f := &Filter{IgnoreFile: DefaultIgnoreFile}
+	if err := f.Add("", exclude...); err != nil {
+		return nil, err
+	}
+	for _, p := range include {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if err := f.Add("", "!"+strings.TrimPrefix(p, "!")); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Add 添加base目录中的规则
+func (f *Filter) Add(base string, lines ...string) error {
+	for _, line := range lines {
+		r, err := ParseRule(line, base)
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			f.Rules = append(f.Rules, r)
+		}
+	}
+	return nil
+}
+
+// Excluded 路径是否被规则排除，最后一条匹配的规则决定结果
+func (f *Filter) Excluded(rel string, isDir bool) bool {
+	excluded := false
+	for _, r := range f.Rules {
+		if r.Match(rel, isDir) {
+			excluded = !r.Negate
+		}
+	}
+	return excluded
+}
+
+// Skip 决定是否跳过一个文件或者目录，rel为相对于备份的根目录的路径
+// 进入没有被跳过的目录时读取其中的忽略文件
+func (f *Filter) Skip(path string, rel string, info os.FileInfo) (bool, error) {
+	if f.Now.IsZero() {
+		f.Now = time.Now()
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		if info.IsDir() {
+			return false, f.readIgnoreFile(path, "")
+		}
+		return false, nil
+	}
+	if info.IsDir() {
+		if f.Excluded(rel, true) {
+			return true, f.countTree(path)
+		}
+		return false, f.readIgnoreFile(path, rel)
+	}
+	skip := f.Excluded(rel, false) ||
+		(f.MaxSize > 0 && info.Mode().IsRegular() && info.Size() > f.MaxSize) ||
+		(f.SkipNewer > 0 && f.Now.Sub(info.ModTime()) < f.SkipNewer)
+	if skip {
+		f.count(info)
+	}
+	return skip, nil
+}
+
+func (f *Filter) count(info os.FileInfo) {
+	f.SkippedFiles++
+	if info.Mode().IsRegular() {
+		f.SkippedBytes += info.Size()
+	}
+}
+
+// 统计被跳过的目录中的文件
+func (f *Filter) countTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			f.count(info)
+		}
+		return nil
+	})
+}
+
+func (f *Filter) readIgnoreFile(dir string, base string) error {
+	if f.IgnoreFile == "" {
+		return nil
+	}
+	file, err := os.Open(filepath.Join(dir, f.IgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if err := f.Add(base, scanner.Text()); err != nil {
+			return fmt.Errorf("%s: %w", file.Name(), err)
+		}
+	}
+	return scanner.Err()
+}
+
+// ParseSize 解析文件大小，支持整数的字节数或者带有单位的字符串，比如100MB、1.5GiB
+func ParseSize(v interface{}) (int64, error) {
+	switch s := v.(type) {
+	case int64:
+		return s, nil
+	case int:
+		return int64(s), nil
+	case float64:
+		return int64(s), nil
+	case string:
+		text := strings.ToUpper(strings.TrimSpace(s))
+		units := []struct {
+			suffix string
+			size   float64
+		}{
+			{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+			{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+			{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+			{"B", 1},
+		}
+		unit := 1.0
+		for _, u := range units {
+			if strings.HasSuffix(text, u.suffix) {
+				unit = u.size
+				text = strings.TrimSpace(strings.TrimSuffix(text, u.suffix))
+				break
+			}
+		}
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("filter: invalid size %q", s)
+		}
+		return int64(n * unit), nil
+	default:
+		return 0, fmt.Errorf("filter: invalid size %v", v)
+	}
+}
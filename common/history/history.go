@@ -0,0 +1,201 @@
+// Package history 持久化每一次流水线运行的结果
+// 记录以JSON Lines的格式追加到缓存目录下的文件中
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/abingzo/bups/common/plugin"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailed  = "failed"
+	OutcomeSkipped = "skipped"
+)
+
+// Entry 一次运行的记录
+type Entry struct {
+	RunID     string          `json:"run_id"`
+	Job       string          `json:"job"`
+	StartTime time.Time       `json:"start_time"`
+	EndTime   time.Time       `json:"end_time"`
+	Outcome   string          `json:"outcome"`
+	Error     string          `json:"error,omitempty"`
+	Plugins   []PluginEntry   `json:"plugins"`
+	Artifacts []ArtifactEntry `json:"artifacts"`
+}
+
+// PluginEntry 一个插件在运行中的记录
+type PluginEntry struct {
+	Plugin   string        `json:"plugin"`
+	Stage    string        `json:"stage"`
+	Duration time.Duration `json:"duration"`
+	Outcome  string        `json:"outcome"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// ArtifactEntry 运行中产生的文件
+type ArtifactEntry struct {
+	Plugin string `json:"plugin"`
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+}
+
+// FromRun 将完成的流水线转换为记录
+func FromRun(run *plugin.Run) Entry {
+	entry := Entry{
+		RunID:     run.ID,
+		Job:       run.Job,
+		StartTime: run.StartTime,
+		EndTime:   run.EndTime,
+		Outcome:   OutcomeSuccess,
+	}
+	if err := run.Err(); err != nil {
+		entry.Outcome = OutcomeFailed
+		entry.Error = err.Error()
+	}
+	for _, v := range run.Results() {
+		pe := PluginEntry{
+			Plugin:   v.Plugin,
+			Stage:    v.Stage.String(),
+			Duration: v.Duration,
+			Outcome:  OutcomeSuccess,
+		}
+		switch {
+		case v.Skipped:
+			pe.Outcome = OutcomeSkipped
+		case v.Err != nil:
+			pe.Outcome = OutcomeFailed
+			pe.Error = v.Err.Error()
+		}
+		entry.Plugins = append(entry.Plugins, pe)
+	}
+	for _, v := range run.Artifacts() {
+		entry.Artifacts = append(entry.Artifacts, ArtifactEntry{
+			Plugin: v.Plugin,
+			Kind:   string(v.Kind),
+			Path:   v.Path,
+			Size:   v.Size,
+		})
+	}
+	return entry
+}
+
+// Duration 整个运行花费的时间
+func (e *Entry) Duration() time.Duration {
+	return e.EndTime.Sub(e.StartTime)
+}
+
+// ArchiveSize 运行中产生的最终归档的大小
+func (e *Entry) ArchiveSize() int64 {
+	var size int64
+	for _, v := range e.Artifacts {
+		if v.Kind == string(plugin.KindArchive) {
+			size += v.Size
+		}
+	}
+	return size
+}
+
+// Store 运行历史的存储
+type Store struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Append 追加一条记录
+func (s *Store) Append(entry Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// List 按时间从新到旧返回记录，job为空时返回所有任务的记录，limit<=0时不限制数量
+func (s *Store) List(job string, limit int) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, err
+		}
+		if job != "" && entry.Job != job {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// 翻转为从新到旧
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// WriteTable 以表格的形式输出记录
+func WriteTable(writer io.Writer, entries []Entry) error {
+	tw := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN ID\tJOB\tSTART\tDURATION\tOUTCOME\tARCHIVE SIZE\tPLUGINS\tERROR")
+	for _, v := range entries {
+		plugins := make([]string, len(v.Plugins))
+		for k, p := range v.Plugins {
+			plugins[k] = fmt.Sprintf("%s:%s(%s)", p.Plugin, p.Outcome, p.Duration.Round(time.Millisecond))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			v.RunID, v.Job, v.StartTime.Format("2006-01-02 15:04:05"), v.Duration().Round(time.Millisecond),
+			v.Outcome, v.ArchiveSize(), strings.Join(plugins, ","), v.Error)
+	}
+	return tw.Flush()
+}
+
+// WriteJSON 以JSON数组的形式输出记录
+func WriteJSON(writer io.Writer, entries []Entry) error {
+	if entries == nil {
+		entries = []Entry{}
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(entries)
+}
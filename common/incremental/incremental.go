@@ -0,0 +1,302 @@
+// Package incremental 使用清单实现目录的增量备份
+//
+// 每一次备份之后保存目录中所有文件的路径、大小、修改时间、权限和内容的sha256
+// 下一次备份与清单比较，只归档新增和修改的文件，并在归档中记录被删除的文件
+// 一条备份链由一个完整备份和之后的增量备份组成，恢复时依次解压即可得到任意一次备份时的目录
+package incremental
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/archiver"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	TypeFull        = "full"
+	TypeIncremental = "incremental"
+	// InfoName 归档中记录备份信息和删除列表的文件，位于归档的根目录
+	InfoName = ".bups-increment.json"
+
+	manifestVersion = 1
+)
+
+// File 清单中的一个文件或者目录
+type File struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	// 普通文件内容的sha256
+	Hash string `json:"hash,omitempty"`
+	// 符号链接的目标
+	Link string `json:"link,omitempty"`
+}
+
+// Manifest 一次备份之后目录的清单
+type Manifest struct {
+	Version int    `json:"version"`
+	Source  string `json:"source"`
+	// 备份链的标识，即完整备份的标识
+	Chain string `json:"chain"`
+	// 完整备份为0，之后的增量备份依次加1
+	Sequence int              `json:"sequence"`
+	Created  time.Time        `json:"created"`
+	Files    map[string]*File `json:"files"`
+}
+
+// Info 写入归档中的备份信息
+type Info struct {
+	Type     string    `json:"type"`
+	Source   string    `json:"source"`
+	Chain    string    `json:"chain"`
+	Sequence int       `json:"sequence"`
+	Created  time.Time `json:"created"`
+	// 归档中目录的名字，即备份的目录的最后一级
+	Root string `json:"root"`
+	// 相对于Root的被删除的文件和目录
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// ReadManifest 读取清单，清单不存在时返回nil
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("incremental: invalid manifest %s: %w", path, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("incremental: not support manifest version %d", m.Version)
+	}
+	return m, nil
+}
+
+// WriteFile 写入清单，先写入临时文件再重命名，中断时不会留下损坏的清单
+func (m *Manifest) WriteFile(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Tracker 实现archiver.Filter，记录新的清单并跳过与上一次备份相同的文件
+type Tracker struct {
+	// 排除规则等其它的过滤器，可以为nil
+	Inner archiver.Filter
+	prev  *Manifest
+	next  *Manifest
+	full  bool
+	// 写入归档和没有变化的文件数
+	Changed   int
+	Unchanged int
+}
+
+// NewTracker 上一次的清单为nil或者full为true时进行完整备份，chain为新的备份链的标识
+func NewTracker(prev *Manifest, source string, full bool, chain string) *Tracker {
+	t := &Tracker{prev: prev, full: full || prev == nil || prev.Source != source}
+	t.next = &Manifest{
+		Version: manifestVersion,
+		Source:  source,
+		Chain:   chain,
+		Created: time.Now(),
+		Files:   make(map[string]*File),
+	}
+	if !t.full {
+		t.next.Chain = prev.Chain
+		t.next.Sequence = prev.Sequence + 1
+	}
+	return t
+}
+
+// Full 是否为完整备份
+func (t *Tracker) Full() bool {
+	return t.full
+}
+
+// Manifest 备份之后的清单，AddTree完成之后才是完整的
+func (t *Tracker) Manifest() *Manifest {
+	return t.next
+}
+
+// Skip 实现archiver.Filter，目录总是写入归档以保留目录的元数据
+func (t *Tracker) Skip(path string, rel string, info os.FileInfo) (bool, error) {
+	if t.Inner != nil {
+		skip, err := t.Inner.Skip(path, rel, info)
+		if err != nil || skip {
+			return skip, err
+		}
+	}
+	if rel == "." {
+		return false, nil
+	}
+	rel = filepath.ToSlash(rel)
+	f := &File{Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode()}
+	if info.IsDir() {
+		f.Size = 0
+		t.next.Files[rel] = f
+		return false, nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return false, err
+		}
+		f.Link = link
+	}
+	var old *File
+	if !t.full {
+		old = t.prev.Files[rel]
+	}
+	if info.Mode().IsRegular() {
+		// 大小和修改时间没有变化时认为内容没有变化，不再读取文件
+		if old != nil && old.Size == f.Size && old.ModTime.Equal(f.ModTime) && old.Hash != "" {
+			f.Hash = old.Hash
+		} else {
+			hash, err := hashFile(path)
+			if err != nil {
+				return false, err
+			}
+			f.Hash = hash
+		}
+	}
+	t.next.Files[rel] = f
+	// 只有修改时间变化而内容相同的文件也被认为没有变化
+	if old != nil && old.Mode == f.Mode && old.Size == f.Size && old.Hash == f.Hash && old.Link == f.Link {
+		t.Unchanged++
+		return true, nil
+	}
+	t.Changed++
+	return false, nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Info 备份的信息，增量备份包含上一次备份之后被删除的文件
+func (t *Tracker) Info(root string) *Info {
+	info := &Info{
+		Type:     TypeIncremental,
+		Source:   t.next.Source,
+		Chain:    t.next.Chain,
+		Sequence: t.next.Sequence,
+		Created:  t.next.Created,
+		Root:     root,
+	}
+	if t.full {
+		info.Type = TypeFull
+		return info
+	}
+	for name := range t.prev.Files {
+		if _, ok := t.next.Files[name]; !ok {
+			info.Deleted = append(info.Deleted, name)
+		}
+	}
+	sort.Strings(info.Deleted)
+	return info
+}
+
+// ReadInfo 读取归档中的备份信息，不是由增量备份产生的归档返回nil
+func ReadInfo(archive string) (*Info, error) {
+	data, err := archiver.ReadFile(archive, InfoName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	info := &Info{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("incremental: invalid %s in %s: %w", InfoName, archive, err)
+	}
+	return info, nil
+}
+
+// Restore 将一个完整备份和之后的增量备份依次恢复到dst，得到最后一个增量备份时的目录
+// 归档可以以任意的顺序给出，但是必须属于同一条备份链并且序号连续
+// 只有一个不是由增量备份产生的归档时直接解压
+func Restore(archives []string, dst string, opts archiver.ExtractOptions) error {
+	if len(archives) == 0 {
+		return errors.New("incremental: no archive to restore")
+	}
+	type item struct {
+		path string
+		info *Info
+	}
+	items := make([]item, 0, len(archives))
+	for _, path := range archives {
+		info, err := ReadInfo(path)
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			if len(archives) == 1 {
+				return archiver.Extract(path, dst, opts)
+			}
+			return fmt.Errorf("incremental: %s is not created by an incremental backup", path)
+		}
+		items = append(items, item{path: path, info: info})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].info.Sequence < items[j].info.Sequence
+	})
+	first := items[0].info
+	if first.Type != TypeFull || first.Sequence != 0 {
+		return fmt.Errorf("incremental: chain %s has no full backup, the first archive is %s", first.Chain, items[0].path)
+	}
+	for i, v := range items {
+		if v.info.Chain != first.Chain || v.info.Root != first.Root {
+			return fmt.Errorf("incremental: %s does not belong to chain %s", v.path, first.Chain)
+		}
+		if v.info.Sequence != i {
+			return fmt.Errorf("incremental: chain %s is missing incremental backup %d", first.Chain, i)
+		}
+	}
+	for _, v := range items {
+		if err := archiver.Extract(v.path, dst, opts); err != nil {
+			return err
+		}
+		for _, name := range v.info.Deleted {
+			// 删除列表来自归档，不能删除dst之外的文件
+			rel := filepath.Clean(filepath.Join(v.info.Root, filepath.FromSlash(name)))
+			if filepath.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("incremental: illegal deleted path %s in %s", name, v.path)
+			}
+			if err := os.RemoveAll(filepath.Join(dst, rel)); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(filepath.Join(dst, InfoName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Package metrics 以Prometheus文本格式导出备份流水线的指标
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/abingzo/bups/common/history"
+	"github.com/abingzo/bups/common/plugin"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentType Prometheus文本格式的类型
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// 一个任务的指标
+type jobMetrics struct {
+	lastRun     time.Time
+	lastSuccess time.Time
+	nextRun     time.Time
+	// 最近一次运行的耗时
+	runDuration float64
+	// 按结果统计的运行次数
+	runs map[string]int64
+	// 最近一次运行中每个阶段及每个插件的耗时
+	stages  map[string]float64
+	plugins map[[2]string]float64
+	// 最近一次运行产生的归档大小
+	archiveBytes   int64
+	uploadAttempts int64
+	uploadFailures int64
+}
+
+// Registry 收集所有任务的指标
+type Registry struct {
+	mu   sync.Mutex
+	jobs map[string]*jobMetrics
+}
+
+func NewRegistry() *Registry {
+	return &Registry{jobs: make(map[string]*jobMetrics)}
+}
+
+func (r *Registry) job(name string) *jobMetrics {
+	jm, ok := r.jobs[name]
+	if !ok {
+		jm = &jobMetrics{
+			runs:    make(map[string]int64),
+			stages:  make(map[string]float64),
+			plugins: make(map[[2]string]float64),
+		}
+		r.jobs[name] = jm
+	}
+	return jm
+}
+
+// Observe 记录一次完成的运行，可以直接作为Context.OnRunComplete的回调
+func (r *Registry) Observe(run *plugin.Run) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	jm := r.job(run.Job)
+	jm.lastRun = run.EndTime
+	jm.runDuration = run.EndTime.Sub(run.StartTime).Seconds()
+	if run.Err() == nil {
+		jm.lastSuccess = run.EndTime
+		jm.runs[history.OutcomeSuccess]++
+	} else {
+		jm.runs[history.OutcomeFailed]++
+	}
+	jm.stages = make(map[string]float64)
+	jm.plugins = make(map[[2]string]float64)
+	for _, v := range run.Results() {
+		stage := v.Stage.String()
+		jm.stages[stage] += v.Duration.Seconds()
+		jm.plugins[[2]string{stage, v.Plugin}] += v.Duration.Seconds()
+	}
+	jm.archiveBytes = 0
+	for _, v := range run.ArtifactsByKind(plugin.KindArchive) {
+		jm.archiveBytes += v.Size
+	}
+	counters := run.Counters()
+	jm.uploadAttempts += counters[plugin.CounterUploadAttempts]
+	jm.uploadFailures += counters[plugin.CounterUploadFailures]
+}
+
+// Seed 使用运行历史恢复最近一次成功的时间，重启之后指标不会丢失
+func (r *Registry) Seed(entries []history.Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range entries {
+		jm := r.job(v.Job)
+		if v.EndTime.After(jm.lastRun) {
+			jm.lastRun = v.EndTime
+		}
+		if v.Outcome == history.OutcomeSuccess && v.EndTime.After(jm.lastSuccess) {
+			jm.lastSuccess = v.EndTime
+		}
+	}
+}
+
+// SetNextRun 记录任务下一次运行的时间，由调度循环在每次等待之前设置
+func (r *Registry) SetNextRun(job string, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.job(job).nextRun = t
+}
+
+// LastSuccess 任务最近一次成功的时间，没有成功过时返回零值
+func (r *Registry) LastSuccess(job string) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if jm, ok := r.jobs[job]; ok {
+		return jm.lastSuccess
+	}
+	return time.Time{}
+}
+
+type sample struct {
+	labels []string // 依次为名字和值
+	value  float64
+}
+
+type family struct {
+	name, help, typ string
+	samples         []sample
+}
+
+// Write 以Prometheus文本格式输出所有指标
+func (r *Registry) Write(writer io.Writer) error {
+	r.mu.Lock()
+	jobs := make([]string, 0, len(r.jobs))
+	for k := range r.jobs {
+		jobs = append(jobs, k)
+	}
+	sort.Strings(jobs)
+	families := []*family{
+		{name: "bups_last_run_timestamp_seconds", help: "Unix time of the last finished run.", typ: "gauge"},
+		{name: "bups_last_success_timestamp_seconds", help: "Unix time of the last successful run.", typ: "gauge"},
+		{name: "bups_next_run_timestamp_seconds", help: "Unix time of the next scheduled run.", typ: "gauge"},
+		{name: "bups_runs_total", help: "Finished runs by outcome.", typ: "counter"},
+		{name: "bups_run_duration_seconds", help: "Duration of the last run.", typ: "gauge"},
+		{name: "bups_stage_duration_seconds", help: "Duration of each stage in the last run.", typ: "gauge"},
+		{name: "bups_plugin_duration_seconds", help: "Duration of each plugin in the last run.", typ: "gauge"},
+		{name: "bups_archive_bytes", help: "Size of the archives produced by the last run.", typ: "gauge"},
+		{name: "bups_upload_attempts_total", help: "Upload attempts.", typ: "counter"},
+		{name: "bups_upload_failures_total", help: "Failed upload attempts.", typ: "counter"},
+	}
+	timestamp := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixNano()) / 1e9
+	}
+	for _, job := range jobs {
+		jm := r.jobs[job]
+		label := []string{"job", job}
+		families[0].samples = append(families[0].samples, sample{label, timestamp(jm.lastRun)})
+		families[1].samples = append(families[1].samples, sample{label, timestamp(jm.lastSuccess)})
+		families[2].samples = append(families[2].samples, sample{label, timestamp(jm.nextRun)})
+		for _, outcome := range []string{history.OutcomeSuccess, history.OutcomeFailed} {
+			families[3].samples = append(families[3].samples, sample{[]string{"job", job, "outcome", outcome}, float64(jm.runs[outcome])})
+		}
+		families[4].samples = append(families[4].samples, sample{label, jm.runDuration})
+		for _, stage := range sortedKeys(jm.stages) {
+			families[5].samples = append(families[5].samples, sample{[]string{"job", job, "stage", stage}, jm.stages[stage]})
+		}
+		pluginKeys := make([][2]string, 0, len(jm.plugins))
+		for k := range jm.plugins {
+			pluginKeys = append(pluginKeys, k)
+		}
+		sort.Slice(pluginKeys, func(i, j int) bool {
+			if pluginKeys[i][0] != pluginKeys[j][0] {
+				return pluginKeys[i][0] < pluginKeys[j][0]
+			}
+			return pluginKeys[i][1] < pluginKeys[j][1]
+		})
+		for _, k := range pluginKeys {
+			families[6].samples = append(families[6].samples, sample{[]string{"job", job, "stage", k[0], "plugin", k[1]}, jm.plugins[k]})
+		}
+		families[7].samples = append(families[7].samples, sample{label, float64(jm.archiveBytes)})
+		families[8].samples = append(families[8].samples, sample{label, float64(jm.uploadAttempts)})
+		families[9].samples = append(families[9].samples, sample{label, float64(jm.uploadFailures)})
+	}
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(writer)
+	for _, f := range families {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.samples {
+			buf.WriteString(f.name)
+			if len(s.labels) > 0 {
+				pairs := make([]string, 0, len(s.labels)/2)
+				for i := 0; i+1 < len(s.labels); i += 2 {
+					pairs = append(pairs, s.labels[i]+`="`+escape(s.labels[i+1])+`"`)
+				}
+				buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			buf.WriteString(" " + strconv.FormatFloat(s.value, 'f', -1, 64) + "\n")
+		}
+	}
+	return buf.Flush()
+}
+
+// ServeHTTP 实现http.Handler
+func (r *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", ContentType)
+	_ = r.Write(writer)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return labelEscaper.Replace(s)
+}
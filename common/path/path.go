@@ -4,4 +4,5 @@ package path
 const (
 	DEFAULT_PATH_CONFIG_FILE  = "./config.toml" // 默认的配置文件路径
 	DEFAULT_PATH_BACK_UPCACHE = "./cache"       // 默认的缓存数据放置文件夹
+	DEFAULT_PATH_HISTORY_FILE = DEFAULT_PATH_BACK_UPCACHE + "/history.jsonl" // 运行历史的记录文件
 )
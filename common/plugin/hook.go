@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// 钩子输出写入日志时保留的最大长度
+const hookOutputLimit = 4096
+
+// 每个阶段之前和之后执行的钩子
+var stageHooks = map[Type][2]string{
+	BCollect:  {config.HookBeforeCollect, config.HookAfterCollect},
+	BHandle:   {config.HookBeforeHandle, config.HookAfterHandle},
+	BCallBack: {config.HookBeforeCallBack, config.HookAfterCallBack},
+}
+
+// HookError 钩子以非0状态退出或者超时
+type HookError struct {
+	Stage   string
+	Command string
+	Output  []byte
+	Err     error
+}
+
+func (h *HookError) Error() string {
+	return fmt.Sprintf("hook %s %q failed: %s", h.Stage, h.Command, h.Err)
+}
+
+// SetHooks 设置任务的钩子
+func (c *Context) SetHooks(job string, hooks []config.Hook) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pipeline(job).hooks = hooks
+}
+
+// 执行某个时机的所有钩子，设置了abort的钩子失败时中止本次运行
+func (c *Context) runHooks(hooks []config.Hook, run *Run, stage string, s Type) {
+	for _, hook := range hooks {
+		if hook.Stage != stage {
+			continue
+		}
+		output, err := runHook(hook, run)
+		if err == nil {
+			c.logInfo(fmt.Sprintf("%s: hook %s %q complete: %s", run, stage, hook.Command, truncate(output)))
+			continue
+		}
+		c.logError(fmt.Sprintf("%s: %s: %s", run, err, truncate(output)))
+		// on_failure在运行结束之后执行，没有可以中止的阶段
+		if hook.Abort && stage != config.HookOnFailure && !run.Aborted() {
+			run.AddResult(Result{
+				Plugin: "hook:" + stage,
+				Stage:  s,
+				Err:    err,
+			})
+			run.Abort()
+		}
+	}
+}
+
+// 使用系统的shell执行钩子，运行的信息通过环境变量传递
+//
+//	BUPS_RUN_ID    运行的ID
+//	BUPS_JOB       任务名
+//	BUPS_STAGE     钩子的时机
+//	BUPS_ARTIFACTS 产物的路径，以路径列表分隔符分隔
+//	BUPS_ERROR     当前运行的错误
+func runHook(hook config.Hook, run *Run) ([]byte, error) {
+	artifacts := run.Artifacts()
+	paths := make([]string, len(artifacts))
+	for k, v := range artifacts {
+		paths[k] = v.Path
+	}
+	runErr := ""
+	if err := run.Err(); err != nil {
+		runErr = err.Error()
+	}
+	output, err := RunCommand(hook.Command, hook.TimeoutDuration(),
+		"BUPS_RUN_ID="+run.ID,
+		"BUPS_JOB="+run.Job,
+		"BUPS_STAGE="+hook.Stage,
+		"BUPS_ARTIFACTS="+strings.Join(paths, string(os.PathListSeparator)),
+		"BUPS_ERROR="+runErr,
+	)
+	if err != nil {
+		return output, &HookError{
+			Stage:   hook.Stage,
+			Command: hook.Command,
+			Output:  output,
+			Err:     err,
+		}
+	}
+	return output, nil
+}
+
+// RunCommand 使用系统的shell执行命令，返回命令的标准输出和标准错误
+// env追加到当前进程的环境变量之后，超过timeout的命令会被杀死
+func RunCommand(command string, timeout time.Duration, env ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	// 输出写入文件而不是管道，超时被杀死的命令遗留的子进程不会阻塞Wait
+	outputFile, err := ioutil.TempFile("", "bups-hook")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(outputFile.Name())
+	defer outputFile.Close()
+	cmd.Stdout = outputFile
+	cmd.Stderr = outputFile
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+	output, readErr := ioutil.ReadFile(outputFile.Name())
+	if readErr != nil && err == nil {
+		err = readErr
+	}
+	return output, err
+}
+
+func truncate(output []byte) string {
+	if len(output) > hookOutputLimit {
+		return string(output[:hookOutputLimit]) + "...(truncated)"
+	}
+	return string(output)
+}
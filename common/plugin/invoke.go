@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/abingzo/bups/common/recovery"
+)
+
+// PanicError 插件在调用中panic时转换得到的错误
+type PanicError struct {
+	Plugin string
+	Value  interface{}
+	Stack  []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("plugin %s panic: %v", p.Plugin, p.Value)
+}
+
+// invoke 调用插件并将插件的panic转换为*PanicError
+// 单个插件的panic不会影响主程序和其它插件
+func invoke(p Plugin, run *Run, args []string) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{
+				Plugin: p.GetName(),
+				Value:  v,
+				Stack:  recovery.Stack(3),
+			}
+		}
+	}()
+	return AdaptV1(p).Exec(run, args)
+}
+
+// signal 向插件发送信号，同样隔离插件的panic
+func signal(p Plugin, single Single) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{
+				Plugin: p.GetName(),
+				Value:  v,
+				Stack:  recovery.Stack(3),
+			}
+		}
+	}()
+	p.Caller(single)
+	return nil
+}
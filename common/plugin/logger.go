@@ -0,0 +1,44 @@
+package plugin
+
+import "github.com/zbh255/bilog"
+
+// jobLogger 在日志前加上任务名，区分不同任务的插件输出的日志
+type jobLogger struct {
+	bilog.Logger
+	tag string
+}
+
+func tagLogger(logger bilog.Logger, job string) bilog.Logger {
+	if logger == nil {
+		return nil
+	}
+	return &jobLogger{Logger: logger, tag: "[" + job + "] "}
+}
+
+func (j *jobLogger) Info(s string) {
+	j.Logger.Info(j.tag + s)
+}
+
+func (j *jobLogger) Debug(s string) {
+	j.Logger.Debug(j.tag + s)
+}
+
+func (j *jobLogger) Trace(s string) {
+	j.Logger.Trace(j.tag + s)
+}
+
+func (j *jobLogger) ErrorFromErr(e error) {
+	j.Logger.ErrorFromString(j.tag + e.Error())
+}
+
+func (j *jobLogger) ErrorFromString(s string) {
+	j.Logger.ErrorFromString(j.tag + s)
+}
+
+func (j *jobLogger) PanicFromErr(e error) {
+	j.Logger.PanicFromString(j.tag + e.Error())
+}
+
+func (j *jobLogger) PanicFromString(s string) {
+	j.Logger.PanicFromString(j.tag + s)
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/path"
+	"sync"
+)
+
+// DefaultJob 没有配置任务时唯一的任务，RegisterRaw和SetState都作用于它
+const DefaultJob = config.DefaultJob
+
+// pipeline 一个任务的流水线实例
+type pipeline struct {
+	// 同一个任务的阶段依次执行，不同任务的流水线互不阻塞
+	mu        sync.Mutex
+	job       string
+	collect   plugins
+	handle    plugins
+	bCallBack plugins
+	// 当前正在进行的备份流水线,流入BCollect时创建
+	run *Run
+	// 在各个阶段前后执行的钩子
+	hooks []config.Hook
+}
+
+func (p *pipeline) add(regPlugin Plugin) {
+	switch regPlugin.GetType() {
+	case BCollect:
+		p.collect = append(p.collect, regPlugin)
+	case BHandle:
+		p.handle = append(p.handle, regPlugin)
+	case BCallBack:
+		// Reporter排在其它回调插件之后
+		if !isReporter(regPlugin) {
+			for k, v := range p.bCallBack {
+				if isReporter(v) {
+					p.bCallBack = append(p.bCallBack[:k], append(plugins{regPlugin}, p.bCallBack[k:]...)...)
+					return
+				}
+			}
+		}
+		p.bCallBack = append(p.bCallBack, regPlugin)
+	}
+}
+
+func (p *pipeline) plugins(s Type) plugins {
+	switch s {
+	case BCollect:
+		return p.collect
+	case BHandle:
+		return p.handle
+	case BCallBack:
+		return p.bCallBack
+	default:
+		panic("not support state type")
+	}
+}
+
+// CacheDir 插件存放文件的目录
+// 默认任务为./cache/插件名，其它任务为./cache/任务名/插件名
+func CacheDir(job string, pluginName string) string {
+	if job == DefaultJob || job == "" {
+		return path.DEFAULT_PATH_BACK_UPCACHE + "/" + pluginName
+	}
+	return path.DEFAULT_PATH_BACK_UPCACHE + "/" + job + "/" + pluginName
+}
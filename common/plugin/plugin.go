@@ -2,9 +2,11 @@
 package plugin
 
 import (
+	"fmt"
 	"github.com/abingzo/bups/common/config"
 	p "plugin"
 	"sync"
+	"time"
 )
 
 type Type int
@@ -67,15 +69,18 @@ type Context struct {
 	// 可以处理参数的插件
 	// 该哨兵属性免去了if
 	argsPlugin plugins
-	collect    plugins
-	handle     plugins
 	init       plugins
-	bCallBack  plugins
-	support    map[string][]uint32
+	// 每个任务拥有独立的流水线，按注册的顺序排列
+	pipelines []*pipeline
+	support   map[string][]uint32
 	// 原生的资源对象
 	RawSource *Source
 	// 状态的流转，每流入一个状态时则调用对应的插件启动函数
 	state Type
+	// 流水线完成时的回调
+	observers []func(run *Run)
+	// bups的版本，记录在每一次运行中
+	Version string
 }
 
 func (c *Context) Register(s string) {
@@ -90,27 +95,67 @@ func (c *Context) Register(s string) {
 	if err != nil {
 		panic(err)
 	}
-	c.RegisterRaw(interFace.(func() Plugin)())
+	switch fn := interFace.(type) {
+	case func() Plugin:
+		c.RegisterRaw(fn())
+	case func() PluginV2:
+		c.RegisterRaw(WrapV2(fn()))
+	default:
+		panic("not support plugin constructor")
+	}
 }
 
+// RegisterV2 注册第二版的插件
+func (c *Context) RegisterV2(regPlugin PluginV2) {
+	c.RegisterRaw(WrapV2(regPlugin))
+}
+
+// RegisterRaw 将插件注册到默认任务的流水线中
 func (c *Context) RegisterRaw(regPlugin Plugin) {
+	c.RegisterJob(DefaultJob, regPlugin)
+}
+
+// RegisterJob 将插件注册到某个任务的流水线中
+// 插件的配置会切换到该任务，缓存目录和日志也按任务区分
+// Init插件不属于任何任务，同名的Init插件只会注册一次
+func (c *Context) RegisterJob(job string, regPlugin Plugin) {
+	if regPlugin.GetType() == Init {
+		for _, v := range c.init {
+			if v.GetName() == regPlugin.GetName() {
+				return
+			}
+		}
+	}
 	c.support[regPlugin.GetName()] = regPlugin.GetSupport()
 	// 实现对应的支持
 	tmpSource := new(Source)
+	tmpSource.Job = job
+	tmpSource.CacheDir = CacheDir(job, regPlugin.GetName())
+	raw := c.RawSource
+	if job != DefaultJob {
+		raw = c.RawSource.forJob(job)
+	}
 	for _, v := range c.support[regPlugin.GetName()] {
 		switch v {
 		case SUPPORT_ARGS:
-			c.argsPlugin = append(c.argsPlugin, regPlugin)
+			// 多个任务安装了同一个插件时，参数交给第一个注册的插件处理
+			registered := false
+			for _, argsPlugin := range c.argsPlugin {
+				registered = registered || argsPlugin.GetName() == regPlugin.GetName()
+			}
+			if !registered {
+				c.argsPlugin = append(c.argsPlugin, regPlugin)
+			}
 		case SUPPORT_LOGGER:
-			tmpSource.StdLog = c.RawSource.StdLog
-			tmpSource.AccessLog = c.RawSource.AccessLog
-			tmpSource.ErrorLog = c.RawSource.ErrorLog
+			tmpSource.StdLog = raw.StdLog
+			tmpSource.AccessLog = raw.AccessLog
+			tmpSource.ErrorLog = raw.ErrorLog
 		case SUPPORT_STDLOG:
-			tmpSource.StdLog = c.RawSource.StdLog
+			tmpSource.StdLog = raw.StdLog
 		case SUPPORT_ACCESSLOG:
-			tmpSource.AccessLog = c.RawSource.AccessLog
+			tmpSource.AccessLog = raw.AccessLog
 		case SUPPORT_ERRORLOG:
-			tmpSource.ErrorLog = c.RawSource.ErrorLog
+			tmpSource.ErrorLog = raw.ErrorLog
 		case SUPPORT_CONFIG_OBJ:
 			/*
 				Config.Plugin为原生map对象，而原生map并不支持并发读写
@@ -118,6 +163,7 @@ func (c *Context) RegisterRaw(regPlugin Plugin) {
 				所以，每次执行重新构造一个
 			*/
 			tmpSource.Config = config.Read(c.RawSource.RawConfig)
+			tmpSource.Config.UseJob(job)
 		case SUPPORT_RAW_CONFIG:
 			tmpSource.RawConfig = c.RawSource.RawConfig
 		case SUPPORT_RAW_FILE:
@@ -132,38 +178,200 @@ func (c *Context) RegisterRaw(regPlugin Plugin) {
 	switch regPlugin.GetType() {
 	case Init:
 		c.init = append(c.init, regPlugin)
-	case BCollect:
-		c.collect = append(c.collect, regPlugin)
-	case BCallBack:
-		c.bCallBack = append(c.bCallBack, regPlugin)
-	case BHandle:
-		c.handle = append(c.handle, regPlugin)
+	case BCollect, BHandle, BCallBack:
+		c.pipeline(job).add(regPlugin)
 	default:
 		panic("not support plugin type")
 	}
 }
 
-func (c *Context) SetState(s Type) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	dst := make(plugins, 0, 10)
+// 返回任务的流水线，不存在则创建
+func (c *Context) pipeline(job string) *pipeline {
+	for _, v := range c.pipelines {
+		if v.job == job {
+			return v
+		}
+	}
+	pl := &pipeline{job: job}
+	c.pipelines = append(c.pipelines, pl)
+	return pl
+}
+
+// SetState 默认任务的流水线流入一个状态并调用该状态的所有插件，返回该阶段插件的错误
+// 同一次运行中BCollect阶段失败时，BHandle和BCallBack阶段的插件会被跳过
+func (c *Context) SetState(s Type) error {
+	return c.SetJobState(DefaultJob, s)
+}
+
+// SetJobState 某个任务的流水线流入一个状态
+// 上下文的锁只在取得流水线时持有，插件和钩子执行期间只持有该任务流水线的锁
+func (c *Context) SetJobState(job string, s Type) error {
+	// 在加锁之前检查状态，不支持的状态不能让上下文一直处于加锁的状态
 	switch s {
-	case BCollect:
-		dst = append(c.collect)
-	case Init:
-		dst = append(c.init)
-	case BCallBack:
-		dst = append(c.bCallBack)
-	case BHandle:
-		dst = append(c.handle)
+	case Init, BCollect, BHandle, BCallBack:
 	default:
-		panic("not support state type")
+		return fmt.Errorf("plugin: not support state type %s", s)
+	}
+	c.lock.Lock()
+	c.state = s
+	// Init阶段不参与流水线
+	if s == Init {
+		inits := append(plugins(nil), c.init...)
+		c.lock.Unlock()
+		var err error
+		for _, v := range inits {
+			if pErr := invoke(v, nil, nil); pErr != nil {
+				c.logPluginError(fmt.Sprintf("plugin %s init failed", v.GetName()), pErr)
+				if err == nil {
+					err = fmt.Errorf("%s: %w", v.GetName(), pErr)
+				}
+			}
+		}
+		return err
+	}
+	pl := c.pipeline(job)
+	c.lock.Unlock()
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	c.lock.Lock()
+	dst := append(plugins(nil), pl.plugins(s)...)
+	hooks := pl.hooks
+	// 每次收集数据都是一次新的流水线
+	if s == BCollect || pl.run == nil {
+		pl.run = NewRun()
+		pl.run.Job = job
+		pl.run.Version = c.Version
+	}
+	run := pl.run
+	c.lock.Unlock()
+	// 同一次运行中收集阶段失败或者被钩子中止时跳过之后的插件
+	skipped := func() bool {
+		return run.Aborted() || (s != BCollect && run.Failed(BCollect))
 	}
+	if !skipped() {
+		c.runHooks(hooks, run, stageHooks[s][0], s)
+	}
+	skip := skipped()
 	// call
 	for _, v := range dst {
-		v.Start(nil)
+		report := s == BCallBack && isReporter(v)
+		result := Result{
+			Plugin:    v.GetName(),
+			Stage:     s,
+			StartTime: time.Now(),
+			// 报告结果的插件在失败的运行中同样需要调用
+			Skipped: skip && !report,
+			Report:  report,
+		}
+		if !result.Skipped {
+			result.Err = invoke(v, run, nil)
+		}
+		result.Duration = time.Since(result.StartTime)
+		run.AddResult(result)
+		if result.Err != nil {
+			c.logPluginError(fmt.Sprintf("%s: plugin %s failed", run, result.Plugin), result.Err)
+		}
 	}
-	c.state = s
+	if skip && len(dst) > 0 {
+		c.logError(fmt.Sprintf("%s: collect stage failed or run aborted, skip %s stage", run, s))
+	}
+	if !skip {
+		c.runHooks(hooks, run, stageHooks[s][1], s)
+	}
+	return run.StageErr(s)
+}
+
+// RunJob 依次流入BCollect、BHandle、BCallBack，完成任务的一次备份
+// 完成之后通知所有通过OnRunComplete注册的回调
+func (c *Context) RunJob(job string) (*Run, error) {
+	for _, s := range []Type{BCollect, BHandle, BCallBack} {
+		_ = c.SetJobState(job, s)
+	}
+	run := c.GetJobRun(job)
+	if run.Err() != nil {
+		c.lock.Lock()
+		hooks := c.pipeline(job).hooks
+		c.lock.Unlock()
+		c.runHooks(hooks, run, config.HookOnFailure, BCallBack)
+	}
+	run.EndTime = time.Now()
+	run.end()
+	c.lock.Lock()
+	observers := c.observers
+	c.lock.Unlock()
+	for _, fn := range observers {
+		fn(run)
+	}
+	return run, run.Err()
+}
+
+// OnRunComplete 注册流水线完成时的回调，比如记录运行历史
+func (c *Context) OnRunComplete(fn func(run *Run)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.observers = append(c.observers, fn)
+}
+
+// Jobs 返回所有拥有流水线的任务
+func (c *Context) Jobs() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	jobs := make([]string, len(c.pipelines))
+	for k, v := range c.pipelines {
+		jobs[k] = v.job
+	}
+	return jobs
+}
+
+// 没有注册访问日志时(比如测试中)则忽略
+func (c *Context) logInfo(msg string) {
+	if c.RawSource == nil || c.RawSource.AccessLog == nil {
+		return
+	}
+	c.RawSource.AccessLog.Info(msg)
+}
+
+// 没有注册错误日志时(比如测试中)则忽略
+func (c *Context) logError(msg string) {
+	if c.RawSource == nil || c.RawSource.ErrorLog == nil {
+		return
+	}
+	c.RawSource.ErrorLog.ErrorFromString(msg)
+}
+
+// 插件panic时同时记录调用栈
+func (c *Context) logPluginError(msg string, err error) {
+	if pErr, ok := err.(*PanicError); ok {
+		c.logError(fmt.Sprintf("%s: %s\n%s", msg, pErr, pErr.Stack))
+		return
+	}
+	c.logError(fmt.Sprintf("%s: %s", msg, err))
+}
+
+// Broadcast 向所有注册的插件发送信号，插件的panic会被记录而不会中断广播
+func (c *Context) Broadcast(single Single) {
+	c.RangeAllPlugin(func(k int, v Plugin) {
+		if err := signal(v, single); err != nil {
+			c.logPluginError(fmt.Sprintf("plugin %s caller failed", v.GetName()), err)
+		}
+	})
+}
+
+// GetRun 返回默认任务当前的流水线，还未进入BCollect时为nil
+func (c *Context) GetRun() *Run {
+	return c.GetJobRun(DefaultJob)
+}
+
+// GetJobRun 返回任务当前的流水线
+func (c *Context) GetJobRun(job string) *Run {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, v := range c.pipelines {
+		if v.job == job {
+			return v.run
+		}
+	}
+	return nil
 }
 
 // RangeArgsPlugin 遍历支持参数的插件列表
@@ -177,24 +385,27 @@ func (c *Context) RangeArgsPlugin(fn func(k int, v Plugin)) {
 
 // RangeAllPlugin 遍历所有注册的插件
 func (c *Context) RangeAllPlugin(fn func(k int, v Plugin)) {
+	c.RangeJobPlugin(func(k int, job string, v Plugin) {
+		fn(k, v)
+	})
+}
+
+// RangeJobPlugin 遍历所有注册的插件以及它们所属的任务，Init插件的任务为空
+func (c *Context) RangeJobPlugin(fn func(k int, job string, v Plugin)) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	k := 0
 	for _, v := range c.init {
-		fn(k, v)
-		k++
-	}
-	for _, v := range c.collect {
-		fn(k, v)
-		k++
-	}
-	for _, v := range c.handle {
-		fn(k, v)
+		fn(k, "", v)
 		k++
 	}
-	for _, v := range c.bCallBack {
-		fn(k, v)
-		k++
+	for _, pl := range c.pipelines {
+		for _, list := range []plugins{pl.collect, pl.handle, pl.bCallBack} {
+			for _, v := range list {
+				fn(k, pl.job, v)
+				k++
+			}
+		}
 	}
 }
 
@@ -0,0 +1,297 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArtifactKind 描述流水线中产物的种类
+type ArtifactKind string
+
+const (
+	KindFile     ArtifactKind = "file"     // 收集阶段产生的文件归档
+	KindDatabase ArtifactKind = "database" // 收集阶段产生的数据库转储
+	KindArchive  ArtifactKind = "archive"  // 处理阶段产生的最终归档
+	KindRemote   ArtifactKind = "remote"   // 上传到远端的对象，Path为对象的键
+	// 归档的分离签名，Meta中的archive为被签名的归档的路径
+	KindSignature ArtifactKind = "signature"
+)
+
+// Artifact 一次运行中由插件产生的文件
+type Artifact struct {
+	Path     string       `json:"path"`
+	Kind     ArtifactKind `json:"kind"`
+	Size     int64        `json:"size"`
+	Checksum string       `json:"checksum"` // sha256
+	Plugin   string       `json:"plugin"`
+	// 描述产物来源的附加信息，比如备份的目录或者转储的数据库
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// Result 一个插件在一次运行中的执行结果
+type Result struct {
+	Plugin    string        `json:"plugin"`
+	Stage     Type          `json:"stage"`
+	StartTime time.Time     `json:"start_time"`
+	Duration  time.Duration `json:"duration"`
+	// 上游阶段失败时插件不会被调用
+	Skipped bool `json:"skipped"`
+	// Reporter的结果，通知或者邮件发送失败不代表备份失败，不计入运行的错误
+	Report bool  `json:"report,omitempty"`
+	Err    error `json:"-"`
+}
+
+// Run 一次完整的备份流水线,由BCollect创建,在BHandle和BCallBack之间传递
+// 插件之间通过Run交换产物,而不是依赖彼此的缓存路径
+type Run struct {
+	mu  sync.Mutex
+	ID  string
+	Job string
+	// 产生本次运行的bups的版本
+	Version   string
+	StartTime time.Time
+	// 流水线的所有阶段结束的时间
+	EndTime   time.Time
+	artifacts []Artifact
+	results   []Result
+	// 被钩子中止的运行会跳过之后所有的插件
+	aborted bool
+	// 插件在运行中累加的计数，比如上传尝试的次数
+	counters map[string]int64
+	// 流水线结束时调用的函数
+	onEnd []func(run *Run)
+}
+
+// 自带插件使用的计数
+const (
+	CounterUploadAttempts = "upload_attempts"
+	CounterUploadFailures = "upload_failures"
+)
+
+// RunReceiver 需要读写产物的插件实现该接口
+// Context在调用Start之前会设置当前的Run
+type RunReceiver interface {
+	SetRun(run *Run)
+}
+
+// Reporter 报告运行结果的BCallBack插件实现该接口
+// 上游阶段失败或者运行被中止时Reporter仍然会被调用
+// 并且在同一阶段的其它插件之后调用，以便看到完整的结果
+// Reporter返回的错误只记录在结果中，不会让运行失败
+type Reporter interface {
+	ReportRun() bool
+}
+
+// 判断插件是否为Reporter，包装过的第二版插件同样适用
+func isReporter(p Plugin) bool {
+	if w, ok := p.(*v2Wrapper); ok {
+		r, ok := w.PluginV2.(Reporter)
+		return ok && r.ReportRun()
+	}
+	r, ok := p.(Reporter)
+	return ok && r.ReportRun()
+}
+
+func NewRun() *Run {
+	now := time.Now()
+	var random [4]byte
+	_, _ = rand.Read(random[:])
+	return &Run{
+		ID:        fmt.Sprintf("%s-%s", now.Format("20060102150405"), hex.EncodeToString(random[:])),
+		StartTime: now,
+	}
+}
+
+func (r *Run) String() string {
+	if r.Job == "" || r.Job == DefaultJob {
+		return "run " + r.ID
+	}
+	return fmt.Sprintf("run %s (job %s)", r.ID, r.Job)
+}
+
+// Emit 登记一个插件产生的文件,会计算文件的大小与校验和
+func (r *Run) Emit(pluginName string, kind ArtifactKind, path string) (Artifact, error) {
+	return r.EmitMeta(pluginName, kind, path, nil)
+}
+
+// EmitMeta 登记文件的同时附带描述来源的信息
+func (r *Run) EmitMeta(pluginName string, kind ArtifactKind, path string, meta map[string]string) (Artifact, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Artifact{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return Artifact{}, err
+	}
+	artifact := Artifact{
+		Path:     path,
+		Kind:     kind,
+		Size:     size,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+		Plugin:   pluginName,
+		Meta:     meta,
+	}
+	r.AddArtifact(artifact)
+	return artifact, nil
+}
+
+func (r *Run) AddArtifact(artifact Artifact) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.artifacts = append(r.artifacts, artifact)
+}
+
+// Artifacts 返回产物列表的拷贝
+func (r *Run) Artifacts() []Artifact {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dst := make([]Artifact, len(r.artifacts))
+	copy(dst, r.artifacts)
+	return dst
+}
+
+// ArtifactsByKind 按种类筛选产物,保持登记时的顺序
+func (r *Run) ArtifactsByKind(kinds ...ArtifactKind) []Artifact {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dst := make([]Artifact, 0, len(r.artifacts))
+	for _, v := range r.artifacts {
+		for _, kind := range kinds {
+			if v.Kind == kind {
+				dst = append(dst, v)
+				break
+			}
+		}
+	}
+	return dst
+}
+
+func (r *Run) AddResult(result Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, result)
+}
+
+// Results 返回执行结果的拷贝
+func (r *Run) Results() []Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dst := make([]Result, len(r.results))
+	copy(dst, r.results)
+	return dst
+}
+
+// OnEnd 注册流水线的所有阶段结束时调用的函数，比如在上传成功之后才提交本地的状态
+// 函数中可以通过Err判断运行是否成功
+func (r *Run) OnEnd(fn func(run *Run)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onEnd = append(r.onEnd, fn)
+}
+
+// 依次调用OnEnd注册的函数
+func (r *Run) end() {
+	r.mu.Lock()
+	fns := r.onEnd
+	r.onEnd = nil
+	r.mu.Unlock()
+	for _, fn := range fns {
+		fn(r)
+	}
+}
+
+// Count 累加一个计数
+func (r *Run) Count(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counters == nil {
+		r.counters = make(map[string]int64)
+	}
+	r.counters[name] += delta
+}
+
+// Counters 返回计数的拷贝
+func (r *Run) Counters() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dst := make(map[string]int64, len(r.counters))
+	for k, v := range r.counters {
+		dst[k] = v
+	}
+	return dst
+}
+
+// Abort 中止本次运行，之后的阶段不再调用插件
+func (r *Run) Abort() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aborted = true
+}
+
+func (r *Run) Aborted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.aborted
+}
+
+// Failed 判断某个阶段是否有插件失败
+func (r *Run) Failed(stage Type) bool {
+	return r.StageErr(stage) != nil
+}
+
+// StageErr 汇总某个阶段所有插件的错误，没有错误则返回nil
+// Reporter的错误不计入，使用ReportErr获取
+func (r *Run) StageErr(stage Type) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msg := make([]string, 0)
+	for _, v := range r.results {
+		if v.Stage == stage && v.Err != nil && !v.Report {
+			msg = append(msg, v.Plugin+": "+v.Err.Error())
+		}
+	}
+	if len(msg) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s stage failed: %s", stage, strings.Join(msg, "; "))
+}
+
+// ReportErr 汇总报告结果的插件的错误，没有错误则返回nil
+func (r *Run) ReportErr() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msg := make([]string, 0)
+	for _, v := range r.results {
+		if v.Report && v.Err != nil {
+			msg = append(msg, v.Plugin+": "+v.Err.Error())
+		}
+	}
+	if len(msg) == 0 {
+		return nil
+	}
+	return fmt.Errorf("report failed: %s", strings.Join(msg, "; "))
+}
+
+// Err 汇总整个流水线的错误，不包括Reporter的错误
+func (r *Run) Err() error {
+	msg := make([]string, 0)
+	for _, stage := range []Type{BCollect, BHandle, BCallBack} {
+		if err := r.StageErr(stage); err != nil {
+			msg = append(msg, err.Error())
+		}
+	}
+	if len(msg) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", r, strings.Join(msg, "; "))
+}
@@ -18,6 +18,19 @@ type Source struct {
 	AccessLog bilog.Logger
 	ErrorLog  bilog.Logger
 	StdLog    bilog.Logger
+	// 插件所属的任务
+	Job string
+	// 插件存放文件的目录，按任务区分
+	CacheDir string
+}
+
+// 拷贝一份资源，日志带上任务名的标签
+func (s *Source) forJob(job string) *Source {
+	dst := *s
+	dst.AccessLog = tagLogger(s.AccessLog, job)
+	dst.ErrorLog = tagLogger(s.ErrorLog, job)
+	dst.StdLog = tagLogger(s.StdLog, job)
+	return &dst
 }
 
 func (s *Source) GetConfigReader() io.Reader {
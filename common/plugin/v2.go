@@ -0,0 +1,94 @@
+package plugin
+
+import "fmt"
+
+// 插件接口的版本
+const (
+	VersionV1 = 1 // Start(args)，通过panic表示失败
+	VersionV2 = 2 // Exec(run, args) error
+)
+
+// PluginV2 第二版插件接口,启动方法返回错误而不是panic
+// Context收集这些错误并决定流水线是否继续
+type PluginV2 interface {
+	// Exec 插件启动时调用的方法，流水线调用时run为当前的Run，参数启动时run为nil
+	Exec(run *Run, args []string) error
+	// Caller 接收到信号时调用的方法
+	Caller(single Single)
+	// GetName 主程序获取插件的名字
+	GetName() string
+	// GetType 主程序获取插件的类型
+	GetType() Type
+	// GetSupport 主程序获取插件需要的支持
+	GetSupport() []uint32
+	// SetSource 设置插件需要的Source
+	SetSource(source *Source)
+}
+
+// NewV2 第二版插件必需要实现的函数类型
+type NewV2 func() PluginV2
+
+// WrapV2 将第二版插件包装为Plugin,使其可以通过iocc和RegisterRaw注册
+func WrapV2(p PluginV2) Plugin {
+	return &v2Wrapper{p}
+}
+
+// AdaptV1 将第一版插件适配为第二版插件,已经是第二版的插件原样返回
+func AdaptV1(p Plugin) PluginV2 {
+	if v2, ok := p.(PluginV2); ok {
+		return v2
+	}
+	return &v1Adapter{p}
+}
+
+// VersionOf 返回插件实现的接口版本
+func VersionOf(p Plugin) int {
+	if _, ok := p.(PluginV2); ok {
+		return VersionV2
+	}
+	return VersionV1
+}
+
+// Start 以参数启动插件并返回插件的错误，兼容两个版本的插件
+// 插件的panic会被转换为*PanicError
+func Start(p Plugin, args []string) error {
+	return invoke(p, nil, args)
+}
+
+type v2Wrapper struct {
+	PluginV2
+}
+
+// Start 直接调用包装后的插件时保持第一版的语义：出错则panic
+func (w *v2Wrapper) Start(args []string) {
+	if err := w.Exec(nil, args); err != nil {
+		panic(err)
+	}
+}
+
+type v1Adapter struct {
+	Plugin
+}
+
+func (a *v1Adapter) Exec(run *Run, args []string) error {
+	if receiver, ok := a.Plugin.(RunReceiver); ok && run != nil {
+		receiver.SetRun(run)
+	}
+	a.Plugin.Start(args)
+	return nil
+}
+
+func (t Type) String() string {
+	switch t {
+	case Init:
+		return "Init"
+	case BCollect:
+		return "Collect"
+	case BHandle:
+		return "Handle"
+	case BCallBack:
+		return "Callback"
+	default:
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+}
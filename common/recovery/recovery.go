@@ -1,4 +1,5 @@
-package main
+// Package recovery 将panic转换为可读的调用栈
+package recovery
 
 import (
 	"bytes"
@@ -18,8 +19,8 @@ var (
 	slash     = []byte("/")
 )
 
-// stack returns a nicely formated stack frame, skipping skip frames
-func stack(skip int) []byte {
+// Stack returns a nicely formated stack frame, skipping skip frames
+func Stack(skip int) []byte {
 	buf := new(bytes.Buffer) // the returned data
 	// As we loop, we open files and read them. These variables record the currently
 	// loaded file.
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound 后端中不存在该对象
+var ErrNotFound = errors.New("repo: object not found")
+
+// Backend 存放仓库对象的后端，对象的名字以/分隔，比如chunks/ab/abcd...
+type Backend interface {
+	Put(name string, data []byte) error
+	// Get 对象不存在时返回ErrNotFound
+	Get(name string) ([]byte, error)
+	// List 返回以prefix开头的所有对象的名字
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+}
+
+// Local 使用本地目录作为后端，比如挂载的移动硬盘或者NFS
+type Local struct {
+	Dir string
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.Dir, filepath.FromSlash(name))
+}
+
+// Put 先写入临时文件再重命名，中断时不会留下不完整的对象
+func (l *Local) Put(name string, data []byte) error {
+	path := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (l *Local) Get(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(l.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (l *Local) List(prefix string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.Walk(l.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == l.Dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Dir, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (l *Local) Delete(name string) error {
+	err := os.Remove(l.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package repo
+
+import (
+	"bufio"
+	"io"
+)
+
+// 块的默认大小，平均大小为2的整数次幂
+const (
+	DefaultMinChunk = 256 << 10
+	DefaultAvgChunk = 1 << 20
+	DefaultMaxChunk = 8 << 20
+)
+
+// gear哈希使用的随机表，由固定的种子生成，所有仓库的切分点一致
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	seed := uint64(0x62757073)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker 使用gear滚动哈希按内容切分数据流
+// 切分点只由附近的内容决定，文件中间插入或者删除数据只会影响附近的块，其余的块可以去重
+type Chunker struct {
+	r    *bufio.Reader
+	min  int
+	max  int
+	mask uint64
+	buf  []byte
+}
+
+// NewChunker 创建切分器，avg必须为2的整数次幂，参数为0时使用默认值
+func NewChunker(r io.Reader, min, avg, max int) *Chunker {
+	if min <= 0 {
+		min = DefaultMinChunk
+	}
+	if avg <= 0 {
+		avg = DefaultAvgChunk
+	}
+	if max <= 0 {
+		max = DefaultMaxChunk
+	}
+	// 使用高位判断切分点，gear哈希的低位只由最近的几个字节决定
+	bits := 0
+	for 1<<bits < avg {
+		bits++
+	}
+	return &Chunker{
+		r:    bufio.NewReaderSize(r, 1<<16),
+		min:  min,
+		max:  max,
+		mask: ^uint64(0) << (64 - bits),
+		buf:  make([]byte, 0, max),
+	}
+}
+
+// Next 返回下一个块，数据结束时返回io.EOF，返回的切片在下一次调用之前有效
+func (c *Chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+	for len(c.buf) < c.max {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			return c.buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = (hash << 1) + gear[b]
+		if len(c.buf) >= c.min && hash&c.mask == 0 {
+			break
+		}
+	}
+	return c.buf, nil
+}
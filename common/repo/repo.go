@@ -0,0 +1,342 @@
+// Package repo 实现按内容切分、去重、压缩和加密的备份仓库
+//
+// 文件和数据库转储使用gear滚动哈希切分为平均1MiB的块，块的标识为主密钥下内容的HMAC-SHA256，
+// 相同的块只保存一次。块使用zstd压缩之后以AES-256-GCM加密，每一次备份写入一个快照，
+// 快照记录目录树以及每一个文件引用的块。仓库中的对象:
+//
+//	config              仓库的参数和使用口令加密的主密钥
+//	chunks/ab/abcd...   块
+//	snapshots/<id>      快照
+//	locks/<id>          正在写入的快照，存在时不能回收块
+//	gc/<id>             正在进行的回收，存在时不能开始新的快照
+package repo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/crypt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	configName     = "config"
+	chunkPrefix    = "chunks/"
+	snapshotPrefix = "snapshots/"
+	lockPrefix     = "locks/"
+	gcPrefix       = "gc/"
+	version        = 1
+	masterKeySize  = 64
+)
+
+var (
+	// ErrNotInitialized 后端中没有仓库
+	ErrNotInitialized = errors.New("repo: repository is not initialized")
+	// ErrWrongPassword 口令无法解密主密钥
+	ErrWrongPassword = errors.New("repo: wrong password or corrupted config")
+	// ErrLocked 有正在写入的快照
+	ErrLocked = errors.New("repo: repository is locked by a running backup")
+	// ErrGCRunning 有正在进行的回收
+	ErrGCRunning = errors.New("repo: repository is locked by a running gc")
+)
+
+// 存放在后端中的仓库参数
+type repoConfig struct {
+	Version int        `json:"version"`
+	Created time.Time  `json:"created"`
+	KDF     *crypt.KDF `json:"kdf"`
+	// 使用口令派生的密钥加密的主密钥
+	Key      []byte `json:"key"`
+	MinChunk int    `json:"min_chunk"`
+	AvgChunk int    `json:"avg_chunk"`
+	MaxChunk int    `json:"max_chunk"`
+}
+
+// Stats 写入数据的统计，Bytes为明文的大小，Stored为压缩加密之后实际写入的大小
+type Stats struct {
+	Chunks    int64
+	NewChunks int64
+	Bytes     int64
+	NewBytes  int64
+	Stored    int64
+}
+
+// Repository 打开的仓库，可以被多个goroutine同时使用
+type Repository struct {
+	backend Backend
+	cfg     *repoConfig
+	aead    cipher.AEAD
+	idKey   []byte
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+
+	mu sync.Mutex
+	// 后端中已经存在的块，第一次写入时从后端读取
+	known map[string]struct{}
+	stats Stats
+}
+
+// Init 在后端中创建新的仓库，kdfName为空时使用argon2id
+func Init(b Backend, passphrase []byte, kdfName string) (*Repository, error) {
+	if _, err := b.Get(configName); err == nil {
+		return nil, errors.New("repo: repository already exists")
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	kdf, err := crypt.NewKDF(kdfName)
+	if err != nil {
+		return nil, err
+	}
+	master := make([]byte, masterKeySize)
+	if _, err := rand.Read(master); err != nil {
+		return nil, err
+	}
+	cfg := &repoConfig{
+		Version:  version,
+		Created:  time.Now(),
+		KDF:      kdf,
+		MinChunk: DefaultMinChunk,
+		AvgChunk: DefaultAvgChunk,
+		MaxChunk: DefaultMaxChunk,
+	}
+	derived, err := kdf.Derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(derived)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Key, err = seal(aead, master, []byte(configName)); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Put(configName, data); err != nil {
+		return nil, err
+	}
+	return newRepository(b, cfg, master)
+}
+
+// Open 使用口令打开仓库
+func Open(b Backend, passphrase []byte) (*Repository, error) {
+	data, err := b.Get(configName)
+	if err == ErrNotFound {
+		return nil, ErrNotInitialized
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &repoConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("repo: invalid config: %w", err)
+	}
+	if cfg.Version != version || cfg.KDF == nil {
+		return nil, fmt.Errorf("repo: not support repository version %d", cfg.Version)
+	}
+	derived, err := cfg.KDF.Derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(derived)
+	if err != nil {
+		return nil, err
+	}
+	master, err := open(aead, cfg.Key, []byte(configName))
+	if err != nil || len(master) != masterKeySize {
+		return nil, ErrWrongPassword
+	}
+	return newRepository(b, cfg, master)
+}
+
+// OpenOrInit 打开仓库，仓库不存在时创建
+func OpenOrInit(b Backend, passphrase []byte, kdfName string) (*Repository, error) {
+	r, err := Open(b, passphrase)
+	if err == ErrNotInitialized {
+		return Init(b, passphrase, kdfName)
+	}
+	return r, err
+}
+
+// 主密钥的前32字节用于加密，后32字节用于计算块的标识
+func newRepository(b Backend, cfg *repoConfig, master []byte) (*Repository, error) {
+	aead, err := newAEAD(master[:32])
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{
+		backend: b,
+		cfg:     cfg,
+		aead:    aead,
+		idKey:   master[32:],
+		encoder: encoder,
+		decoder: decoder,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 加密的结果为随机的nonce加上密文，additional绑定对象的名字，防止对象被互相替换
+func seal(aead cipher.AEAD, plaintext []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, data []byte, additional []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("repo: object is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additional)
+}
+
+// Stats 返回写入数据的统计
+func (r *Repository) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+func (r *Repository) chunkID(data []byte) string {
+	mac := hmac.New(sha256.New, r.idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func chunkName(id string) string {
+	return chunkPrefix + id[:2] + "/" + id
+}
+
+// 读取后端中已经存在的块
+func (r *Repository) loadKnown() error {
+	if r.known != nil {
+		return nil
+	}
+	names, err := r.backend.List(chunkPrefix)
+	if err != nil {
+		return err
+	}
+	r.known = make(map[string]struct{}, len(names))
+	for _, name := range names {
+		r.known[name[strings.LastIndex(name, "/")+1:]] = struct{}{}
+	}
+	return nil
+}
+
+// SaveChunk 保存一个块，后端中已经存在相同的块时不再写入
+func (r *Repository) SaveChunk(data []byte) (string, error) {
+	id := r.chunkID(data)
+	r.mu.Lock()
+	if err := r.loadKnown(); err != nil {
+		r.mu.Unlock()
+		return "", err
+	}
+	_, ok := r.known[id]
+	r.stats.Chunks++
+	r.stats.Bytes += int64(len(data))
+	r.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	sealed, err := seal(r.aead, r.encoder.EncodeAll(data, nil), []byte(id))
+	if err != nil {
+		return "", err
+	}
+	if err := r.backend.Put(chunkName(id), sealed); err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	r.known[id] = struct{}{}
+	r.stats.NewChunks++
+	r.stats.NewBytes += int64(len(data))
+	r.stats.Stored += int64(len(sealed))
+	r.mu.Unlock()
+	return id, nil
+}
+
+// LoadChunk 读取一个块并校验其内容
+func (r *Repository) LoadChunk(id string) ([]byte, error) {
+	if len(id) < 2 {
+		return nil, fmt.Errorf("repo: invalid chunk id %q", id)
+	}
+	sealed, err := r.backend.Get(chunkName(id))
+	if err != nil {
+		return nil, fmt.Errorf("repo: load chunk %s: %w", id, err)
+	}
+	compressed, err := open(r.aead, sealed, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("repo: chunk %s is corrupted: %w", id, err)
+	}
+	data, err := r.decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("repo: chunk %s is corrupted: %w", id, err)
+	}
+	if r.chunkID(data) != id {
+		return nil, fmt.Errorf("repo: chunk %s does not match its content", id)
+	}
+	return data, nil
+}
+
+// SaveStream 切分并保存数据流，返回块的标识和数据的大小
+func (r *Repository) SaveStream(src io.Reader) ([]string, int64, error) {
+	chunker := NewChunker(src, r.cfg.MinChunk, r.cfg.AvgChunk, r.cfg.MaxChunk)
+	ids := make([]string, 0)
+	var size int64
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			return ids, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		id, err := r.SaveChunk(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		ids = append(ids, id)
+		size += int64(len(data))
+	}
+}
+
+// LoadStream 依次读取块并写入dst
+func (r *Repository) LoadStream(dst io.Writer, ids []string) error {
+	for _, id := range ids {
+		data, err := r.LoadChunk(id)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
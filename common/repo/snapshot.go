@@ -0,0 +1,419 @@
+package repo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/archiver"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 快照中节点的类型
+const (
+	NodeDir     = "dir"
+	NodeFile    = "file"
+	NodeSymlink = "symlink"
+)
+
+// Node 快照中的一个文件、目录或者符号链接
+type Node struct {
+	// 快照中的路径，以/分隔，比如blog->root/index.php
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	Chunks  []string    `json:"chunks,omitempty"`
+}
+
+// Snapshot 一次备份的快照
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Job     string    `json:"job,omitempty"`
+	Host    string    `json:"host,omitempty"`
+	Version string    `json:"version,omitempty"`
+	// 备份的目录和文件
+	Paths []string `json:"paths"`
+	Nodes []*Node  `json:"nodes"`
+	// 所有文件的大小之和
+	Size int64 `json:"size"`
+}
+
+// Files 快照中文件的数量
+func (s *Snapshot) Files() int {
+	n := 0
+	for _, v := range s.Nodes {
+		if v.Type == NodeFile {
+			n++
+		}
+	}
+	return n
+}
+
+// SnapshotWriter 向一个新的快照中写入文件
+type SnapshotWriter struct {
+	repo     *Repository
+	Snapshot *Snapshot
+	// Filter 为nil时AddTree写入全部的文件
+	Filter archiver.Filter
+	// OnSkip 跳过套接字、命名管道等特殊文件时调用
+	OnSkip func(path string, info os.FileInfo)
+}
+
+// NewSnapshot 创建快照并加锁，加锁期间不能回收块，Commit或者Abort之后解锁
+// 有正在进行的回收时返回ErrGCRunning
+func (r *Repository) NewSnapshot(id string) (*SnapshotWriter, error) {
+	if id == "" || strings.ContainsAny(id, "/\\") {
+		return nil, fmt.Errorf("repo: invalid snapshot id %q", id)
+	}
+	if err := r.backend.Put(lockPrefix+id, []byte(time.Now().Format(time.RFC3339))); err != nil {
+		return nil, err
+	}
+	// 先加锁再检查回收的锁，GC的顺序与此相反，二者至少有一方能看到对方的锁
+	running, err := r.backend.List(gcPrefix)
+	if err == nil && len(running) != 0 {
+		err = fmt.Errorf("%w: %s", ErrGCRunning, strings.Join(running, ", "))
+	}
+	if err != nil {
+		r.backend.Delete(lockPrefix + id)
+		return nil, err
+	}
+	return &SnapshotWriter{repo: r, Snapshot: &Snapshot{ID: id, Time: time.Now()}}, nil
+}
+
+func (w *SnapshotWriter) addFile(name string, path string, info os.FileInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	ids, size, err := w.repo.SaveStream(file)
+	if err != nil {
+		return err
+	}
+	w.Snapshot.Nodes = append(w.Snapshot.Nodes, &Node{
+		Name:    name,
+		Type:    NodeFile,
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		Size:    size,
+		Chunks:  ids,
+	})
+	w.Snapshot.Size += size
+	return nil
+}
+
+// AddFile 将单个文件以name写入快照
+func (w *SnapshotWriter) AddFile(name string, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	w.Snapshot.Paths = append(w.Snapshot.Paths, path)
+	return w.addFile(name, path, info)
+}
+
+// AddTree 将目录写入快照中的name目录，符号链接不会被跟随
+func (w *SnapshotWriter) AddTree(src string, name string) error {
+	w.Snapshot.Paths = append(w.Snapshot.Paths, src)
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if w.Filter != nil {
+			skip, err := w.Filter.Skip(path, rel, info)
+			if err != nil {
+				return err
+			}
+			if skip && info.IsDir() {
+				return filepath.SkipDir
+			}
+			if skip {
+				return nil
+			}
+		}
+		nodeName := name
+		if rel != "." {
+			nodeName += "/" + filepath.ToSlash(rel)
+		}
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			w.Snapshot.Nodes = append(w.Snapshot.Nodes, &Node{Name: nodeName, Type: NodeDir, Mode: mode, ModTime: info.ModTime()})
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			w.Snapshot.Nodes = append(w.Snapshot.Nodes, &Node{Name: nodeName, Type: NodeSymlink, Mode: mode, ModTime: info.ModTime(), Link: link})
+		case mode.IsRegular():
+			return w.addFile(nodeName, path, info)
+		default:
+			if w.OnSkip != nil {
+				w.OnSkip(path, info)
+			}
+		}
+		return nil
+	})
+}
+
+// Commit 保存快照并解锁
+func (w *SnapshotWriter) Commit() error {
+	data, err := json.Marshal(w.Snapshot)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(w.repo.aead, w.repo.encoder.EncodeAll(data, nil), []byte(snapshotPrefix+w.Snapshot.ID))
+	if err != nil {
+		return err
+	}
+	if err := w.repo.backend.Put(snapshotPrefix+w.Snapshot.ID, sealed); err != nil {
+		return err
+	}
+	return w.Abort()
+}
+
+// Abort 放弃快照并解锁，已经写入的块在回收时被删除
+func (w *SnapshotWriter) Abort() error {
+	return w.repo.backend.Delete(lockPrefix + w.Snapshot.ID)
+}
+
+// LoadSnapshot 读取快照，id可以是唯一的前缀或者latest
+func (r *Repository) LoadSnapshot(id string) (*Snapshot, error) {
+	names, err := r.backend.List(snapshotPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if id == "latest" {
+		snapshots, err := r.ListSnapshots()
+		if err != nil {
+			return nil, err
+		}
+		if len(snapshots) == 0 {
+			return nil, errors.New("repo: repository has no snapshot")
+		}
+		return snapshots[len(snapshots)-1], nil
+	}
+	match := ""
+	for _, name := range names {
+		if !strings.HasPrefix(name, snapshotPrefix+id) {
+			continue
+		}
+		if match != "" {
+			return nil, fmt.Errorf("repo: snapshot id %s is ambiguous", id)
+		}
+		match = name
+	}
+	if match == "" {
+		return nil, fmt.Errorf("repo: snapshot %s does not exist", id)
+	}
+	return r.loadSnapshot(match)
+}
+
+func (r *Repository) loadSnapshot(name string) (*Snapshot, error) {
+	sealed, err := r.backend.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := open(r.aead, sealed, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("repo: %s is corrupted: %w", name, err)
+	}
+	data, err := r.decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("repo: %s is corrupted: %w", name, err)
+	}
+	s := &Snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("repo: %s is corrupted: %w", name, err)
+	}
+	return s, nil
+}
+
+// ListSnapshots 按时间排序的所有快照
+func (r *Repository) ListSnapshots() ([]*Snapshot, error) {
+	names, err := r.backend.List(snapshotPrefix)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, 0, len(names))
+	for _, name := range names {
+		s, err := r.loadSnapshot(name)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// DeleteSnapshot 删除快照，快照引用的块在回收时才被删除
+func (r *Repository) DeleteSnapshot(id string) error {
+	s, err := r.LoadSnapshot(id)
+	if err != nil {
+		return err
+	}
+	return r.backend.Delete(snapshotPrefix + s.ID)
+}
+
+// Restore 将快照恢复到dst，恢复文件的内容、权限、修改时间和符号链接
+func (r *Repository) Restore(s *Snapshot, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	dirs := make([]*Node, 0)
+	for _, n := range s.Nodes {
+		// 与解压归档相同，拒绝..、绝对路径以及经过符号链接的路径
+		target, err := archiver.SafeJoin(dst, n.Name)
+		if err != nil {
+			return err
+		}
+		if n.Type == NodeDir {
+			if err := archiver.MakeDir(dst, target); err != nil {
+				return err
+			}
+			dirs = append(dirs, n)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		switch n.Type {
+		case NodeSymlink:
+			if err := os.Symlink(n.Link, target); err != nil {
+				return err
+			}
+			continue
+		case NodeFile:
+			if err := r.restoreFile(n, target); err != nil {
+				return err
+			}
+		}
+	}
+	// 由深到浅设置目录的权限和修改时间，不跟随符号链接
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := archiver.SetDirMeta(dst, dirs[i].Name, dirs[i].Mode.Perm(), dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) restoreFile(n *Node, target string) error {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := r.LoadStream(file, n.Chunks); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, n.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, n.ModTime, n.ModTime)
+}
+
+// GC 删除没有被任何快照引用的块，返回删除的块数
+// 有正在写入的快照时返回ErrLocked，有其它正在进行的回收时返回ErrGCRunning
+// force为true时忽略锁并删除遗留的回收的锁，只应该在确认锁已经失效时使用
+// 回收期间持有gc/下的锁，之后开始的快照看到该锁时放弃，不会与正在删除的块去重
+func (r *Repository) GC(force bool) (removed int, err error) {
+	running, err := r.backend.List(gcPrefix)
+	if err != nil {
+		return 0, err
+	}
+	if len(running) != 0 && !force {
+		return 0, fmt.Errorf("%w: %s", ErrGCRunning, strings.Join(running, ", "))
+	}
+	for _, name := range running {
+		if err := r.backend.Delete(name); err != nil {
+			return 0, err
+		}
+	}
+	if err := r.checkLocks(force); err != nil {
+		return 0, err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return 0, err
+	}
+	lock := gcPrefix + time.Now().Format("20060102150405") + "-" + hex.EncodeToString(suffix)
+	if err := r.backend.Put(lock, []byte(time.Now().Format(time.RFC3339))); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if dErr := r.backend.Delete(lock); err == nil {
+			err = dErr
+		}
+	}()
+	// 加锁之后再次检查，在加锁之前开始的快照此时一定已经加锁
+	if err := r.checkLocks(force); err != nil {
+		return 0, err
+	}
+	snapshots, err := r.ListSnapshots()
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[string]struct{})
+	for _, s := range snapshots {
+		for _, n := range s.Nodes {
+			for _, id := range n.Chunks {
+				used[id] = struct{}{}
+			}
+		}
+	}
+	names, err := r.backend.List(chunkPrefix)
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		id := name[strings.LastIndex(name, "/")+1:]
+		if _, ok := used[id]; ok {
+			continue
+		}
+		if err := r.backend.Delete(name); err != nil {
+			return removed, err
+		}
+		removed++
+		r.mu.Lock()
+		if r.known != nil {
+			delete(r.known, id)
+		}
+		r.mu.Unlock()
+	}
+	return removed, nil
+}
+
+// 有正在写入的快照时返回ErrLocked，force为true时忽略
+func (r *Repository) checkLocks(force bool) error {
+	locks, err := r.backend.List(lockPrefix)
+	if err != nil {
+		return err
+	}
+	if len(locks) != 0 && !force {
+		return fmt.Errorf("%w: %s", ErrLocked, strings.Join(locks, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+// Package schedule 计算备份流水线下一次启动的时间
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule 调度器的抽象，返回t之后下一次启动的时间
+// 没有下一次时返回零值
+type Schedule interface {
+	Next(t time.Time) time.Time
+	String() string
+}
+
+// New 根据配置创建调度器
+// cron表达式优先，没有配置cron时使用interval作为固定间隔
+func New(cron string, timezone string, interval time.Duration) (Schedule, error) {
+	if cron != "" {
+		loc := time.Local
+		if timezone != "" {
+			var err error
+			loc, err = time.LoadLocation(timezone)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ParseCron(cron, loc)
+	}
+	if interval > 0 {
+		return Every(interval), nil
+	}
+	return nil, errors.New("schedule: neither cron nor lopp_time is configured")
+}
+
+// ForJob 根据任务的配置创建调度器
+func ForJob(job config.Job) (Schedule, error) {
+	return New(job.Schedule.Cron, job.Schedule.Timezone, job.Interval())
+}
+
+// Interval 固定间隔的调度器，兼容原来的lopp_time
+type Interval time.Duration
+
+func Every(d time.Duration) Interval {
+	return Interval(d)
+}
+
+func (i Interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
+
+func (i Interval) String() string {
+	return "every " + time.Duration(i).String()
+}
+
+// Cron 标准的cron表达式调度器
+// 5个字段: 分 时 日 月 周
+// 6个字段: 秒 分 时 日 月 周
+type Cron struct {
+	expr                                  string
+	second, minute, hour, dom, month, dow uint64
+	// 日和周同时被限制时两者满足其一即可，与crontab的行为一致
+	domAny, dowAny bool
+	loc            *time.Location
+}
+
+type bounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	secondBounds = bounds{0, 59, nil}
+	minuteBounds = bounds{0, 59, nil}
+	hourBounds   = bounds{0, 23, nil}
+	domBounds    = bounds{1, 31, nil}
+	monthBounds  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7与0都表示周日
+	dowBounds = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// 预定义的表达式
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron 解析5个或6个字段的cron表达式，loc为nil时使用本地时区
+func ParseCron(expr string, loc *time.Location) (*Cron, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	spec := strings.TrimSpace(expr)
+	if v, ok := descriptors[strings.ToLower(spec)]; ok {
+		spec = v
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("cron %q: expected 5 or 6 fields, found %d", expr, len(fields))
+	}
+	c := &Cron{expr: expr, loc: loc}
+	var err error
+	for k, v := range []struct {
+		dst *uint64
+		b   bounds
+	}{
+		{&c.second, secondBounds},
+		{&c.minute, minuteBounds},
+		{&c.hour, hourBounds},
+		{&c.dom, domBounds},
+		{&c.month, monthBounds},
+		{&c.dow, dowBounds},
+	} {
+		*v.dst, err = parseField(fields[k], v.b)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+	}
+	// 周日可以写作0或7
+	if c.dow&(1<<7) != 0 {
+		c.dow = c.dow&^(1<<7) | 1
+	}
+	c.domAny = isAny(fields[3])
+	c.dowAny = isAny(fields[5])
+	return c, nil
+}
+
+func isAny(field string) bool {
+	return field == "*" || field == "?"
+}
+
+// 将一个字段解析为位图，第n位为1表示n满足条件
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeAndStep := strings.SplitN(part, "/", 2)
+		start, end := b.min, b.max
+		switch r := rangeAndStep[0]; {
+		case r == "*" || r == "?":
+		case strings.Contains(r, "-"):
+			lowHigh := strings.SplitN(r, "-", 2)
+			var err error
+			if start, err = parseValue(lowHigh[0], b); err != nil {
+				return 0, err
+			}
+			if end, err = parseValue(lowHigh[1], b); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if start, err = parseValue(r, b); err != nil {
+				return 0, err
+			}
+			// 没有步长的单个值
+			if len(rangeAndStep) == 1 {
+				end = start
+			}
+		}
+		step := 1
+		if len(rangeAndStep) == 2 {
+			var err error
+			step, err = strconv.Atoi(rangeAndStep[1])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+		}
+		if start > end {
+			return 0, fmt.Errorf("invalid range %q", part)
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, b bounds) (int, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("value %d out of range [%d, %d]", v, b.min, b.max)
+	}
+	return v, nil
+}
+
+// Next 返回t之后第一个满足表达式的时间，5年内没有满足的时间则返回零值
+func (c *Cron) Next(t time.Time) time.Time {
+	origin := t.Location()
+	t = t.In(c.loc)
+	// 从下一秒开始查找
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	added := false
+	yearLimit := t.Year() + 5
+
+wrap:
+	for t.Year() <= yearLimit {
+		for c.month&(1<<uint(t.Month())) == 0 {
+			if !added {
+				added = true
+				t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, c.loc)
+			}
+			t = t.AddDate(0, 1, 0)
+			if t.Month() == time.January {
+				continue wrap
+			}
+		}
+		for !c.dayMatches(t) {
+			if !added {
+				added = true
+				t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, c.loc)
+			}
+			t = t.AddDate(0, 0, 1)
+			// 夏令时切换可能导致零点不存在
+			if t.Hour() != 0 {
+				if t.Hour() > 12 {
+					t = t.Add(time.Duration(24-t.Hour()) * time.Hour)
+				} else {
+					t = t.Add(-time.Duration(t.Hour()) * time.Hour)
+				}
+			}
+			if t.Day() == 1 {
+				continue wrap
+			}
+		}
+		for c.hour&(1<<uint(t.Hour())) == 0 {
+			if !added {
+				added = true
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, c.loc)
+			}
+			t = t.Add(time.Hour)
+			if t.Hour() == 0 {
+				continue wrap
+			}
+		}
+		for c.minute&(1<<uint(t.Minute())) == 0 {
+			if !added {
+				added = true
+				t = t.Truncate(time.Minute)
+			}
+			t = t.Add(time.Minute)
+			if t.Minute() == 0 {
+				continue wrap
+			}
+		}
+		for c.second&(1<<uint(t.Second())) == 0 {
+			if !added {
+				added = true
+				t = t.Truncate(time.Second)
+			}
+			t = t.Add(time.Second)
+			if t.Second() == 0 {
+				continue wrap
+			}
+		}
+		return t.In(origin)
+	}
+	return time.Time{}
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func (c *Cron) String() string {
+	return fmt.Sprintf("cron %q (%s)", c.expr, c.loc)
+}
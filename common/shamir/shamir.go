@@ -0,0 +1,218 @@
+// Package shamir 在GF(256)上实现Shamir秘密共享
+//
+// 秘密被拆分为n份，任意k份可以还原秘密，少于k份无法得到秘密的任何信息
+// 份额的文本格式为BUPS-SHARE-1开头的base32编码，其中记录了门限、份额的序号、
+// 每次拆分随机生成的标识和秘密的名字(比如密钥的标识)
+// 拆分的是秘密加上以秘密为密钥的HMAC，单个份额中没有任何可以验证猜测的秘密的信息，
+// 还原之后使用HMAC校验结果
+package shamir
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SharePrefix 份额的文本格式的前缀
+const SharePrefix = "BUPS-SHARE-1"
+
+const (
+	idSize  = 8
+	macSize = 16
+)
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GF(256)的对数表和指数表，使用AES的既约多项式x^8+x^4+x^3+x+1，生成元为3
+var (
+	logTable [256]byte
+	expTable [510]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		// x *= 3
+		x ^= x << 1
+		if x&0x100 != 0 {
+			x ^= 0x11b
+		}
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+// Share 一个份额
+type Share struct {
+	// 还原需要的份额数
+	Threshold int
+	// 份额的序号，即多项式的自变量，从1开始
+	X byte
+	// 拆分时随机生成，同一次拆分的份额拥有相同的标识
+	ID []byte
+	// 秘密的名字，比如密钥的标识
+	Name string
+	// 秘密和校验码拼接之后的份额
+	Data []byte
+}
+
+// 以秘密为密钥的校验码，和秘密一起拆分，不单独出现在份额中
+func mac(secret []byte, id []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(id)
+	return h.Sum(nil)[:macSize]
+}
+
+// Split 将秘密拆分为n份，任意k份可以还原
+func Split(secret []byte, name string, n, k int) ([]*Share, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("shamir: secret is empty")
+	}
+	if k < 2 || n < k || n > 255 {
+		return nil, fmt.Errorf("shamir: invalid shares %d threshold %d, require 2 <= threshold <= shares <= 255", n, k)
+	}
+	if len(name) > 255 {
+		return nil, errors.New("shamir: name is too long")
+	}
+	id := make([]byte, idSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	payload := append(append([]byte{}, secret...), mac(secret, id)...)
+	shares := make([]*Share, n)
+	for i := range shares {
+		shares[i] = &Share{
+			Threshold: k,
+			X:         byte(i + 1),
+			ID:        id,
+			Name:      name,
+			Data:      make([]byte, len(payload)),
+		}
+	}
+	// 每一个字节使用一个k-1次的随机多项式，常数项为秘密
+	coefficients := make([]byte, k)
+	for i, b := range payload {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for _, s := range shares {
+			// 秦九韶算法求值
+			var y byte
+			for j := k - 1; j >= 0; j-- {
+				y = mul(y, s.X) ^ coefficients[j]
+			}
+			s.Data[i] = y
+		}
+	}
+	return shares, nil
+}
+
+// Combine 使用至少门限数量的份额还原秘密，并校验秘密的HMAC
+func Combine(shares []*Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("shamir: no share")
+	}
+	first := shares[0]
+	used := make([]*Share, 0, first.Threshold)
+	seen := make(map[byte]struct{}, len(shares))
+	for _, s := range shares {
+		if s.Threshold != first.Threshold || s.Name != first.Name || len(s.Data) != len(first.Data) ||
+			!bytes.Equal(s.ID, first.ID) {
+			return nil, errors.New("shamir: shares do not belong to the same secret")
+		}
+		if s.X == 0 {
+			return nil, errors.New("shamir: invalid share index 0")
+		}
+		if _, ok := seen[s.X]; ok {
+			continue
+		}
+		seen[s.X] = struct{}{}
+		if len(used) < first.Threshold {
+			used = append(used, s)
+		}
+	}
+	if len(first.Data) <= macSize {
+		return nil, errors.New("shamir: invalid share")
+	}
+	if len(used) < first.Threshold {
+		return nil, fmt.Errorf("shamir: need %d different shares, got %d", first.Threshold, len(used))
+	}
+	// 拉格朗日插值求x=0处的值
+	payload := make([]byte, len(first.Data))
+	for i, s := range used {
+		basis := byte(1)
+		for j, o := range used {
+			if i == j {
+				continue
+			}
+			// l_i(0) = Π x_j / (x_j - x_i)，GF(256)中减法即异或
+			basis = mul(basis, div(o.X, o.X^s.X))
+		}
+		for k := range payload {
+			payload[k] ^= mul(basis, s.Data[k])
+		}
+	}
+	secret := payload[:len(payload)-macSize]
+	if !hmac.Equal(mac(secret, first.ID), payload[len(secret):]) {
+		return nil, errors.New("shamir: recovered secret does not match its mac, some shares are corrupted")
+	}
+	return secret, nil
+}
+
+// String 份额的文本格式
+func (s *Share) String() string {
+	buf := bytes.NewBuffer(make([]byte, 0, 3+idSize+len(s.Name)+len(s.Data)))
+	buf.WriteByte(byte(s.Threshold))
+	buf.WriteByte(s.X)
+	buf.Write(s.ID)
+	buf.WriteByte(byte(len(s.Name)))
+	buf.WriteString(s.Name)
+	buf.Write(s.Data)
+	return SharePrefix + "-" + shareEncoding.EncodeToString(buf.Bytes())
+}
+
+// ParseShare 解析份额的文本格式
+func ParseShare(text string) (*Share, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(strings.ToUpper(text), SharePrefix+"-") {
+		return nil, errors.New("shamir: share does not start with " + SharePrefix)
+	}
+	data, err := shareEncoding.DecodeString(strings.ToUpper(text[len(SharePrefix)+1:]))
+	if err != nil || len(data) < 3+idSize {
+		return nil, errors.New("shamir: invalid share")
+	}
+	s := &Share{
+		Threshold: int(data[0]),
+		X:         data[1],
+		ID:        data[2 : 2+idSize],
+	}
+	data = data[2+idSize:]
+	size := int(data[0])
+	if len(data) < 1+size+1 {
+		return nil, errors.New("shamir: invalid share")
+	}
+	s.Name = string(data[1 : 1+size])
+	s.Data = data[1+size:]
+	return s, nil
+}
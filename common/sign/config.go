@@ -0,0 +1,47 @@
+package sign
+
+import (
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+)
+
+/*
+	配置文件选项:plugin.encrypt.sign
+	trusted为信任的公钥，可以是一个公钥或者公钥的列表
+*/
+
+// 签名的配置所在的插件和配置项
+const (
+	ConfigPlugin = "encrypt"
+	ConfigScope  = "sign"
+)
+
+// ParseTrusted 解析配置中的trusted选项
+func ParseTrusted(v interface{}) ([]*PublicKey, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	res := make([]*PublicKey, 0, len(list))
+	for _, t := range list {
+		key, err := ParsePublicKey(fmt.Sprint(t))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, key)
+	}
+	return res, nil
+}
+
+// ReadTrusted 读取plugin.encrypt.sign中信任的公钥，没有配置时返回nil
+// 读取配置时不改变cfg当前的插件名，调用者可以是任何插件
+func ReadTrusted(cfg *config.AutoGenerated) ([]*PublicKey, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	v, ok := cfg.PluginData(ConfigPlugin, ConfigScope)["trusted"]
+	if !ok {
+		return nil, nil
+	}
+	return ParseTrusted(v)
+}
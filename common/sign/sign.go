@@ -0,0 +1,257 @@
+// Package sign 为备份归档生成和验证分离的ed25519签名
+//
+// 签名文件与归档放在一起，扩展名为.sig，内容为JSON:
+// 签名覆盖归档的sha256摘要和元数据(远端对象的键、任务、主机、时间、bups的版本)
+// 恢复之前使用信任的公钥验证，防止存储桶中被放入篡改过的归档，
+// 对象的键必须与签名中的一致，防止旧的归档和签名替换新的对象
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Ext 签名文件的扩展名，签名文件的路径为归档的路径加上Ext
+	Ext = ".sig"
+	// 公钥和私钥的文本格式
+	PublicKeyPrefix  = "bupssig1"
+	SecretKeyPrefix  = "BUPS-SIGN-KEY-1"
+	AlgorithmEd25519 = "ed25519"
+	Version          = 1
+
+	// 签名内容的前缀，避免签名被用于其它用途
+	signContext = "bups-signature-v1\n"
+)
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ErrUntrusted 签名不是由信任的公钥产生的
+var ErrUntrusted = errors.New("sign: signature is not made by a trusted key")
+
+// Metadata 签名覆盖的元数据
+type Metadata struct {
+	// 签名时归档的文件名
+	Archive string `json:"archive"`
+	// 归档在存储中的对象键，由任务和运行的开始时间决定
+	Object string `json:"object"`
+	Size   int64  `json:"size"`
+	// 归档的sha256摘要
+	Digest    string `json:"digest"`
+	Job       string `json:"job"`
+	Host      string `json:"host"`
+	Timestamp string `json:"timestamp"`
+	// 产生归档的bups的版本
+	Version string `json:"version"`
+}
+
+// Signature 签名文件的内容
+type Signature struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+	// 签名公钥的指纹
+	KeyID     string   `json:"key_id"`
+	Metadata  Metadata `json:"metadata"`
+	Signature []byte   `json:"signature"`
+}
+
+func (m *Metadata) message() ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signContext), data...), nil
+}
+
+// PublicKey 验证签名使用的公钥
+type PublicKey struct {
+	key ed25519.PublicKey
+}
+
+// ParsePublicKey 解析bupssig1开头的公钥
+func ParsePublicKey(s string) (*PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(strings.ToLower(s), PublicKeyPrefix) {
+		return nil, fmt.Errorf("sign: public key %q does not start with %s", s, PublicKeyPrefix)
+	}
+	key, err := keyEncoding.DecodeString(strings.ToUpper(s[len(PublicKeyPrefix):]))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("sign: invalid public key %q", s)
+	}
+	return &PublicKey{key: key}, nil
+}
+
+func (p *PublicKey) String() string {
+	return PublicKeyPrefix + strings.ToLower(keyEncoding.EncodeToString(p.key))
+}
+
+// KeyID 公钥的指纹，为公钥的sha256摘要的前8个字节
+func (p *PublicKey) KeyID() string {
+	sum := sha256.Sum256(p.key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// PrivateKey 签名使用的私钥，保存在产生备份的主机上
+type PrivateKey struct {
+	key ed25519.PrivateKey
+}
+
+// GenerateKey 生成新的签名密钥对
+func GenerateKey() (*PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{key: key}, nil
+}
+
+// ParsePrivateKey 解析BUPS-SIGN-KEY-1开头的私钥
+func ParsePrivateKey(s string) (*PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(strings.ToUpper(s), SecretKeyPrefix) {
+		return nil, errors.New("sign: private key does not start with " + SecretKeyPrefix)
+	}
+	seed, err := keyEncoding.DecodeString(strings.ToUpper(s[len(SecretKeyPrefix):]))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("sign: invalid private key")
+	}
+	return &PrivateKey{key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// ReadPrivateKey 从文件中读取私钥，忽略空行和#开头的注释
+func ReadPrivateKey(path string) (*PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := ParsePrivateKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("sign: no private key in %s", path)
+}
+
+func (p *PrivateKey) String() string {
+	return SecretKeyPrefix + keyEncoding.EncodeToString(p.key.Seed())
+}
+
+// Public 私钥对应的公钥
+func (p *PrivateKey) Public() *PublicKey {
+	return &PublicKey{key: p.key.Public().(ed25519.PublicKey)}
+}
+
+// Digest 计算文件的sha256摘要和大小
+func Digest(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// Sign 签名归档，meta中的文件名、大小和摘要由归档计算，meta.Object必须设置
+func Sign(key *PrivateKey, archive string, meta Metadata) (*Signature, error) {
+	if meta.Object == "" {
+		return nil, errors.New("sign: object name of the archive is required")
+	}
+	digest, size, err := Digest(archive)
+	if err != nil {
+		return nil, err
+	}
+	meta.Archive = filepath.Base(archive)
+	meta.Digest = digest
+	meta.Size = size
+	msg, err := meta.message()
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{
+		Version:   Version,
+		Algorithm: AlgorithmEd25519,
+		KeyID:     key.Public().KeyID(),
+		Metadata:  meta,
+		Signature: ed25519.Sign(key.key, msg),
+	}, nil
+}
+
+// Verify 使用信任的公钥验证签名，并检查归档的摘要是否与签名中的一致
+// object为被验证的归档在存储中的对象键，必须与签名的对象键一致
+func (s *Signature) Verify(archive string, object string, trusted []*PublicKey) error {
+	if s.Version != Version || s.Algorithm != AlgorithmEd25519 {
+		return fmt.Errorf("sign: unsupported signature version %d algorithm %s", s.Version, s.Algorithm)
+	}
+	var key *PublicKey
+	for _, v := range trusted {
+		if v.KeyID() == s.KeyID {
+			key = v
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("%w: key %s", ErrUntrusted, s.KeyID)
+	}
+	msg, err := s.Metadata.message()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key.key, msg, s.Signature) {
+		return errors.New("sign: signature is invalid")
+	}
+	if s.Metadata.Object == "" || s.Metadata.Object != object {
+		return fmt.Errorf("sign: signature is made for object %q, not %q", s.Metadata.Object, object)
+	}
+	digest, size, err := Digest(archive)
+	if err != nil {
+		return err
+	}
+	if digest != s.Metadata.Digest || size != s.Metadata.Size {
+		return errors.New("sign: archive does not match the signed digest")
+	}
+	return nil
+}
+
+// WriteFile 将签名写入文件
+func (s *Signature) WriteFile(path string) error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// ReadFile 读取签名文件
+func ReadFile(path string) (*Signature, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(Signature)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("sign: decode %s: %w", path, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"github.com/abingzo/bups/common/repo"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"io/ioutil"
+	"strings"
+)
+
+// CosBackend 将仓库的对象存放在存储桶中Prefix目录下，实现repo.Backend
+type CosBackend struct {
+	Element *Cos
+	Prefix  string
+}
+
+// NewCosBackend 使用NewCos连接的存储桶存放仓库
+func NewCosBackend(c *Cos, prefix string) *CosBackend {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &CosBackend{Element: c, Prefix: prefix}
+}
+
+func (b *CosBackend) Put(name string, data []byte) error {
+	_, err := b.Element.client.Object.Put(context.Background(), b.Prefix+name, bytes.NewReader(data), nil)
+	return err
+}
+
+func (b *CosBackend) Get(name string) ([]byte, error) {
+	res, err := b.Element.client.Object.Get(context.Background(), b.Prefix+name, nil)
+	if err != nil {
+		if cos.IsNotFoundError(err) {
+			return nil, repo.ErrNotFound
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// List 分页列出对象，每页最多1000个
+func (b *CosBackend) List(prefix string) ([]string, error) {
+	names := make([]string, 0)
+	opt := &cos.BucketGetOptions{Prefix: b.Prefix + prefix, MaxKeys: 1000}
+	for {
+		res, _, err := b.Element.client.Bucket.Get(context.Background(), opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range res.Contents {
+			names = append(names, strings.TrimPrefix(v.Key, b.Prefix))
+		}
+		if !res.IsTruncated {
+			return names, nil
+		}
+		opt.Marker = res.NextMarker
+	}
+}
+
+func (b *CosBackend) Delete(name string) error {
+	return b.Element.Delete(b.Prefix + name)
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"github.com/abingzo/bups/common/config"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+/*
+	配置文件选项:plugin.upload.cos
+	基础的上传至Cos的接口，提供上传，下载，检索
+*/
+
+// 存储桶的配置所在的插件和配置项
+const (
+	ConfigPlugin = "upload"
+	ConfigScope  = "cos"
+)
+
+type Cos struct {
+	client     *cos.Client
+	sId        string
+	sKey       string
+	bucketUrl  string
+	serviceUrl string
+}
+
+// NewCos 根据plugin.upload.cos的配置连接存储桶
+// 读取配置时不改变cfg当前的插件名，调用者可以是任何插件
+func NewCos(cfg *config.AutoGenerated) *Cos {
+	c := &Cos{}
+	data := cfg.PluginData(ConfigPlugin, ConfigScope)
+	// 设置属性
+	c.sId, _ = data["sId"].(string)
+	c.sKey, _ = data["sKey"].(string)
+	c.bucketUrl, _ = data["bucketUrl"].(string)
+	c.serviceUrl, _ = data["serviceUrl"].(string)
+	// 连接服务端
+	bu, _ := url.Parse(c.bucketUrl)
+	bsu, _ := url.Parse(c.serviceUrl)
+	bucket := cos.BaseURL{
+		BucketURL:  bu,
+		ServiceURL: bsu,
+	}
+	c.client = cos.NewClient(&bucket, &http.Client{
+		Transport: &cos.AuthorizationTransport{
+			SecretID:  c.sId,
+			SecretKey: c.sKey,
+		},
+	})
+	return c
+}
+
+// Push 将本地文件上传为fileName对象
+func (c *Cos) Push(path string, fileName string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = c.client.Object.Put(context.Background(), fileName, file, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Cos) Download(fileName string) ([]byte, error) {
+	res, err := c.client.Object.Get(context.Background(), fileName, nil)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (c *Cos) Delete(fileName string) error {
+	_, err := c.client.Object.Delete(context.Background(), fileName)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Cos) Search() {}
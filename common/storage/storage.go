@@ -0,0 +1,54 @@
+// Package storage 访问存放归档和仓库的存储桶，并决定归档在存储中的对象键
+//
+// 存储桶的连接使用plugin.upload.cos的配置，upload、encrypt和backup插件共用该包，
+// 插件之间不需要互相导入
+package storage
+
+import (
+	"github.com/abingzo/bups/common/path"
+	"github.com/abingzo/bups/common/plugin"
+	"path/filepath"
+	"strings"
+)
+
+// DownloadDir 从存储桶下载的归档存放的目录
+const DownloadDir = path.DEFAULT_PATH_BACK_UPCACHE + "/download"
+
+// ObjectName 归档在存储中的对象键，根据备份的时间取名，一次运行有多个归档时追加归档的文件名
+// 非默认任务的归档放在以任务名命名的目录下
+func ObjectName(run *plugin.Run, artifact plugin.Artifact, total int) string {
+	prefix := run.StartTime.Format("2006-01-02-15-04")
+	if run.Job != "" && run.Job != plugin.DefaultJob {
+		prefix = run.Job + "/" + prefix
+	}
+	if total > 1 {
+		return prefix + "-" + filepath.Base(artifact.Path)
+	}
+	return prefix + fullExt(artifact.Path)
+}
+
+// 文件名中第一个.之后的部分，保留.tar.gz.enc这样的多级扩展名
+func fullExt(path string) string {
+	base := filepath.Base(path)
+	if i := strings.Index(base, "."); i > 0 {
+		return base[i:]
+	}
+	return ""
+}
+
+// ObjectOf 本地归档对应的对象键，下载目录中的归档为相对于下载目录的路径，其它归档为文件名
+func ObjectOf(archive string) string {
+	dir, err := filepath.Abs(DownloadDir)
+	if err != nil {
+		return filepath.Base(archive)
+	}
+	path, err := filepath.Abs(archive)
+	if err != nil {
+		return filepath.Base(archive)
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Base(archive)
+}
@@ -0,0 +1,198 @@
+// Package watchdog 跟踪每个任务最近一次成功的运行
+// 超过配置的时间没有成功的备份时发出告警，即死人开关
+package watchdog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/history"
+	"github.com/abingzo/bups/common/plugin"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Alert 一个任务超过阈值没有成功的备份
+type Alert struct {
+	Job string `json:"job"`
+	// 没有成功过时为watchdog启动的时间
+	LastSuccess time.Time     `json:"last_success"`
+	Gap         time.Duration `json:"gap"`
+	Threshold   time.Duration `json:"threshold"`
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("watchdog: job %s has no successful backup for %s (threshold %s, last success %s)",
+		a.Job, a.Gap.Round(time.Second), a.Threshold, a.LastSuccess.Format(time.RFC3339))
+}
+
+// Watchdog 死人开关
+type Watchdog struct {
+	mu    sync.Mutex
+	rules map[string]config.Watchdog
+	// 每个任务最近一次成功的时间
+	last map[string]time.Time
+	// 没有成功过的任务从启动的时间开始计算
+	start time.Time
+	// 同一次中断只告警一次，成功之后重新计算
+	alerted map[string]bool
+	alert   func(Alert, config.Watchdog)
+	now     func() time.Time
+}
+
+// New 根据任务的配置创建Watchdog，没有配置threshold的任务不会被检查
+// 没有成功过的任务从创建的时间开始计算
+func New(jobs []config.Job, alert func(Alert, config.Watchdog)) *Watchdog {
+	w := &Watchdog{
+		rules:   make(map[string]config.Watchdog),
+		last:    make(map[string]time.Time),
+		alerted: make(map[string]bool),
+		alert:   alert,
+		now:     time.Now,
+	}
+	w.start = w.now()
+	for _, v := range jobs {
+		if v.Watchdog.ThresholdDuration() <= 0 {
+			continue
+		}
+		w.rules[v.Name] = v.Watchdog
+	}
+	return w
+}
+
+// Enabled 是否有需要检查的任务
+func (w *Watchdog) Enabled() bool {
+	return len(w.rules) > 0
+}
+
+// Interval 所有任务中最短的检查间隔
+func (w *Watchdog) Interval() time.Duration {
+	var interval time.Duration
+	for _, v := range w.rules {
+		if d := v.IntervalDuration(); interval == 0 || d < interval {
+			interval = d
+		}
+	}
+	return interval
+}
+
+// Seed 使用运行历史恢复最近一次成功的时间
+func (w *Watchdog) Seed(entries []history.Entry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, v := range entries {
+		if _, ok := w.rules[v.Job]; !ok || v.Outcome != history.OutcomeSuccess {
+			continue
+		}
+		if v.EndTime.After(w.last[v.Job]) {
+			w.last[v.Job] = v.EndTime
+		}
+	}
+}
+
+// Observe 记录一次完成的运行，可以直接作为Context.OnRunComplete的回调
+func (w *Watchdog) Observe(run *plugin.Run) {
+	if run.Err() != nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.rules[run.Job]; !ok {
+		return
+	}
+	end := run.EndTime
+	if end.IsZero() {
+		end = w.now()
+	}
+	w.last[run.Job] = end
+	w.alerted[run.Job] = false
+}
+
+// Check 检查所有的任务并对新超过阈值的任务告警，返回当前所有超过阈值的任务
+func (w *Watchdog) Check() []Alert {
+	w.mu.Lock()
+	now := w.now()
+	alerts := make([]Alert, 0)
+	fire := make([]Alert, 0)
+	jobs := make([]string, 0, len(w.rules))
+	for k := range w.rules {
+		jobs = append(jobs, k)
+	}
+	sort.Strings(jobs)
+	for _, job := range jobs {
+		rule := w.rules[job]
+		last, ok := w.last[job]
+		if !ok {
+			last = w.start
+		}
+		gap := now.Sub(last)
+		if gap <= rule.ThresholdDuration() {
+			continue
+		}
+		alert := Alert{Job: job, LastSuccess: last, Gap: gap, Threshold: rule.ThresholdDuration()}
+		alerts = append(alerts, alert)
+		if !w.alerted[job] {
+			w.alerted[job] = true
+			fire = append(fire, alert)
+		}
+	}
+	w.mu.Unlock()
+	// 告警可能很慢，不持有锁
+	if w.alert != nil {
+		for _, v := range fire {
+			w.alert(v, w.rules[v.Job])
+		}
+	}
+	return alerts
+}
+
+// Run 按照检查间隔循环检查，直到stop被关闭
+func (w *Watchdog) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.Interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// SetClock 替换获取当前时间的函数，用于测试
+func (w *Watchdog) SetClock(now func() time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.now = now
+}
+
+// SetStart 设置没有成功过的任务开始计算的时间
+func (w *Watchdog) SetStart(t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.start = t
+}
+
+// Post 将告警以JSON的形式POST到url
+func Post(client *http.Client, url string, alert Alert) error {
+	body, err := json.Marshal(struct {
+		Alert
+		Message string `json:"message"`
+	}{alert, alert.String()})
+	if err != nil {
+		return err
+	}
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("watchdog: post %s: unexpected status %s", url, res.Status)
+	}
+	return nil
+}
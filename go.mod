@@ -1,10 +1,34 @@
 module github.com/abingzo/bups
 
-go 1.15
+go 1.22
 
 require (
 	github.com/BurntSushi/toml v0.3.1
-	github.com/google/uuid v1.1.2 // indirect
+	github.com/klauspost/compress v1.18.0
 	github.com/tencentyun/cos-go-sdk-v5 v0.7.24
+	github.com/ulikunitz/xz v0.5.9
 	github.com/zbh255/bilog v0.3.0
+	golang.org/x/crypto v0.11.0
+	golang.org/x/sys v0.10.0
+)
+
+require (
+	github.com/QcloudApi/qcloud_sign_golang v0.0.0-20141224014652-e4130a326409 // indirect
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/google/go-querystring v1.0.0 // indirect
+	github.com/google/uuid v1.1.2 // indirect
+	github.com/mozillazg/go-httpheader v0.2.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.0 // indirect
+	github.com/stretchr/testify v1.7.1 // indirect
+	github.com/yuin/goldmark v1.4.13 // indirect
+	golang.org/x/mod v0.8.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/term v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	golang.org/x/tools v0.6.0 // indirect
+	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -4,8 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"github.com/abingzo/bups/app"
+	"github.com/abingzo/bups/common/metrics"
 	"github.com/abingzo/bups/common/path"
 	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/recovery"
+	"github.com/abingzo/bups/common/schedule"
 	"github.com/abingzo/bups/iocc"
 	"os"
 	"os/signal"
@@ -22,7 +25,7 @@ func main() {
 	// 处理错误
 	defer func() {
 		if err := recover(); err != nil {
-			stack := stack(3)
+			stack := recovery.Stack(3)
 			fmt.Printf("PANIC: %s\n%s", err, stack)
 		}
 	}()
@@ -32,19 +35,20 @@ func main() {
 	app.RegisterSource(*configFilePath)
 	// 加载插件代码
 	ctx := app.LoaderPlugin(*configFilePath)
+	ctx.Version = GetInfo().Version
 	// 为插件准备存放文件的文件夹，已存在则不创建
-	ctx.RangeAllPlugin(func(k int, v plugin.Plugin) {
-		info, err := os.Stat(path.DEFAULT_PATH_BACK_UPCACHE + "/" + v.GetName())
+	ctx.RangeJobPlugin(func(k int, job string, v plugin.Plugin) {
+		dir := plugin.CacheDir(job, v.GetName())
+		info, err := os.Stat(dir)
 		if err == nil && info.IsDir() {
 			return
 		}
 		// 不存在则创建
-		err = os.MkdirAll(path.DEFAULT_PATH_BACK_UPCACHE+"/"+v.GetName(), 0755)
+		err = os.MkdirAll(dir, 0755)
 		if err != nil {
 			panic(err)
 		}
 	})
-	mainConf := iocc.GetConfig().Project
 	// 处理参数，如果有插件需要，则交给该插件
 	if app.ArgsProcess(ctx,GetInfo) {
 		return
@@ -55,24 +59,48 @@ func main() {
 		signal.Notify(c, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGINT)
 		switch v := <-c; v {
 		case syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGINT:
-			ctx.RangeAllPlugin(func(k int, v plugin.Plugin) {
-				v.Caller(plugin.Exit)
-			})
+			ctx.Broadcast(plugin.Exit)
 			os.Exit(0)
 		}
 	}()
 	// TODO:解决初始化正常却无法打印日志的问题
 
 	// 没有参数处理的情况下则通过调度器直接启动程序
+	// 记录每一次运行的结果
+	app.RecordHistory(ctx)
+	// 收集并导出指标
+	registry := app.ServeMetrics(ctx)
+	// 长时间没有成功的备份时告警
+	app.StartWatchdog(ctx)
 	// 启动初始化插件
 	ctx.SetState(plugin.Init)
+	// 每个任务按照自己的调度规则运行
+	// 插件的panic在Context中被隔离并记录到错误日志，失败的运行等待下一个周期重试
+	for _, job := range iocc.GetConfig().Jobs() {
+		sched, err := schedule.ForJob(job)
+		if err != nil {
+			panic(fmt.Errorf("job %s: %w", job.Name, err))
+		}
+		go runJob(ctx, registry, job.Name, sched)
+	}
+	select {}
+}
+
+// runJob 按照调度规则循环运行一个任务
+func runJob(ctx *plugin.Context, registry *metrics.Registry, job string, sched schedule.Schedule) {
+	accessLog := iocc.GetAccessLog()
 	for {
-		timer := time.After(time.Duration(mainConf.LoppTime) * time.Minute)
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			iocc.GetErrorLog().ErrorFromString(fmt.Sprintf("job %s: schedule has no next run: %s", job, sched))
+			return
+		}
+		accessLog.Info(fmt.Sprintf("job %s: next run at %s", job, next.Format(time.RFC3339)))
+		registry.SetNextRun(job, next)
+		timer := time.After(time.Until(next))
 		select {
 		case <-timer:
-			ctx.SetState(plugin.BCollect)
-			ctx.SetState(plugin.BHandle)
-			ctx.SetState(plugin.BCallBack)
+			_, _ = ctx.RunJob(job)
 		}
 	}
 }
@@ -1,18 +1,22 @@
 package backup
 
 import (
-	"archive/zip"
-	"errors"
 	"flag"
 	"fmt"
+	"github.com/abingzo/bups/common/archiver"
 	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/filter"
+	"github.com/abingzo/bups/common/incremental"
 	"github.com/abingzo/bups/common/path"
 	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/repo"
+	"github.com/abingzo/bups/common/sign"
+	"github.com/abingzo/bups/common/storage"
 	"github.com/zbh255/bilog"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -33,18 +37,8 @@ var (
 	debugShow = false
 )
 
-// 数据库备份的参数
-var mysqlDumpArgs = []string{
-	"--host",
-	"--port",
-	"--user",
-	"--password",
-	"--databases",
-	"--lock-tables",
-}
-
 func New() plugin.Plugin {
-	return &Backup{}
+	return plugin.WrapV2(&Backup{})
 }
 
 type Backup struct {
@@ -53,102 +47,320 @@ type Backup struct {
 	errorLog  bilog.Logger
 	stdLog    bilog.Logger
 	cfg       *config.AutoGenerated
+	// 存放备份文件的目录，不同的任务使用不同的目录
+	cacheDir string
+	// 参数启动时指定--full，开启增量备份时仍然进行完整备份
+	forceFull bool
+	// 开启仓库时本次备份的快照，文件和数据库转储写入快照而不是归档
+	snapshot *repo.SnapshotWriter
 }
 
 func (b *Backup) Caller(s plugin.Single) {
 	b.stdLog.Info("Caller")
 }
 
-func (b *Backup) Start(args []string) {
-	if args != nil || len(args) != 0 {
-		os.Args = args
-		debugIf := flag.Bool("debug", false, "是否开启调试模式")
-		flag.Parse()
-		debugShow = *debugIf
+func (b *Backup) Exec(run *plugin.Run, args []string) error {
+	// 配置对象由插件共用，每次运行重新设置插件名
+	b.cfg.SetPluginName(Name)
+	if len(args) != 0 {
+		restored, err := b.execArgs(args)
+		if err != nil || restored {
+			return err
+		}
+	}
+	rc, err := b.readRepositoryConfig()
+	if err != nil {
+		return err
+	}
+	if !rc.enable {
+		if err := b.backupFile(run); err != nil {
+			return err
+		}
+		return b.backupDatabase(run)
+	}
+	r, err := b.openRepository(rc)
+	if err != nil {
+		return err
+	}
+	if b.snapshot, err = b.newSnapshot(run, r); err != nil {
+		return err
+	}
+	defer func() { b.snapshot = nil }()
+	if err = b.backupFile(run); err == nil {
+		err = b.backupDatabase(run)
+	}
+	if err != nil {
+		// 已经写入的块在回收时被删除
+		if aErr := b.snapshot.Abort(); aErr != nil {
+			b.errorLog.ErrorFromString(aErr.Error())
+		}
+		return err
+	}
+	return b.commitSnapshot(run, r, b.snapshot)
+}
+
+// 参数启动时的选项，--debug打印执行的命令，--full在开启增量备份时进行完整备份
+// 恢复一个文件归档: --restore blog.harder.com->root.tar.gz --target /User/harder [--same-owner]
+// 恢复增量备份时给出完整备份和之后的增量备份: --restore full.tar.gz,inc1.tar.gz,inc2.tar.gz
+// 恢复时重新设置归档中记录的权限、修改时间、扩展属性，以root运行时默认恢复属主
+// 配置了信任的公钥时恢复的归档必须有通过验证的签名，从签名的外层归档中取出的归档使用--from给出外层归档
+// 开启仓库时: --snapshots列出快照，--restore-snapshot <id|latest> --target dir恢复快照，
+// --forget <id>删除快照，--gc [--force]回收没有被快照引用的块
+func (b *Backup) execArgs(args []string) (bool, error) {
+	flags := flag.NewFlagSet(Name, flag.ContinueOnError)
+	debug := flags.Bool("debug", false, "是否开启调试模式")
+	full := flags.Bool("full", false, "开启增量备份时进行完整备份")
+	restore := flags.String("restore", "", "需要恢复的文件归档，增量备份的归档以逗号分隔")
+	from := flags.String("from", "", "恢复的归档所在的签名过的外层归档，以逗号分隔")
+	target := flags.String("target", ".", "恢复到的目录")
+	sameOwner := flags.Bool("same-owner", os.Geteuid() == 0, "恢复文件的属主")
+	snapshots := flags.Bool("snapshots", false, "列出仓库中的快照")
+	restoreSnapshot := flags.String("restore-snapshot", "", "需要恢复的快照，可以是唯一的前缀或者latest")
+	forget := flags.String("forget", "", "需要删除的快照")
+	gc := flags.Bool("gc", false, "回收没有被快照引用的块")
+	force := flags.Bool("force", false, "回收时忽略正在写入的快照的锁")
+	if err := flags.Parse(args[1:]); err != nil {
+		return false, err
+	}
+	debugShow = *debug
+	b.forceFull = *full
+	if done, err := b.execRepository(*snapshots, *restoreSnapshot, *target, *forget, *gc, *force); done || err != nil {
+		return true, err
+	}
+	if *restore == "" {
+		return false, nil
+	}
+	archives := strings.Split(*restore, ",")
+	if err := b.verifyRestore(archives, *from); err != nil {
+		return true, err
+	}
+	err := incremental.Restore(archives, *target, archiver.ExtractOptions{
+		SameOwner: *sameOwner,
+		OnWarn: func(name string, err error) {
+			b.errorLog.ErrorFromString(fmt.Sprintf("restore %s metadata: %s", name, err))
+		},
+	})
+	if err != nil {
+		return true, err
+	}
+	b.accessLog.Info("restore " + *restore + " to " + *target + " complete")
+	return true, nil
+}
+
+// 配置了信任的公钥时在解压之前验证签名，给出了外层归档时验证外层归档，否则验证每一个恢复的归档
+// 签名为归档旁边的.sig文件，对象键与encrypt插件相同，下载目录中的归档为相对于下载目录的路径
+func (b *Backup) verifyRestore(archives []string, from string) error {
+	trusted, err := sign.ReadTrusted(b.cfg)
+	if err != nil || len(trusted) == 0 {
+		return err
+	}
+	signed := archives
+	if from != "" {
+		signed = strings.Split(from, ",")
 	}
-	b.backupFile()
-	b.backupDatabase()
+	for _, v := range signed {
+		sig, err := sign.ReadFile(v + sign.Ext)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("backup: trusted keys are configured but %s%s does not exist", v, sign.Ext)
+			}
+			return err
+		}
+		if err := sig.Verify(v, storage.ObjectOf(v), trusted); err != nil {
+			return fmt.Errorf("backup: verify %s: %w", v, err)
+		}
+	}
+	return nil
 }
 
 // 备份文件
-func (b *Backup) backupFile() {
+// 符号链接不会被跟随，套接字和命名管道被跳过并记录一条警告
+// file_path中的一项为目录的路径，或者包含path和过滤选项的表
+func (b *Backup) backupFile(run *plugin.Run) error {
+	opts := archiver.FromConfig(b.cfg.Project.Archive)
+	err := opts.Validate()
+	if err != nil {
+		return err
+	}
+	global, err := b.readFilterConfig()
+	if err != nil {
+		return err
+	}
+	inc, err := b.readIncrementalConfig()
+	if err != nil {
+		return err
+	}
+	var skippedFiles, skippedBytes int64
 	b.cfg.SetPluginScope(ScopeFilePath)
 	b.cfg.RangePluginData(func(k string, v interface{}) {
-		src, ok := v.(string)
-		if !ok {
-			panic("file path data type is not a string")
+		if err != nil {
+			return
 		}
-		// 根据备份的目录名加配置选项名创建一个目标zip文件
+		var src string
+		entry := &filterConfig{}
+		switch value := v.(type) {
+		case string:
+			src = value
+		case map[string]interface{}:
+			for option, ov := range value {
+				if option == "path" {
+					src = fmt.Sprint(ov)
+					continue
+				}
+				var ok bool
+				if ok, err = entry.set(option, ov); err != nil {
+					return
+				} else if !ok {
+					err = fmt.Errorf("file path %s has unknown option %s", k, option)
+					return
+				}
+			}
+			if src == "" {
+				err = fmt.Errorf("file path %s has no path", k)
+				return
+			}
+		default:
+			err = fmt.Errorf("file path %s data type is not a string", k)
+			return
+		}
+		var f *filter.Filter
+		if f, err = newFilter(global, entry); err != nil {
+			return
+		}
+		// 根据备份的目录名加配置选项名创建一个目标归档，扩展名由任务的归档格式决定
 		// Example: /User/harder/blog.harder.com -> ./cache/backup/blog.harder.com->root.zip
 		srcSplit := strings.Split(src, "/")
-		dstFile := fmt.Sprintf("%s/%s->%s.zip", BackupFilePath, srcSplit[len(srcSplit)-1], k)
-		err := Zip(src, dstFile)
-		// 归档为zip时出现错误则panic
-		if err != nil {
-			panic(err)
+		if b.snapshot != nil {
+			// 快照中的目录与归档同名，仓库自身去重，不使用增量备份
+			b.snapshot.Filter = f
+			if err = b.snapshot.AddTree(src, srcSplit[len(srcSplit)-1]+"->"+k); err != nil {
+				return
+			}
+			skippedFiles += f.SkippedFiles
+			skippedBytes += f.SkippedBytes
+			return
 		}
+		var tracker *incremental.Tracker
+		if inc.enable {
+			if tracker, err = b.newTracker(run, inc, k, src, f); err != nil {
+				return
+			}
+		}
+		dstFile := fmt.Sprintf("%s/%s->%s%s", b.cacheDir, srcSplit[len(srcSplit)-1], k, opts.Ext())
+		if err = b.archive(src, dstFile, opts, k, f, tracker); err != nil {
+			return
+		}
+		skippedFiles += f.SkippedFiles
+		skippedBytes += f.SkippedBytes
+		meta := map[string]string{
+			"key":           k,
+			"source":        src,
+			"skipped_files": strconv.FormatInt(f.SkippedFiles, 10),
+			"skipped_bytes": strconv.FormatInt(f.SkippedBytes, 10),
+		}
+		if tracker != nil {
+			m := tracker.Manifest()
+			meta["backup_type"] = incremental.TypeIncremental
+			if tracker.Full() {
+				meta["backup_type"] = incremental.TypeFull
+			}
+			meta["chain"] = m.Chain
+			meta["sequence"] = strconv.Itoa(m.Sequence)
+			b.accessLog.Info(fmt.Sprintf("%s backup of %s: %d changed %d unchanged files",
+				meta["backup_type"], k, tracker.Changed, tracker.Unchanged))
+			if err = b.commitManifest(run, k, m); err != nil {
+				return
+			}
+		}
+		err = emit(run, plugin.KindFile, dstFile, meta)
 	})
+	if err != nil {
+		return err
+	}
 	// 打印一条备份成功的日志
-	b.accessLog.Info("backup file complete")
+	b.accessLog.Info(fmt.Sprintf("backup file complete, skipped %d files %d bytes", skippedFiles, skippedBytes))
+	return nil
 }
 
-// 备份数据库
-// 目前只支持mysql driver
-func (b *Backup) backupDatabase() {
-	b.cfg.SetPluginScope(ScopeDataBase)
-	args := make([]string, 0, 2)
-	// 检查驱动
-	switch b.cfg.PluginGetData("driver").(string) {
-	case "mysql":
-		args = append(args, "mysqldump")
-		args = append(args, encodeMysqldumpArguments(b.cfg)...)
-	default:
-		panic(errors.New("no support database driver"))
-	}
-	// 创建存储备份的文件
-	file, err := os.OpenFile(BackupFilePath+"/database.sql", os.O_CREATE|os.O_WRONLY, 0777)
+// 归档一个目录，开启增量备份时tracker不为nil，只写入变化的文件和备份信息
+func (b *Backup) archive(src string, dst string, opts archiver.Options, key string, f archiver.Filter,
+	tracker *incremental.Tracker) error {
+	w, err := archiver.Create(dst, opts)
 	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
-	if debugShow {
-		_, _ = b.stdOut.Write([]byte(strings.Join(args, " ")))
-	}
-	// 创建子进程去执行任务，并重定向它的输出以获得结果
-	cmd := exec.Command(args[0])
-	// 修改参数
-	cmd.Args = args
-	cmd.Stdout = file
-	err = cmd.Run()
-	if err != nil {
-		panic(errors.New(err.Error() + fmt.Sprintf(" args: %v",cmd.Args)))
+		return err
 	}
-	// 打印一条备份成功的日志
-	b.accessLog.Info("backup database complete")
+	w.Filter = f
+	if tracker != nil {
+		w.Filter = tracker
+	}
+	w.OnSkip = func(path string, info os.FileInfo) {
+		b.errorLog.ErrorFromString(fmt.Sprintf("skip special file %s (%s)", path, info.Mode().Type()))
+	}
+	if err := w.AddTree(src); err != nil {
+		w.Close()
+		return err
+	}
+	if tracker != nil {
+		if err := b.addIncrementInfo(w, key, tracker.Info(archiver.TreeRoot(src))); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
 }
 
-// 编码参数
-// 配置值均为字符串，否则会引起类型断言失败panic
-func encodeMysqldumpArguments(cfg *config.AutoGenerated) []string {
-	args := make([]string, 0, 10)
-	cfg.SetPluginScope(ScopeDataBase)
-	for _, v := range mysqlDumpArgs {
-		switch v {
-		case "--host", "--port", "--user", "--password":
-			args = append(args,fmt.Sprintf("%s=%s",v,cfg.PluginGetData(v[2:]).(string)))
-		case "--databases":
-			args = append(args,v)
-			c := cfg.PluginGetData(v[2:]).([]interface{})
-			strSlice := make([]string, len(c))
-			for k, v := range c {
-				strSlice[k] = v.(string)
+// 备份数据库，每一个转储目标写入自己的文件
+func (b *Backup) backupDatabase(run *plugin.Run) error {
+	targets, err := b.readTargets()
+	if err != nil || len(targets) == 0 {
+		return err
+	}
+	parallel, err := b.dumpParallel()
+	if err != nil {
+		return err
+	}
+	results, err := DumpTargets(targets, b.cacheDir, parallel)
+	if err != nil {
+		return err
+	}
+	files := 0
+	for k, dumps := range results {
+		for _, d := range dumps {
+			if b.snapshot != nil {
+				// 与目录相同，转储只写入快照，不再交给之后的插件归档和上传
+				if err = b.snapshot.AddFile("database/"+filepath.Base(d.Path), d.Path); err != nil {
+					return err
+				}
+			} else {
+				meta := map[string]string{
+					"target":    targets[k].Name,
+					"driver":    targets[k].Driver,
+					"databases": strings.Join(d.Databases, ","),
+					"duration":  d.Duration.String(),
+				}
+				for k, v := range d.Meta {
+					meta[k] = v
+				}
+				if err = emit(run, plugin.KindDatabase, d.Path, meta); err != nil {
+					return err
+				}
 			}
-			args = append(args, strSlice...)
-		default:
-			args = append(args, v)
+			b.accessLog.Info(fmt.Sprintf("dump %s complete: %d bytes in %s", filepath.Base(d.Path), d.Size, d.Duration))
+			files++
 		}
 	}
-	return args
+	// 打印一条备份成功的日志
+	b.accessLog.Info(fmt.Sprintf("backup database complete, %d targets %d files", len(targets), files))
+	return nil
+}
+
+// 将产物登记到当前的流水线中，没有流水线时(比如参数启动)则忽略
+func emit(run *plugin.Run, kind plugin.ArtifactKind, path string, meta map[string]string) error {
+	if run == nil {
+		return nil
+	}
+	_, err := run.EmitMeta(Name, kind, path, meta)
+	return err
 }
 
 func (b *Backup) GetName() string {
@@ -169,51 +381,8 @@ func (b *Backup) SetSource(source *plugin.Source) {
 	b.accessLog = source.AccessLog
 	b.errorLog = source.ErrorLog
 	b.stdLog = source.StdLog
-}
-
-// Zip srcFile could be a single file or a directory
-// destZip必须为一个正确的文件路径，否则返回错误
-func Zip(srcFile string, destZip string) error {
-	zipfile, err := os.OpenFile(destZip, os.O_CREATE|os.O_WRONLY, 0777)
-	if err != nil {
-		return err
+	b.cacheDir = source.CacheDir
+	if b.cacheDir == "" {
+		b.cacheDir = BackupFilePath
 	}
-	defer zipfile.Close()
-
-	archive := zip.NewWriter(zipfile)
-	defer archive.Close()
-
-	return filepath.Walk(srcFile, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
-
-		header.Name = strings.TrimPrefix(path, filepath.Dir(srcFile)+"/")
-		// header.Name = path
-		if info.IsDir() {
-			header.Name += "/"
-		} else {
-			header.Method = zip.Deflate
-		}
-
-		writer, err := archive.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			_, err = io.Copy(writer, file)
-		}
-		return err
-	})
 }
@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/*
+	配置文件选项:plugin.backup.databases
+	每一个[[plugin.backup.databases]]是一个独立的转储目标，拥有自己的name、driver、连接信息和转储选项，
+	file为转储文件名的前缀，默认为name。plugin.backup.database作为名为database的目标继续有效
+	配置文件选项:plugin.backup.dump
+	parallel为同时转储的目标数，默认为2
+*/
+
+const (
+	ScopeDataBases = "databases"
+	ScopeDump      = "dump"
+	// 同时转储的目标数
+	defaultDumpParallel = 2
+)
+
+// 读取配置中的所有转储目标，按名字排序
+func (b *Backup) readTargets() ([]*Target, error) {
+	targets := make([]*Target, 0)
+	b.cfg.SetPluginScope(ScopeDataBase)
+	options := make(map[string]interface{})
+	b.cfg.RangePluginData(func(k string, v interface{}) {
+		options[k] = v
+	})
+	if len(options) != 0 {
+		targets = append(targets, NewTarget(ScopeDataBase, options))
+	}
+	var err error
+	b.cfg.SetPluginScope(ScopeDataBases)
+	b.cfg.RangePluginData(func(k string, v interface{}) {
+		if err != nil {
+			return
+		}
+		options, ok := v.(map[string]interface{})
+		if !ok {
+			err = fmt.Errorf("backup: databases.%s is not a table", k)
+			return
+		}
+		targets = append(targets, NewTarget(k, options))
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Name < targets[j].Name
+	})
+	// 每一个目标转储到自己的文件中
+	files := make(map[string]string, len(targets))
+	for _, t := range targets {
+		if _, ok := drivers[t.Driver]; !ok {
+			return nil, fmt.Errorf("backup: no support database driver %s in %s", t.Driver, t.Name)
+		}
+		if t.File != filepath.Base(t.File) || t.File == "." || t.File == ".." {
+			return nil, fmt.Errorf("backup: invalid dump file name %s in %s", t.File, t.Name)
+		}
+		if other, ok := files[t.File]; ok {
+			return nil, fmt.Errorf("backup: %s and %s dump to the same file %s", other, t.Name, t.File)
+		}
+		files[t.File] = t.Name
+	}
+	return targets, nil
+}
+
+// 同时转储的目标数
+func (b *Backup) dumpParallel() (int, error) {
+	b.cfg.SetPluginScope(ScopeDump)
+	v := b.cfg.PluginGetData("parallel")
+	if v == nil {
+		return defaultDumpParallel, nil
+	}
+	n, ok := v.(int64)
+	if !ok || n <= 0 {
+		return 0, fmt.Errorf("backup: dump parallel %v is not a positive integer", v)
+	}
+	return int(n), nil
+}
+
+// DumpTargets 最多parallel个目标同时转储，返回的结果与targets一一对应
+// 所有的转储结束之后才返回，失败的目标的错误被合并
+func DumpTargets(targets []*Target, dir string, parallel int) ([][]*Dump, error) {
+	results := make([][]*Dump, len(targets))
+	errs := make([]error, len(targets))
+	sem := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for k, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(k int, t *Target) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			dumps, err := DumpTarget(t, dir)
+			if err != nil {
+				errs[k] = fmt.Errorf("backup: dump %s: %w", t.Name, err)
+				return
+			}
+			results[k] = dumps
+		}(k, t)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
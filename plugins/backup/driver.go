@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+	数据库的转储驱动，配置中的driver选择驱动
+	每一种数据库实现Driver，转储的文件作为database产物交给之后的插件
+*/
+
+// Driver 数据库的转储驱动
+type Driver interface {
+	// Dump 转储目标中的数据库，文件写入dir，返回产生的文件
+	Dump(target *Target, dir string) ([]*Dump, error)
+}
+
+// Dump 转储产生的一个文件
+type Dump struct {
+	Path string
+	// 文件中包含的数据库
+	Databases []string
+	// 描述文件的附加信息，比如转储的格式
+	Meta map[string]string
+	// 文件的大小和转储花费的时间
+	Size     int64
+	Duration time.Duration
+}
+
+// 支持的驱动
+var drivers = map[string]Driver{
+	"mysql":    mysqlDriver{},
+	"postgres": postgresDriver{},
+	"sqlite":   sqliteDriver{},
+	"mongodb":  mongodbDriver{},
+	"redis":    redisDriver{},
+}
+
+// DumpTarget 使用目标配置的驱动转储数据库
+func DumpTarget(target *Target, dir string) ([]*Dump, error) {
+	driver, ok := drivers[target.Driver]
+	if !ok {
+		return nil, fmt.Errorf("backup: no support database driver %s", target.Driver)
+	}
+	dumps, err := driver.Dump(target, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dumps {
+		info, err := os.Stat(d.Path)
+		if err != nil {
+			return nil, err
+		}
+		d.Size = info.Size()
+	}
+	return dumps, nil
+}
+
+// Target 一个需要转储的数据库目标
+type Target struct {
+	Name   string
+	Driver string
+	// 转储文件的名字以它开头，没有配置file时为Name
+	File    string
+	options map[string]interface{}
+}
+
+// NewTarget 使用配置中的选项创建目标
+func NewTarget(name string, options map[string]interface{}) *Target {
+	t := &Target{Name: name, Driver: fmt.Sprint(options["driver"]), File: name, options: options}
+	if file := t.String("file"); file != "" {
+		t.File = file
+	}
+	return t
+}
+
+// String 字符串选项，没有配置时为空
+func (t *Target) String(k string) string {
+	v, ok := t.options[k]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// Strings 字符串数组选项，单个字符串视为只有一项的数组
+func (t *Target) Strings(k string) []string {
+	v, ok := t.options[k]
+	if !ok || v == nil {
+		return nil
+	}
+	return stringList(v)
+}
+
+// Bool 布尔选项，没有配置时为def
+func (t *Target) Bool(k string, def bool) bool {
+	v, ok := t.options[k].(bool)
+	if !ok {
+		return def
+	}
+	return v
+}
+
+// 执行转储的命令，stdout不为空时将命令的输出写入该文件
+// 命令失败时错误中包含标准错误的输出，不包含命令的参数以免泄露口令
+func runDump(cmd *exec.Cmd, stdout string) error {
+	if debugShow {
+		fmt.Fprintln(os.Stdout, strings.Join(cmd.Args, " "))
+	}
+	if stdout != "" {
+		file, err := os.OpenFile(stdout, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		cmd.Stdout = file
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return fmt.Errorf("%s: %w", cmd.Args[0], err)
+		}
+		return fmt.Errorf("%s: %w: %s", cmd.Args[0], err, msg)
+	}
+	return nil
+}
+
+// 执行命令并返回标准输出
+func runOutput(cmd *exec.Cmd) (string, error) {
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	if err := runDump(cmd, ""); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"fmt"
+	"github.com/abingzo/bups/common/filter"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.backup.filter
+	所有备份的目录共用的排除规则，file_path中的每一项也可以配置自己的规则
+	[plugin.backup.file_path.root]
+	path = "/var/www/blog"
+	exclude = ["wp-content/cache/"]
+*/
+
+const ScopeFilter = "filter"
+
+// 过滤的选项
+type filterConfig struct {
+	exclude   []string
+	include   []string
+	maxSize   int64
+	skipNewer time.Duration
+	// 为nil时使用上一级的配置
+	ignoreFile *string
+}
+
+// 设置一个选项，不是过滤的选项时返回false
+func (c *filterConfig) set(k string, v interface{}) (bool, error) {
+	switch k {
+	case "exclude":
+		c.exclude = stringList(v)
+	case "include":
+		c.include = stringList(v)
+	case "max_size":
+		size, err := filter.ParseSize(v)
+		if err != nil {
+			return true, err
+		}
+		c.maxSize = size
+	case "skip_newer":
+		seconds, ok := v.(int64)
+		if !ok || seconds < 0 {
+			return true, fmt.Errorf("backup: skip_newer %v is not a number of seconds", v)
+		}
+		c.skipNewer = time.Duration(seconds) * time.Second
+	case "ignore_file":
+		name := fmt.Sprint(v)
+		c.ignoreFile = &name
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// 读取全局的过滤选项
+func (b *Backup) readFilterConfig() (*filterConfig, error) {
+	c := &filterConfig{}
+	var err error
+	b.cfg.SetPluginScope(ScopeFilter)
+	b.cfg.RangePluginData(func(k string, v interface{}) {
+		if err != nil {
+			return
+		}
+		var ok bool
+		if ok, err = c.set(k, v); err == nil && !ok {
+			err = fmt.Errorf("backup: unknown filter option %s", k)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 使用全局的选项和file_path中一项的选项创建过滤器
+// 规则依次为全局的排除规则、该项的排除规则以及包含规则，该项的选项覆盖全局的选项
+func newFilter(global *filterConfig, entry *filterConfig) (*filter.Filter, error) {
+	exclude := append(append([]string{}, global.exclude...), entry.exclude...)
+	include := append(append([]string{}, global.include...), entry.include...)
+	f, err := filter.New(exclude, include)
+	if err != nil {
+		return nil, err
+	}
+	f.MaxSize = global.maxSize
+	if entry.maxSize != 0 {
+		f.MaxSize = entry.maxSize
+	}
+	f.SkipNewer = global.skipNewer
+	if entry.skipNewer != 0 {
+		f.SkipNewer = entry.skipNewer
+	}
+	if global.ignoreFile != nil {
+		f.IgnoreFile = *global.ignoreFile
+	}
+	if entry.ignoreFile != nil {
+		f.IgnoreFile = *entry.ignoreFile
+	}
+	return f, nil
+}
+
+// 配置中的字符串或者字符串数组
+func stringList(v interface{}) []string {
+	switch list := v.(type) {
+	case []interface{}:
+		s := make([]string, 0, len(list))
+		for _, item := range list {
+			s = append(s, fmt.Sprint(item))
+		}
+		return s
+	case []string:
+		return list
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
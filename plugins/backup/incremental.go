@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/abingzo/bups/common/archiver"
+	"github.com/abingzo/bups/common/incremental"
+	"github.com/abingzo/bups/common/plugin"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.backup.incremental
+	开启之后file_path中的每一项在上一次备份的清单的基础上只归档变化的文件
+	每full_every次备份进行一次完整备份
+*/
+
+const (
+	ScopeIncremental = "incremental"
+	// 清单存放在缓存目录下，不会被encrypt插件清理
+	manifestDir      = "manifest"
+	defaultFullEvery = 7
+)
+
+type incrementalConfig struct {
+	enable bool
+	// 两次完整备份之间最多的增量备份次数加一
+	fullEvery int
+}
+
+func (b *Backup) readIncrementalConfig() (*incrementalConfig, error) {
+	c := &incrementalConfig{fullEvery: defaultFullEvery}
+	var err error
+	b.cfg.SetPluginScope(ScopeIncremental)
+	b.cfg.RangePluginData(func(k string, v interface{}) {
+		if err != nil {
+			return
+		}
+		switch k {
+		case "enable":
+			enable, ok := v.(bool)
+			if !ok {
+				err = fmt.Errorf("backup: incremental enable %v is not a bool", v)
+				return
+			}
+			c.enable = enable
+		case "full_every":
+			n, ok := v.(int64)
+			if !ok || n < 1 {
+				err = fmt.Errorf("backup: incremental full_every %v must be a positive number", v)
+				return
+			}
+			c.fullEvery = int(n)
+		default:
+			err = fmt.Errorf("backup: unknown incremental option %s", k)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (b *Backup) manifestPath(key string) string {
+	return filepath.Join(b.cacheDir, manifestDir, key+".json")
+}
+
+// 创建file_path中一项的增量备份跟踪器，达到完整备份的周期或者参数指定--full时进行完整备份
+func (b *Backup) newTracker(run *plugin.Run, c *incrementalConfig, key string, src string, inner archiver.Filter) (*incremental.Tracker, error) {
+	prev, err := incremental.ReadManifest(b.manifestPath(key))
+	if err != nil {
+		return nil, err
+	}
+	full := b.forceFull || (prev != nil && prev.Sequence+1 >= c.fullEvery)
+	chain := time.Now().Format("20060102150405")
+	if run != nil {
+		chain = run.ID
+	}
+	t := incremental.NewTracker(prev, src, full, chain)
+	t.Inner = inner
+	return t, nil
+}
+
+// 将备份信息写入归档的根目录
+func (b *Backup) addIncrementInfo(w *archiver.Writer, key string, info *incremental.Info) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(b.cacheDir, key+incremental.InfoName)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return w.AddFile(incremental.InfoName, tmp)
+}
+
+// 保存新的清单，在流水线中运行时只有整个运行成功(比如上传成功)之后才保存
+// 否则下一次的增量备份会基于一个没有被上传的归档
+func (b *Backup) commitManifest(run *plugin.Run, key string, m *incremental.Manifest) error {
+	path := b.manifestPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if run == nil {
+		return m.WriteFile(path)
+	}
+	run.OnEnd(func(run *plugin.Run) {
+		if run.Err() != nil {
+			b.errorLog.ErrorFromString(fmt.Sprintf("%s failed, manifest of %s is not updated", run, key))
+			return
+		}
+		if err := m.WriteFile(path); err != nil {
+			b.errorLog.ErrorFromString(fmt.Sprintf("write manifest of %s: %s", key, err))
+		}
+	})
+	return nil
+}
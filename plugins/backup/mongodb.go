@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.backup.database
+	driver = "mongodb"时使用mongodump将数据库转储为archive文件，gzip为true时压缩
+	databases为空时转储全部的数据库到一个文件，否则每一个数据库转储为一个文件
+	连接可以使用uri，或者host、port、user、auth_database，password和uri通过临时的--config文件传递，不会出现在命令行中
+*/
+
+type mongodbDriver struct{}
+
+func (mongodbDriver) Dump(target *Target, dir string) ([]*Dump, error) {
+	args, cleanup, err := mongodbConnArgs(target, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	ext := ".archive"
+	gzip := target.Bool("gzip", false)
+	if gzip {
+		args = append(args, "--gzip")
+		ext += ".gz"
+	}
+	databases := target.Strings("databases")
+	if len(databases) == 0 {
+		// 空的名字表示全部的数据库
+		databases = []string{""}
+	}
+	dumps := make([]*Dump, 0, len(databases))
+	for _, db := range databases {
+		name := target.File
+		dbArgs := args
+		if db != "" {
+			name += "-" + db
+			dbArgs = append(dbArgs[:len(dbArgs):len(dbArgs)], "--db="+db)
+		}
+		dstFile := filepath.Join(dir, name+ext)
+		start := time.Now()
+		if err := runDump(exec.Command("mongodump", append(dbArgs, "--archive="+dstFile)...), ""); err != nil {
+			return nil, err
+		}
+		dump := &Dump{
+			Path:     dstFile,
+			Meta:     map[string]string{"format": "archive", "gzip": strconv.FormatBool(gzip)},
+			Duration: time.Since(start),
+		}
+		if db != "" {
+			dump.Databases = []string{db}
+		}
+		dumps = append(dumps, dump)
+	}
+	return dumps, nil
+}
+
+// 连接参数，需要保密的选项写入dir中的临时配置文件，cleanup删除该文件
+func mongodbConnArgs(target *Target, dir string) ([]string, func(), error) {
+	args := make([]string, 0, 8)
+	cleanup := func() {}
+	if v := target.String("host"); v != "" {
+		args = append(args, "--host="+v)
+	}
+	if v := target.String("port"); v != "" {
+		args = append(args, "--port="+v)
+	}
+	if v := target.String("user"); v != "" {
+		args = append(args, "--username="+v)
+	}
+	if v := target.String("auth_database"); v != "" {
+		args = append(args, "--authenticationDatabase="+v)
+	}
+	secrets := ""
+	// uri中通常包含口令
+	if v := target.String("uri"); v != "" {
+		secrets += "uri: " + strconv.Quote(v) + "\n"
+	}
+	if v := target.String("password"); v != "" {
+		secrets += "password: " + strconv.Quote(v) + "\n"
+	}
+	if secrets == "" {
+		return args, cleanup, nil
+	}
+	file, err := ioutil.TempFile(dir, ".mongodump-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() { _ = os.Remove(file.Name()) }
+	_, err = file.WriteString(secrets)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("backup: write mongodump config: %w", err)
+	}
+	return append(args, "--config="+file.Name()), cleanup, nil
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	password写入临时的选项文件，通过--defaults-extra-file传递给mysqldump，口令不会出现在命令行中
+	没有配置的host、port和user不传递，使用mysqldump自身的默认值
+*/
+
+// 数据库备份的参数
+var mysqlDumpArgs = []string{
+	"--host",
+	"--port",
+	"--user",
+	"--databases",
+	"--lock-tables",
+}
+
+// 使用mysqldump将所有数据库转储到同一个sql文件
+type mysqlDriver struct{}
+
+func (mysqlDriver) Dump(target *Target, dir string) ([]*Dump, error) {
+	databases := target.Strings("databases")
+	if len(databases) == 0 {
+		return nil, fmt.Errorf("backup: %s has no databases", target.Name)
+	}
+	defaults, cleanup, err := mysqlDefaultsFile(target, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	dstFile := filepath.Join(dir, target.File+".sql")
+	start := time.Now()
+	cmd := exec.Command("mysqldump", encodeMysqldumpArguments(target, defaults)...)
+	if err := runDump(cmd, dstFile); err != nil {
+		return nil, err
+	}
+	return []*Dump{{
+		Path:      dstFile,
+		Databases: databases,
+		Meta:      map[string]string{"format": "sql"},
+		Duration:  time.Since(start),
+	}}, nil
+}
+
+// 编码参数，defaults不为空时作为第一个参数，mysqldump要求--defaults-extra-file在最前面
+func encodeMysqldumpArguments(target *Target, defaults string) []string {
+	args := make([]string, 0, 10)
+	if defaults != "" {
+		args = append(args, "--defaults-extra-file="+defaults)
+	}
+	for _, v := range mysqlDumpArgs {
+		switch v {
+		case "--host", "--port", "--user":
+			if value := target.String(v[2:]); value != "" {
+				args = append(args, fmt.Sprintf("%s=%s", v, value))
+			}
+		case "--databases":
+			args = append(args, v)
+			args = append(args, target.Strings(v[2:])...)
+		default:
+			args = append(args, v)
+		}
+	}
+	return args
+}
+
+// 配置了password时将其写入dir中的临时选项文件，cleanup删除该文件
+func mysqlDefaultsFile(target *Target, dir string) (string, func(), error) {
+	password := target.String("password")
+	if password == "" {
+		return "", func() {}, nil
+	}
+	// 文件由TempFile以0600创建
+	file, err := ioutil.TempFile(dir, ".my-*.cnf")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.Remove(file.Name()) }
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(password)
+	_, err = fmt.Fprintf(file, "[client]\npassword=\"%s\"\n", escaped)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return file.Name(), cleanup, nil
+}
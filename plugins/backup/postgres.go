@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.backup.database
+	driver = "postgres"时使用pg_dump逐个转储databases中的数据库，
+	format为custom(默认)或plain，globals为true(默认)时使用pg_dumpall --globals-only转储角色和表空间
+	password通过临时的PGPASSFILE传递给子进程，也可以使用passfile指定已有的口令文件，口令不会出现在命令行中
+*/
+
+const (
+	PostgresFormatCustom = "custom"
+	PostgresFormatPlain  = "plain"
+)
+
+type postgresDriver struct{}
+
+func (postgresDriver) Dump(target *Target, dir string) ([]*Dump, error) {
+	databases := target.Strings("databases")
+	if len(databases) == 0 {
+		return nil, fmt.Errorf("backup: %s has no databases", target.Name)
+	}
+	format := target.String("format")
+	if format == "" {
+		format = PostgresFormatCustom
+	}
+	ext := ".dump"
+	switch format {
+	case PostgresFormatCustom:
+	case PostgresFormatPlain:
+		ext = ".sql"
+	default:
+		return nil, fmt.Errorf("backup: not support postgres format %s", format)
+	}
+	env, cleanup, err := postgresEnv(target, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	dumps := make([]*Dump, 0, len(databases)+1)
+	for _, db := range databases {
+		dstFile := filepath.Join(dir, target.File+"-"+db+ext)
+		args := append(postgresConnArgs(target), "--format="+format, "--file="+dstFile, db)
+		start := time.Now()
+		cmd := exec.Command("pg_dump", args...)
+		cmd.Env = env
+		if err := runDump(cmd, ""); err != nil {
+			return nil, err
+		}
+		dumps = append(dumps, &Dump{
+			Path:      dstFile,
+			Databases: []string{db},
+			Meta:      map[string]string{"format": format},
+			Duration:  time.Since(start),
+		})
+	}
+	if target.Bool("globals", true) {
+		dstFile := filepath.Join(dir, target.File+"-globals.sql")
+		args := append(postgresConnArgs(target), "--globals-only", "--file="+dstFile)
+		start := time.Now()
+		cmd := exec.Command("pg_dumpall", args...)
+		cmd.Env = env
+		if err := runDump(cmd, ""); err != nil {
+			return nil, err
+		}
+		dumps = append(dumps, &Dump{
+			Path:     dstFile,
+			Meta:     map[string]string{"format": PostgresFormatPlain, "globals": "true"},
+			Duration: time.Since(start),
+		})
+	}
+	return dumps, nil
+}
+
+// 连接参数，--no-password使得缺少口令时直接失败而不是等待输入
+func postgresConnArgs(target *Target) []string {
+	args := make([]string, 0, 8)
+	if v := target.String("host"); v != "" {
+		args = append(args, "--host="+v)
+	}
+	if v := target.String("port"); v != "" {
+		args = append(args, "--port="+v)
+	}
+	if v := target.String("user"); v != "" {
+		args = append(args, "--username="+v)
+	}
+	return append(args, "--no-password")
+}
+
+// 子进程的环境变量，配置了password时写入dir中的临时口令文件，cleanup删除该文件
+func postgresEnv(target *Target, dir string) ([]string, func(), error) {
+	env := os.Environ()
+	cleanup := func() {}
+	if v := target.String("sslmode"); v != "" {
+		env = append(env, "PGSSLMODE="+v)
+	}
+	if v := target.String("passfile"); v != "" {
+		env = append(env, "PGPASSFILE="+v)
+	}
+	password := target.String("password")
+	if password == "" {
+		return env, cleanup, nil
+	}
+	file, err := ioutil.TempFile(dir, ".pgpass-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() { _ = os.Remove(file.Name()) }
+	// 文件由TempFile以0600创建，libpq拒绝权限更宽的口令文件
+	_, err = fmt.Fprintf(file, "%s:%s:*:%s:%s\n", pgpassField(target.String("host")),
+		pgpassField(target.String("port")), pgpassField(target.String("user")), pgpassEscape(password))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return append(env, "PGPASSFILE="+file.Name()), cleanup, nil
+}
+
+// 口令文件中的字段，没有配置时匹配任意值
+func pgpassField(v string) string {
+	if v == "" {
+		return "*"
+	}
+	return pgpassEscape(v)
+}
+
+func pgpassEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, ":", `\:`).Replace(v)
+}
@@ -0,0 +1,212 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.backup.database
+	driver = "redis"时使用redis-cli执行BGSAVE，等待保存完成之后复制RDB文件，只能备份本机的redis
+	rdb为RDB文件的路径，没有配置时通过CONFIG GET dir和dbfilename获得
+	timeout为等待保存完成的秒数，默认为600，password通过REDISCLI_AUTH传递
+*/
+
+// 查询保存状态的间隔
+var redisPollInterval = 200 * time.Millisecond
+
+const redisDefaultTimeout = 600
+
+type redisDriver struct{}
+
+func (redisDriver) Dump(target *Target, dir string) ([]*Dump, error) {
+	cli := newRedisCli(target)
+	timeout := time.Duration(redisDefaultTimeout) * time.Second
+	if v := target.String("timeout"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("backup: invalid redis timeout %s", v)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	rdb := target.String("rdb")
+	if rdb == "" {
+		rdbDir, err := cli.configGet("dir")
+		if err != nil {
+			return nil, err
+		}
+		rdbFile, err := cli.configGet("dbfilename")
+		if err != nil {
+			return nil, err
+		}
+		rdb = filepath.Join(rdbDir, rdbFile)
+	}
+	start := time.Now()
+	if err := cli.bgsave(timeout); err != nil {
+		return nil, err
+	}
+	dstFile := filepath.Join(dir, target.File+".rdb")
+	if err := copyFile(rdb, dstFile); err != nil {
+		return nil, err
+	}
+	return []*Dump{{
+		Path:     dstFile,
+		Meta:     map[string]string{"format": "rdb"},
+		Duration: time.Since(start),
+	}}, nil
+}
+
+type redisCli struct {
+	args []string
+	env  []string
+}
+
+func newRedisCli(target *Target) *redisCli {
+	c := &redisCli{args: make([]string, 0, 8), env: os.Environ()}
+	if v := target.String("host"); v != "" {
+		c.args = append(c.args, "-h", v)
+	}
+	if v := target.String("port"); v != "" {
+		c.args = append(c.args, "-p", v)
+	}
+	if v := target.String("user"); v != "" {
+		c.args = append(c.args, "--user", v)
+	}
+	if v := target.String("password"); v != "" {
+		c.env = append(c.env, "REDISCLI_AUTH="+v)
+	}
+	return c
+}
+
+// 执行一条命令，返回去掉空白的输出，redis返回错误时redis-cli的退出码不一定为非0
+func (c *redisCli) do(args ...string) (string, error) {
+	cmd := exec.Command("redis-cli", append(c.args[:len(c.args):len(c.args)], args...)...)
+	cmd.Env = c.env
+	out, err := runOutput(cmd)
+	out = strings.TrimSpace(out)
+	if err != nil {
+		return "", err
+	}
+	for _, prefix := range []string{"ERR", "NOAUTH", "WRONGPASS", "NOPERM", "(error)"} {
+		if strings.HasPrefix(out, prefix) {
+			return "", fmt.Errorf("redis-cli %s: %s", args[0], out)
+		}
+	}
+	return out, nil
+}
+
+func (c *redisCli) configGet(name string) (string, error) {
+	out, err := c.do("CONFIG", "GET", name)
+	if err != nil {
+		return "", err
+	}
+	// 输出为名字和值两行
+	lines := strings.Split(out, "\n")
+	if len(lines) != 2 {
+		return "", fmt.Errorf("backup: unexpected redis CONFIG GET %s output: %s", name, out)
+	}
+	return strings.TrimSpace(lines[1]), nil
+}
+
+// 执行BGSAVE并等待LASTSAVE变化，已经在保存时等待其完成之后再保存一次
+func (c *redisCli) bgsave(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	wait := func() error {
+		if time.Now().After(deadline) {
+			return errors.New("backup: timeout waiting for redis BGSAVE")
+		}
+		time.Sleep(redisPollInterval)
+		return nil
+	}
+	last, err := c.lastSave()
+	if err != nil {
+		return err
+	}
+	// LASTSAVE的精度为秒，同一秒内的两次保存无法区分
+	if last >= time.Now().Unix() {
+		time.Sleep(time.Second)
+	}
+	for {
+		_, err := c.do("BGSAVE")
+		if err == nil {
+			break
+		}
+		if !strings.Contains(err.Error(), "in progress") {
+			return err
+		}
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+	for {
+		now, err := c.lastSave()
+		if err != nil {
+			return err
+		}
+		if now > last {
+			return nil
+		}
+		info, err := c.persistence()
+		if err != nil {
+			return err
+		}
+		// 保存可能在第一次查询之前就已经失败，没有正在进行的保存时直接检查上一次保存的结果
+		if info["rdb_bgsave_in_progress"] != "1" && info["rdb_last_bgsave_status"] != "ok" {
+			return errors.New("backup: redis BGSAVE failed, see the redis log")
+		}
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *redisCli) lastSave() (int64, error) {
+	out, err := c.do("LASTSAVE")
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(strings.TrimPrefix(out, "(integer) "), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("backup: unexpected redis LASTSAVE output: %s", out)
+	}
+	return v, nil
+}
+
+// INFO persistence中的字段
+func (c *redisCli) persistence() (map[string]string, error) {
+	out, err := c.do("INFO", "persistence")
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), ":"); ok {
+			info[k] = v
+		}
+	}
+	return info, nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
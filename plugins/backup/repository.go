@@ -0,0 +1,204 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/crypt"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/repo"
+	"github.com/abingzo/bups/common/storage"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.backup.repository
+	开启之后文件和数据库转储按内容切分为块写入去重的仓库，每一次备份写入一个快照
+	仓库可以放在本地目录或者plugin.upload.cos配置的存储桶中
+*/
+
+const (
+	ScopeRepository = "repository"
+	BackendLocal    = "local"
+	BackendCos      = "cos"
+	// 存储桶中仓库的默认目录
+	defaultRepoPrefix = "repo"
+)
+
+type repositoryConfig struct {
+	enable  bool
+	backend string
+	// 本地目录或者存储桶中的目录
+	path     string
+	password []byte
+	kdf      string
+}
+
+func (b *Backup) readRepositoryConfig() (*repositoryConfig, error) {
+	c := &repositoryConfig{backend: BackendLocal}
+	var err error
+	var passwordFile string
+	b.cfg.SetPluginScope(ScopeRepository)
+	b.cfg.RangePluginData(func(k string, v interface{}) {
+		if err != nil {
+			return
+		}
+		switch k {
+		case "enable":
+			enable, ok := v.(bool)
+			if !ok {
+				err = fmt.Errorf("backup: repository enable %v is not a bool", v)
+				return
+			}
+			c.enable = enable
+		case "backend":
+			c.backend = fmt.Sprint(v)
+		case "path":
+			c.path = fmt.Sprint(v)
+		case "password":
+			c.password = []byte(fmt.Sprint(v))
+		case "password_file":
+			passwordFile = fmt.Sprint(v)
+		case "kdf":
+			c.kdf = fmt.Sprint(v)
+		default:
+			err = fmt.Errorf("backup: unknown repository option %s", k)
+		}
+	})
+	if err != nil || !c.enable {
+		return c, err
+	}
+	if passwordFile != "" {
+		if c.password, err = crypt.ReadKeyFile(passwordFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.password) == 0 {
+		return nil, errors.New("backup: repository requires password or password_file")
+	}
+	switch c.backend {
+	case BackendLocal:
+		if c.path == "" {
+			return nil, errors.New("backup: local repository requires path")
+		}
+	case BackendCos:
+		if c.path == "" {
+			c.path = defaultRepoPrefix
+		}
+	default:
+		return nil, fmt.Errorf("backup: not support repository backend %s", c.backend)
+	}
+	return c, nil
+}
+
+// 打开配置的仓库，不存在时创建
+func (b *Backup) openRepository(c *repositoryConfig) (*repo.Repository, error) {
+	var backend repo.Backend
+	if c.backend == BackendCos {
+		backend = storage.NewCosBackend(storage.NewCos(b.cfg), c.path)
+	} else {
+		backend = &repo.Local{Dir: c.path}
+	}
+	return repo.OpenOrInit(backend, c.password, c.kdf)
+}
+
+// 创建本次备份的快照
+func (b *Backup) newSnapshot(run *plugin.Run, r *repo.Repository) (*repo.SnapshotWriter, error) {
+	id := time.Now().Format("20060102150405")
+	if run != nil {
+		id = run.ID
+	}
+	w, err := r.NewSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	w.Snapshot.Host, _ = os.Hostname()
+	if run != nil {
+		w.Snapshot.Job = run.Job
+		w.Snapshot.Version = run.Version
+	}
+	w.OnSkip = func(path string, info os.FileInfo) {
+		b.errorLog.ErrorFromString(fmt.Sprintf("skip special file %s (%s)", path, info.Mode().Type()))
+	}
+	return w, nil
+}
+
+// 保存快照并登记为远端的产物
+func (b *Backup) commitSnapshot(run *plugin.Run, r *repo.Repository, w *repo.SnapshotWriter) error {
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	stats := r.Stats()
+	b.accessLog.Info(fmt.Sprintf("snapshot %s saved: %d files %d bytes, %d of %d chunks are new, stored %d bytes",
+		w.Snapshot.ID, w.Snapshot.Files(), w.Snapshot.Size, stats.NewChunks, stats.Chunks, stats.Stored))
+	if run != nil {
+		run.AddArtifact(plugin.Artifact{
+			Path:   "snapshots/" + w.Snapshot.ID,
+			Kind:   plugin.KindRemote,
+			Size:   stats.Stored,
+			Plugin: Name,
+			Meta:   map[string]string{"snapshot": w.Snapshot.ID, "size": fmt.Sprint(w.Snapshot.Size)},
+		})
+	}
+	return nil
+}
+
+// 参数启动时对仓库的操作，没有指定操作时返回false
+func (b *Backup) execRepository(snapshots bool, restore string, target string, forget string, gc bool, force bool) (bool, error) {
+	if !snapshots && restore == "" && forget == "" && !gc {
+		return false, nil
+	}
+	c, err := b.readRepositoryConfig()
+	if err != nil {
+		return true, err
+	}
+	if !c.enable {
+		return true, errors.New("backup: repository is not enabled")
+	}
+	r, err := b.openRepository(c)
+	if err != nil {
+		return true, err
+	}
+	switch {
+	case snapshots:
+		list, err := r.ListSnapshots()
+		if err != nil {
+			return true, err
+		}
+		return true, printSnapshots(os.Stdout, list)
+	case restore != "":
+		s, err := r.LoadSnapshot(restore)
+		if err != nil {
+			return true, err
+		}
+		if err := r.Restore(s, target); err != nil {
+			return true, err
+		}
+		b.accessLog.Info(fmt.Sprintf("restore snapshot %s to %s complete", s.ID, target))
+	case forget != "":
+		if err := r.DeleteSnapshot(forget); err != nil {
+			return true, err
+		}
+		b.accessLog.Info("forget snapshot " + forget)
+	case gc:
+		removed, err := r.GC(force)
+		if err != nil {
+			return true, err
+		}
+		b.accessLog.Info(fmt.Sprintf("gc removed %d chunks", removed))
+	}
+	return true, nil
+}
+
+func printSnapshots(w io.Writer, list []*repo.Snapshot) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tJOB\tHOST\tFILES\tSIZE\tPATHS")
+	for _, s := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", s.ID, s.Time.Format("2006-01-02 15:04:05"),
+			s.Job, s.Host, s.Files(), s.Size, strings.Join(s.Paths, ","))
+	}
+	return tw.Flush()
+}
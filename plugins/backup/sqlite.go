@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.backup.database
+	driver = "sqlite"时databases为数据库文件的路径，使用sqlite3命令行工具以只读方式打开数据库，
+	method为backup(默认，在线备份接口)或vacuum(VACUUM INTO，同时整理碎片)，得到的副本与写入中的事务一致
+	副本需要通过PRAGMA integrity_check才会被收集
+*/
+
+const (
+	SqliteMethodBackup = "backup"
+	SqliteMethodVacuum = "vacuum"
+	// 数据库被锁定时等待的毫秒数
+	sqliteBusyTimeout = "10000"
+)
+
+type sqliteDriver struct{}
+
+func (sqliteDriver) Dump(target *Target, dir string) ([]*Dump, error) {
+	databases := target.Strings("databases")
+	if len(databases) == 0 {
+		return nil, fmt.Errorf("backup: %s has no databases", target.Name)
+	}
+	method := target.String("method")
+	if method == "" {
+		method = SqliteMethodBackup
+	}
+	if method != SqliteMethodBackup && method != SqliteMethodVacuum {
+		return nil, fmt.Errorf("backup: not support sqlite method %s", method)
+	}
+	dumps := make([]*Dump, 0, len(databases))
+	names := make(map[string]string, len(databases))
+	for _, db := range databases {
+		// 不存在的文件会被sqlite3创建为空的数据库
+		if _, err := os.Stat(db); err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(db), filepath.Ext(db))
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("backup: sqlite databases %s and %s have the same name", other, db)
+		}
+		names[name] = db
+		dstFile := filepath.Join(dir, target.File+"-"+name+".db")
+		// 副本已经存在时.backup会覆盖，VACUUM INTO会失败
+		if err := os.Remove(dstFile); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		var sql string
+		if method == SqliteMethodVacuum {
+			sql = "VACUUM INTO '" + strings.ReplaceAll(dstFile, "'", "''") + "'"
+		} else {
+			sql = `.backup "` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(dstFile) + `"`
+		}
+		start := time.Now()
+		cmd := exec.Command("sqlite3", "-readonly", "-bail", "-cmd", ".timeout "+sqliteBusyTimeout, db, sql)
+		if err := runDump(cmd, ""); err != nil {
+			return nil, err
+		}
+		if err := sqliteIntegrityCheck(dstFile); err != nil {
+			return nil, fmt.Errorf("backup: copy of %s: %w", db, err)
+		}
+		dumps = append(dumps, &Dump{
+			Path:      dstFile,
+			Databases: []string{db},
+			Meta:      map[string]string{"format": "sqlite", "method": method, "integrity": "ok"},
+			Duration:  time.Since(start),
+		})
+	}
+	return dumps, nil
+}
+
+// 检查数据库文件的完整性，检查不通过时返回sqlite给出的问题
+func sqliteIntegrityCheck(path string) error {
+	result, err := runOutput(exec.Command("sqlite3", "-readonly", path, "PRAGMA integrity_check"))
+	if err != nil {
+		return err
+	}
+	if result = strings.TrimSpace(result); result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	return nil
+}
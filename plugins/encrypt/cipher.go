@@ -0,0 +1,316 @@
+package encrypt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/crypt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.encrypt.cipher 和 plugin.encrypt.keyring
+	没有配置任何密钥时只归档不加密
+	密钥环中的每一个密钥都有标识、创建日期和状态，加密总是使用唯一的active密钥
+	decrypt-only的密钥只用于解密旧的归档，解密时按照文件头中的标识选择密钥
+	cipher中直接配置的口令或者接收者等同于密钥环中以key_id为标识的一个密钥
+*/
+
+const (
+	ScopeCipher  = "cipher"
+	ScopeKeyring = "keyring"
+	// 加密后的归档的扩展名
+	EncryptedExt = ".enc"
+)
+
+// 密钥的状态
+const (
+	KeyActive      = "active"
+	KeyDecryptOnly = "decrypt-only"
+)
+
+// Key 密钥环中的一个密钥，使用口令或者公钥
+type Key struct {
+	ID      string
+	Created time.Time
+	Status  string
+	// 口令，支持$ENV:，或者由key_file读取
+	Passphrase []byte
+	// 公钥加密的接收者，与口令不能同时使用
+	Recipients []*crypt.Recipient
+	// 解密使用的私钥文件，只在离线解密时配置
+	IdentityFile string
+	// 由份额还原的私钥
+	Identities []*crypt.Identity
+}
+
+// Cipher 加密归档的选项
+type Cipher struct {
+	Keys []*Key
+	// 覆盖所有密钥的私钥文件，由参数--identity指定
+	IdentityFile string
+	KDF          string
+	ChunkSize    int
+}
+
+// ReadCipher 从配置中读取加密的选项和密钥环
+func ReadCipher(cfg *config.AutoGenerated) (*Cipher, error) {
+	c := &Cipher{KDF: crypt.KDFArgon2id}
+	if cfg == nil {
+		return c, nil
+	}
+	cfg.SetPluginName(Name)
+	cfg.SetPluginScope(ScopeCipher)
+	// cipher中直接配置的密钥
+	data := make(map[string]interface{})
+	cfg.RangePluginData(func(k string, v interface{}) {
+		data[k] = v
+	})
+	legacy, err := readKey(data["key_id"], data)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := data["kdf"]; ok {
+		c.KDF = fmt.Sprint(v)
+	}
+	if v, ok := data["chunk_size"]; ok {
+		if c.ChunkSize, err = strconv.Atoi(fmt.Sprint(v)); err != nil {
+			return nil, err
+		}
+	}
+	if legacy.Passphrase != nil || legacy.Recipients != nil || legacy.IdentityFile != "" {
+		if legacy.Passphrase == nil && legacy.Recipients == nil {
+			legacy.Status = KeyDecryptOnly
+		}
+		c.Keys = append(c.Keys, legacy)
+	}
+	// 密钥环，按照标识排序保证顺序稳定
+	cfg.SetPluginScope(ScopeKeyring)
+	ids := make([]string, 0)
+	keyring := make(map[string]map[string]interface{})
+	cfg.RangePluginData(func(k string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok {
+			ids = append(ids, k)
+			keyring[k] = m
+		}
+	})
+	sort.Strings(ids)
+	for _, id := range ids {
+		key, err := readKey(id, keyring[id])
+		if err != nil {
+			return nil, err
+		}
+		c.Keys = append(c.Keys, key)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 读取一个密钥的配置，id为nil时使用default
+func readKey(id interface{}, data map[string]interface{}) (*Key, error) {
+	k := &Key{ID: "default", Status: KeyActive}
+	if id != nil {
+		k.ID = fmt.Sprint(id)
+	}
+	var err error
+	for name, v := range data {
+		switch name {
+		case "passphrase":
+			k.Passphrase = []byte(fmt.Sprint(v))
+		case "key_file":
+			if k.Passphrase, err = crypt.ReadKeyFile(fmt.Sprint(v)); err != nil {
+				return nil, err
+			}
+		case "recipients":
+			list, ok := v.([]interface{})
+			if !ok {
+				list = []interface{}{v}
+			}
+			for _, r := range list {
+				recipient, err := crypt.ParseRecipient(fmt.Sprint(r))
+				if err != nil {
+					return nil, err
+				}
+				k.Recipients = append(k.Recipients, recipient)
+			}
+		case "identity_file":
+			k.IdentityFile = fmt.Sprint(v)
+		case "status":
+			k.Status = fmt.Sprint(v)
+		case "created":
+			if k.Created, err = parseCreated(v); err != nil {
+				return nil, fmt.Errorf("encrypt: key %s: %w", k.ID, err)
+			}
+		}
+	}
+	if len(k.Passphrase) != 0 && len(k.Recipients) != 0 {
+		return nil, fmt.Errorf("encrypt: key %s: passphrase and recipients can not be used together", k.ID)
+	}
+	return k, nil
+}
+
+// 创建日期支持TOML的日期和字符串
+func parseCreated(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		for _, layout := range []string{"2006-01-02", time.RFC3339} {
+			if res, err := time.Parse(layout, t); err == nil {
+				return res, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid created date %v", v)
+}
+
+func (c *Cipher) validate() error {
+	ids := make(map[string]struct{}, len(c.Keys))
+	active := 0
+	for _, k := range c.Keys {
+		if _, ok := ids[k.ID]; ok {
+			return fmt.Errorf("encrypt: duplicate key %s", k.ID)
+		}
+		ids[k.ID] = struct{}{}
+		switch k.Status {
+		case KeyActive:
+			if len(k.Passphrase) == 0 && len(k.Recipients) == 0 {
+				return fmt.Errorf("encrypt: active key %s has no passphrase or recipients", k.ID)
+			}
+			active++
+		case KeyDecryptOnly:
+		default:
+			return fmt.Errorf("encrypt: key %s has unknown status %s", k.ID, k.Status)
+		}
+	}
+	if active > 1 {
+		return errors.New("encrypt: only one key can be active")
+	}
+	return nil
+}
+
+// Enabled 是否需要加密归档
+func (c *Cipher) Enabled() bool {
+	return c.Active() != nil
+}
+
+// Active 加密使用的密钥，没有时返回nil
+func (c *Cipher) Active() *Key {
+	for _, k := range c.Keys {
+		if k.Status == KeyActive {
+			return k
+		}
+	}
+	return nil
+}
+
+// Lookup 按照标识查找密钥
+func (c *Cipher) Lookup(id string) *Key {
+	for _, k := range c.Keys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// Encrypt 使用启用的密钥加密，并在文件头中记录密钥的标识
+func (c *Cipher) Encrypt(dst io.Writer, src io.Reader) error {
+	w, err := c.NewWriter(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// NewWriter 返回使用启用的密钥加密的写入器，写入的数据被加密之后写入dst
+func (c *Cipher) NewWriter(dst io.Writer) (io.WriteCloser, error) {
+	k := c.Active()
+	if k == nil {
+		return nil, errors.New("encrypt: no active key")
+	}
+	if len(k.Recipients) != 0 {
+		return crypt.NewRecipientsWriter(dst, k.Recipients, k.ID, c.ChunkSize)
+	}
+	return crypt.NewPassphraseWriter(dst, k.Passphrase, k.ID, c.KDF, c.ChunkSize)
+}
+
+// EncryptFile 加密src并写入dst
+func (c *Cipher) EncryptFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := c.Encrypt(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// DecryptFile 解密src并写入dst，认证失败时删除不完整的dst
+func (c *Cipher) DecryptFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	reader, err := crypt.NewReader(in, c.key)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// 按照文件头中的标识选择密钥，公钥加密的文件使用私钥文件解密
+func (c *Cipher) key(header *crypt.Header) ([]byte, error) {
+	k := c.Lookup(header.KeyID)
+	identityFile := c.IdentityFile
+	if identityFile == "" && k != nil {
+		identityFile = k.IdentityFile
+	}
+	if len(header.Recipients) != 0 {
+		if c.IdentityFile == "" && k != nil && len(k.Identities) != 0 {
+			return crypt.IdentityKey(k.Identities...)(header)
+		}
+		if identityFile == "" {
+			return nil, errors.New("encrypt: file is encrypted to recipients of key " + header.KeyID + ", identity file is required")
+		}
+		identities, err := crypt.ReadIdentities(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		return crypt.IdentityKey(identities...)(header)
+	}
+	if k == nil {
+		return nil, errors.New("encrypt: file is encrypted with key " + header.KeyID + ", which is not in the keyring")
+	}
+	if len(k.Passphrase) == 0 {
+		return nil, errors.New("encrypt: key " + k.ID + " has no passphrase")
+	}
+	return crypt.PassphraseKey(k.Passphrase)(header)
+}
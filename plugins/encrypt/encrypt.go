@@ -1,12 +1,16 @@
 package encrypt
 
 import (
-	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/abingzo/bups/common/archiver"
 	"github.com/abingzo/bups/common/config"
 	"github.com/abingzo/bups/common/path"
 	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/storage"
 	"github.com/zbh255/bilog"
-	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,10 +22,10 @@ const (
 	Self = path.DEFAULT_PATH_BACK_UPCACHE + "/" + Name
 )
 
-var support = []uint32{plugin.SUPPORT_LOGGER, plugin.SUPPORT_CONFIG_OBJ}
+var support = []uint32{plugin.SUPPORT_LOGGER, plugin.SUPPORT_CONFIG_OBJ, plugin.SUPPORT_ARGS}
 
 func New() plugin.Plugin {
-	return &EncryptAndArchive{}
+	return plugin.WrapV2(&EncryptAndArchive{})
 }
 
 // EncryptAndArchive 加密及归档
@@ -29,31 +33,226 @@ type EncryptAndArchive struct {
 	config    *config.AutoGenerated
 	errorLog  bilog.Logger
 	accessLog bilog.Logger
+	// 存放归档文件的目录，不同的任务使用不同的目录
+	cacheDir string
 }
 
 func (e *EncryptAndArchive) SetSource(source *plugin.Source) {
+	e.config = source.Config
 	e.accessLog = source.AccessLog
 	e.errorLog = source.ErrorLog
+	e.cacheDir = source.CacheDir
+	if e.cacheDir == "" {
+		e.cacheDir = Self
+	}
 }
 
-func (e *EncryptAndArchive) Start(args []string) {
-	// 读取backup备份好的文件
-	if err := Zip(path.DEFAULT_PATH_BACK_UPCACHE+"/backup", Self+"/backup.zip"); err != nil {
-		e.errorLog.ErrorFromString(err.Error())
-		panic(err)
-	} else {
-		e.accessLog.Info("archive backup.zip successfully")
+func (e *EncryptAndArchive) Exec(run *plugin.Run, args []string) error {
+	if len(args) != 0 {
+		return e.execArgs(args)
+	}
+	if run == nil {
+		return errors.New("encrypt: no pipeline run to archive")
+	}
+	c, err := ReadCipher(e.config)
+	if err != nil {
+		return err
+	}
+	signer, err := ReadSigner(e.config)
+	if err != nil {
+		return err
+	}
+	// 归档收集阶段产生的所有文件
+	collected := run.ArtifactsByKind(plugin.KindFile, plugin.KindDatabase)
+	opts := archiver.FromConfig(e.config.Project.Archive)
+	archive := e.cacheDir + "/backup" + opts.Ext()
+	if c.Enabled() {
+		// 归档直接写入加密的写入器，明文的归档不会落盘
+		archive += EncryptedExt
+		if err := EncryptArtifacts(c, collected, archive, opts); err != nil {
+			return err
+		}
+	} else if err := ArchiveArtifacts(collected, archive, opts); err != nil {
+		return err
+	}
+	// 上传插件使用产物中的对象键，签名覆盖同一个对象键
+	object := storage.ObjectName(run, plugin.Artifact{Path: archive}, 1)
+	if _, err := run.EmitMeta(Name, plugin.KindArchive, archive, map[string]string{"object": object}); err != nil {
+		return err
+	}
+	// 签名最终的归档，上传插件将签名与归档一起上传
+	if signer.Key != nil {
+		signature, err := signer.SignArchive(run, archive, object)
+		if err != nil {
+			return err
+		}
+		if _, err := run.EmitMeta(Name, plugin.KindSignature, signature, map[string]string{"archive": archive}); err != nil {
+			return err
+		}
+	}
+	e.accessLog.Info(fmt.Sprintf("archive %s successfully", filepath.Base(archive)))
+	return nil
+}
+
+// 参数启动时解密一个归档: --decrypt backup.zip.enc --out backup.zip [--identity key.txt]
+// 或者只验证归档的签名: --verify backup.zip.enc
+// 将远端的归档重新加密到启用的密钥: --reencrypt 2022-01-01-00-00.zip.enc,blog/2022-01-02-00-00.zip.enc
+// 列出密钥环中的密钥: --keys
+// 将密钥拆分为份额: --split-key --parts 5 --threshold 3 [--key 2023-01] [--share-dir /media/usb]
+// 使用份额还原密钥并解密: --decrypt backup.zip.enc --shares a.txt,b.txt,c.txt
+// 只还原密钥并写入文件: --shares a.txt,b.txt,c.txt --out key.txt
+// 配置了信任的公钥时，签名验证失败的归档不会被解密
+// 签名记录了归档的对象键，重命名过的归档需要使用--object blog/2022-01-01-00-00.zip.enc给出原来的对象键
+func (e *EncryptAndArchive) execArgs(args []string) error {
+	flags := flag.NewFlagSet(Name, flag.ContinueOnError)
+	decrypt := flags.String("decrypt", "", "需要解密的归档")
+	verify := flags.String("verify", "", "需要验证签名的归档")
+	signature := flags.String("signature", "", "签名文件，默认为归档的路径加上.sig")
+	object := flags.String("object", "", "归档在存储中的对象键，默认为下载目录中的相对路径或者文件名")
+	out := flags.String("out", "", "解密之后的文件，默认去掉.enc扩展名")
+	identity := flags.String("identity", "", "私钥文件，覆盖配置中的identity_file")
+	reencrypt := flags.String("reencrypt", "", "需要重新加密的远端对象，以逗号分隔")
+	keys := flags.Bool("keys", false, "列出密钥环中的密钥")
+	splitKey := flags.Bool("split-key", false, "将密钥拆分为份额")
+	parts := flags.Int("parts", 5, "拆分的份额数")
+	threshold := flags.Int("threshold", 3, "还原密钥需要的份额数")
+	keyID := flags.String("key", "", "拆分的密钥，默认为启用的密钥")
+	shareDir := flags.String("share-dir", "", "存放份额文件的目录，为空时输出到标准输出")
+	shares := flags.String("shares", "", "还原密钥使用的份额文件或者份额的文本，以逗号分隔")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	signer, err := ReadSigner(e.config)
+	if err != nil {
+		return err
+	}
+	c, err := ReadCipher(e.config)
+	if err != nil {
+		return err
+	}
+	if *identity != "" {
+		c.IdentityFile = *identity
+	}
+	if *keys {
+		for _, k := range c.Keys {
+			created := "-"
+			if !k.Created.IsZero() {
+				created = k.Created.Format("2006-01-02")
+			}
+			fmt.Printf("Key:%s --> Created:%s --> Status:%s\n", k.ID, created, k.Status)
+		}
+		return nil
+	}
+	if *reencrypt != "" {
+		return e.reencrypt(c, signer, strings.Split(*reencrypt, ","))
+	}
+	if *splitKey {
+		list, err := c.SplitKey(*keyID, *parts, *threshold)
+		if err != nil {
+			return err
+		}
+		return WriteShares(os.Stdout, *shareDir, list)
+	}
+	if *shares != "" {
+		list, err := ReadShares(strings.Split(*shares, ","))
+		if err != nil {
+			return err
+		}
+		key, err := c.RecoverKey(list)
+		if err != nil {
+			return err
+		}
+		e.accessLog.Info(fmt.Sprintf("recover key %s from %d shares", key.ID, len(list)))
+		// 没有需要解密的归档时将还原的密钥写入文件
+		if *decrypt == "" {
+			if *out == "" {
+				return errors.New("encrypt: --out is required to save the recovered key")
+			}
+			secret, err := key.secret("")
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(*out, append(secret, '\n'), 0600)
+		}
+	}
+	if *verify != "" {
+		if len(signer.Trusted) == 0 {
+			return errors.New("encrypt: no trusted key configured")
+		}
+		if *object == "" {
+			*object = storage.ObjectOf(*verify)
+		}
+		sig, err := signer.Verify(*verify, *signature, *object)
+		if err != nil {
+			return err
+		}
+		e.accessLog.Info(fmt.Sprintf("verify %s successfully, object %s job %s host %s time %s version %s",
+			*verify, sig.Metadata.Object, sig.Metadata.Job, sig.Metadata.Host, sig.Metadata.Timestamp, sig.Metadata.Version))
+		return nil
+	}
+	if *decrypt == "" {
+		return errors.New("encrypt: --decrypt, --verify, --reencrypt, --keys or --split-key is required")
+	}
+	if *object == "" {
+		*object = storage.ObjectOf(*decrypt)
+	}
+	if _, err := signer.Verify(*decrypt, *signature, *object); err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(*decrypt, EncryptedExt)
+		if *out == *decrypt {
+			*out += ".dec"
+		}
+	}
+	if err := c.DecryptFile(*decrypt, *out); err != nil {
+		return err
+	}
+	e.accessLog.Info(fmt.Sprintf("decrypt %s to %s successfully", *decrypt, *out))
+	return nil
+}
+
+// 逐个重新加密远端的归档，失败时停止并返回错误
+func (e *EncryptAndArchive) reencrypt(c *Cipher, signer *Signer, names []string) error {
+	rotator := &Rotator{
+		Storage: storage.NewCos(e.config),
+		Cipher:  c,
+		Signer:  signer,
+		Dir:     e.cacheDir,
 	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		rotated, err := rotator.Rotate(name)
+		if err != nil {
+			return fmt.Errorf("reencrypt %s: %w", name, err)
+		}
+		if rotated {
+			e.accessLog.Info(fmt.Sprintf("reencrypt %s to key %s successfully", name, c.Active().ID))
+		} else {
+			e.accessLog.Info(fmt.Sprintf("%s is already encrypted with key %s", name, c.Active().ID))
+		}
+	}
+	return nil
 }
 
 func (e *EncryptAndArchive) Caller(single plugin.Single) {
 	// 清理资源
-	if err := os.Remove(Self + "/backup.zip"); err != nil {
+	// 归档的扩展名由任务的配置决定，清理所有的归档及其签名
+	files, err := filepath.Glob(e.cacheDir + "/backup.*")
+	if err != nil {
 		e.errorLog.ErrorFromString(err.Error())
 		panic(err)
-	} else {
-		e.accessLog.Info("clean sources complete")
 	}
+	for _, v := range files {
+		if err := os.Remove(v); err != nil && !os.IsNotExist(err) {
+			e.errorLog.ErrorFromString(err.Error())
+			panic(err)
+		}
+	}
+	e.accessLog.Info("clean sources complete")
 }
 
 func (e *EncryptAndArchive) GetName() string {
@@ -68,49 +267,57 @@ func (e *EncryptAndArchive) GetSupport() []uint32 {
 	return support
 }
 
-// Zip srcFile could be a single file or a directory
-// destZip必须为一个正确的文件路径，否则返回错误
-func Zip(srcFile string, destZip string) error {
-	zipfile, err := os.OpenFile(destZip, os.O_CREATE|os.O_WRONLY, 0755)
+// ArchiveArtifacts 将产物归档到同一个文件中
+// 归档内的文件名为: 产生该产物的插件名/文件名
+func ArchiveArtifacts(artifacts []plugin.Artifact, dst string, opts archiver.Options) error {
+	w, err := archiver.Create(dst, opts)
 	if err != nil {
 		return err
 	}
-	defer zipfile.Close()
-
-	archive := zip.NewWriter(zipfile)
-	defer archive.Close()
+	if err := addArtifacts(w, artifacts); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
 
-	return filepath.Walk(srcFile, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// EncryptArtifacts 将产物归档并加密写入dst，失败时删除不完整的dst
+func EncryptArtifacts(c *Cipher, artifacts []plugin.Artifact, dst string, opts archiver.Options) (err error) {
+	file, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
 		}
-
-		header, err := zip.FileInfoHeader(info)
 		if err != nil {
-			return err
-		}
-
-		header.Name = strings.TrimPrefix(path, filepath.Dir(srcFile)+"/")
-		// header.Name = path
-		if info.IsDir() {
-			header.Name += "/"
-		} else {
-			header.Method = zip.Deflate
+			os.Remove(dst)
 		}
+	}()
+	enc, err := c.NewWriter(file)
+	if err != nil {
+		return err
+	}
+	w, err := archiver.NewWriter(enc, opts)
+	if err != nil {
+		return err
+	}
+	if err := addArtifacts(w, artifacts); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
 
-		writer, err := archive.CreateHeader(header)
-		if err != nil {
+func addArtifacts(w *archiver.Writer, artifacts []plugin.Artifact) error {
+	for _, v := range artifacts {
+		if err := w.AddFile(v.Plugin+"/"+filepath.Base(v.Path), v.Path); err != nil {
 			return err
 		}
-
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			_, err = io.Copy(writer, file)
-		}
-		return err
-	})
+	}
+	return nil
 }
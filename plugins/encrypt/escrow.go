@@ -0,0 +1,135 @@
+package encrypt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/crypt"
+	"github.com/abingzo/bups/common/shamir"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	将密钥拆分为多个份额交给不同的人保管，任意门限数量的份额可以还原密钥
+	口令密钥拆分口令本身，公钥密钥拆分私钥文件中的私钥，全部过程不需要网络
+*/
+
+// 密钥的秘密，口令或者私钥的文本格式
+func (k *Key) secret(identityFile string) ([]byte, error) {
+	if len(k.Passphrase) != 0 {
+		return k.Passphrase, nil
+	}
+	if len(k.Identities) != 0 {
+		return []byte(k.Identities[0].String()), nil
+	}
+	if identityFile == "" {
+		identityFile = k.IdentityFile
+	}
+	if identityFile == "" {
+		return nil, errors.New("encrypt: key " + k.ID + " has no passphrase or identity file to split")
+	}
+	identities, err := crypt.ReadIdentities(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(identities[0].String()), nil
+}
+
+// SplitKey 将密钥拆分为n份，任意k份可以还原，id为空时拆分启用的密钥
+func (c *Cipher) SplitKey(id string, n, k int) ([]*shamir.Share, error) {
+	key := c.Active()
+	if id != "" {
+		key = c.Lookup(id)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("encrypt: key %q is not in the keyring", id)
+	}
+	secret, err := key.secret(c.IdentityFile)
+	if err != nil {
+		return nil, err
+	}
+	return shamir.Split(secret, key.ID, n, k)
+}
+
+// WriteShares 输出份额，dir为空时写入w，否则每一个份额写入dir下单独的文件
+func WriteShares(w io.Writer, dir string, shares []*shamir.Share) error {
+	for _, s := range shares {
+		text := fmt.Sprintf("# bups key %s share %d of %d, any %d shares recover the key\n%s\n",
+			s.Name, s.X, len(shares), s.Threshold, s)
+		if dir == "" {
+			if _, err := io.WriteString(w, text); err != nil {
+				return err
+			}
+			continue
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%s-share-%d.txt", s.Name, s.X))
+		if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadShares 读取份额，每一项为份额的文件或者份额的文本，文件中忽略空行和#开头的注释
+func ReadShares(items []string) ([]*shamir.Share, error) {
+	shares := make([]*shamir.Share, 0, len(items))
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		lines := []string{item}
+		if _, err := os.Stat(item); err == nil {
+			data, err := ioutil.ReadFile(item)
+			if err != nil {
+				return nil, err
+			}
+			lines = strings.Split(string(data), "\n")
+		}
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			s, err := shamir.ParseShare(line)
+			if err != nil {
+				return nil, err
+			}
+			shares = append(shares, s)
+		}
+	}
+	return shares, nil
+}
+
+// RecoverKey 使用份额还原密钥并加入密钥环用于解密，返回还原的密钥
+// 密钥环中已经有相同标识的密钥时替换它
+func (c *Cipher) RecoverKey(shares []*shamir.Share) (*Key, error) {
+	secret, err := shamir.Combine(shares)
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{ID: shares[0].Name, Status: KeyDecryptOnly}
+	if strings.HasPrefix(string(secret), crypt.SecretKeyPrefix) {
+		identity, err := crypt.ParseIdentity(string(secret))
+		if err != nil {
+			return nil, err
+		}
+		key.Identities = []*crypt.Identity{identity}
+	} else {
+		key.Passphrase = secret
+	}
+	for i, k := range c.Keys {
+		if k.ID == key.ID {
+			c.Keys[i] = key
+			return key, nil
+		}
+	}
+	c.Keys = append(c.Keys, key)
+	return key, nil
+}
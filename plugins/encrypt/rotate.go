@@ -0,0 +1,122 @@
+package encrypt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/crypt"
+	"github.com/abingzo/bups/common/sign"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Storage 存放远端归档的存储，storage.Cos实现了该接口
+type Storage interface {
+	Push(path string, name string) error
+	Download(name string) ([]byte, error)
+}
+
+// Rotator 将远端的归档重新加密到密钥环中启用的密钥
+type Rotator struct {
+	Storage Storage
+	Cipher  *Cipher
+	Signer  *Signer
+	// 存放下载和重新加密的临时文件的目录
+	Dir string
+}
+
+// Rotate 下载远端的归档，解密之后使用启用的密钥重新加密并覆盖原来的对象
+// 配置了签名的私钥时同时更新签名，已经使用启用的密钥加密的归档不做处理并返回false
+// 配置了信任的公钥时必须配置签名的私钥，否则重新加密的归档无法再通过验证
+func (r *Rotator) Rotate(name string) (bool, error) {
+	active := r.Cipher.Active()
+	if active == nil {
+		return false, errors.New("encrypt: no active key to rotate to")
+	}
+	if len(r.Signer.Trusted) != 0 && r.Signer.Key == nil {
+		return false, errors.New("encrypt: trusted keys are configured but no signing key_file, rotated archives could not be verified")
+	}
+	data, err := r.Storage.Download(name)
+	if err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempDir(r.Dir, "rotate")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	archive := filepath.Join(tmp, filepath.Base(name))
+	if err := ioutil.WriteFile(archive, data, 0600); err != nil {
+		return false, err
+	}
+	// 签名验证失败的归档不会被重新加密和签名，重新签名时保留原来的元数据
+	var metadata sign.Metadata
+	if len(r.Signer.Trusted) != 0 || r.Signer.Key != nil {
+		signature, err := r.Storage.Download(name + sign.Ext)
+		if err == nil {
+			err = ioutil.WriteFile(archive+sign.Ext, signature, 0600)
+		}
+		if err != nil && len(r.Signer.Trusted) != 0 {
+			return false, fmt.Errorf("encrypt: download signature of %s: %w", name, err)
+		}
+		sig, err := r.Signer.Verify(archive, "", name)
+		if err != nil {
+			return false, err
+		}
+		if sig == nil {
+			sig, _ = sign.ReadFile(archive + sign.Ext)
+		}
+		if sig != nil {
+			metadata = sig.Metadata
+		}
+	}
+	file, err := os.Open(archive)
+	if err != nil {
+		return false, err
+	}
+	header, _, err := crypt.ReadHeader(file)
+	file.Close()
+	if err != nil {
+		return false, err
+	}
+	if header.KeyID == active.ID {
+		return false, nil
+	}
+	plain := filepath.Join(tmp, "plain")
+	if err := r.Cipher.DecryptFile(archive, plain); err != nil {
+		return false, err
+	}
+	// 覆盖本地的副本，保持归档的文件名不变
+	if err := r.Cipher.EncryptFile(plain, archive); err != nil {
+		return false, err
+	}
+	if r.Signer.Key == nil {
+		if err := r.Storage.Push(archive, name); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	// 先在本地完成签名，再先上传签名后上传归档
+	// 上传归档失败时恢复原来的签名，远端不会留下不匹配的归档和签名
+	metadata.Object = name
+	signature, err := sign.Sign(r.Signer.Key, archive, metadata)
+	if err != nil {
+		return false, err
+	}
+	newSig := filepath.Join(tmp, "rotated"+sign.Ext)
+	if err := signature.WriteFile(newSig); err != nil {
+		return false, err
+	}
+	if err := r.Storage.Push(newSig, name+sign.Ext); err != nil {
+		return false, err
+	}
+	if err := r.Storage.Push(archive, name); err != nil {
+		if _, sErr := os.Stat(archive + sign.Ext); sErr == nil {
+			if rErr := r.Storage.Push(archive+sign.Ext, name+sign.Ext); rErr != nil {
+				return false, fmt.Errorf("encrypt: push %s: %w, and restore its signature: %v", name, err, rErr)
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
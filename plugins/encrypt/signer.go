@@ -0,0 +1,103 @@
+package encrypt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/sign"
+	"os"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.encrypt.sign
+	配置了key_file时为每一个归档生成分离的签名
+	配置了trusted时解密和验证归档之前必须通过签名的验证
+*/
+
+const ScopeSign = sign.ConfigScope
+
+// Signer 签名归档的选项
+type Signer struct {
+	Key *sign.PrivateKey
+	// 信任的公钥
+	Trusted []*sign.PublicKey
+}
+
+// ReadSigner 从配置中读取签名的选项
+func ReadSigner(cfg *config.AutoGenerated) (*Signer, error) {
+	s := &Signer{}
+	if cfg == nil {
+		return s, nil
+	}
+	cfg.SetPluginName(Name)
+	cfg.SetPluginScope(ScopeSign)
+	var keyFile string
+	var err error
+	cfg.RangePluginData(func(k string, v interface{}) {
+		if err != nil {
+			return
+		}
+		switch k {
+		case "key_file":
+			keyFile = fmt.Sprint(v)
+		case "trusted":
+			s.Trusted, err = sign.ParseTrusted(v)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if keyFile != "" {
+		if s.Key, err = sign.ReadPrivateKey(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// SignArchive 签名归档并将签名写入归档旁边的.sig文件，object为归档上传之后的对象键
+func (s *Signer) SignArchive(run *plugin.Run, archive string, object string) (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	signature, err := sign.Sign(s.Key, archive, sign.Metadata{
+		Object:    object,
+		Job:       run.Job,
+		Host:      host,
+		Timestamp: run.StartTime.Format(time.RFC3339),
+		Version:   run.Version,
+	})
+	if err != nil {
+		return "", err
+	}
+	path := archive + sign.Ext
+	if err := signature.WriteFile(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Verify 使用信任的公钥验证归档，没有配置信任的公钥时不验证
+// signature为空时使用归档旁边的.sig文件，object为归档在存储中的对象键
+func (s *Signer) Verify(archive string, signature string, object string) (*sign.Signature, error) {
+	if len(s.Trusted) == 0 {
+		return nil, nil
+	}
+	if signature == "" {
+		signature = archive + sign.Ext
+	}
+	sig, err := sign.ReadFile(signature)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("encrypt: trusted keys are configured but " + signature + " does not exist")
+		}
+		return nil, err
+	}
+	if err := sig.Verify(archive, object, s.Trusted); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
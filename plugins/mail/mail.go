@@ -0,0 +1,433 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/zbh255/bilog"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.mail.smtp
+	通过SMTP发送每次运行的纯文本及HTML摘要
+*/
+
+const (
+	Name      = "mail"
+	Type      = plugin.BCallBack
+	ScopeSMTP = "smtp"
+)
+
+// 与SMTP服务器建立连接的方式
+const (
+	SecurityNone     = "none"     // 明文
+	SecurityStartTLS = "starttls" // 明文连接之后升级为TLS
+	SecurityTLS      = "tls"      // 隐式TLS，通常为465端口
+)
+
+const defaultTimeout = 30 * time.Second
+
+var support = []uint32{plugin.SUPPORT_LOGGER, plugin.SUPPORT_CONFIG_OBJ}
+
+func New() plugin.Plugin {
+	return plugin.WrapV2(&Mail{})
+}
+
+// Item 摘要中的一个产物
+type Item struct {
+	Name   string
+	Source string
+	Path   string
+	Size   int64
+}
+
+// Summary 邮件中运行的摘要，也是模板的数据
+type Summary struct {
+	RunID      string
+	Job        string
+	Host       string
+	Status     string
+	StartTime  time.Time
+	Duration   time.Duration
+	Files      []Item // backup插件归档的每一个file_path配置项
+	Databases  []Item // 转储的数据库
+	Archives   []Item
+	RemoteKeys []string
+	Errors     []string
+}
+
+// NewSummary 根据运行的结果生成摘要
+func NewSummary(run *plugin.Run) *Summary {
+	host, _ := os.Hostname()
+	s := &Summary{
+		RunID:     run.ID,
+		Job:       run.Job,
+		Host:      host,
+		Status:    "success",
+		StartTime: run.StartTime,
+	}
+	end := run.EndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	s.Duration = end.Sub(run.StartTime).Round(time.Millisecond)
+	if run.Err() != nil {
+		s.Status = "failed"
+	}
+	for _, v := range run.Results() {
+		if v.Err != nil {
+			s.Errors = append(s.Errors, v.Plugin+": "+v.Err.Error())
+		}
+	}
+	for _, v := range run.Artifacts() {
+		switch v.Kind {
+		case plugin.KindFile:
+			s.Files = append(s.Files, Item{Name: v.Meta["key"], Source: v.Meta["source"], Path: v.Path, Size: v.Size})
+		case plugin.KindDatabase:
+			s.Databases = append(s.Databases, Item{Name: v.Meta["databases"], Source: v.Meta["driver"], Path: v.Path, Size: v.Size})
+		case plugin.KindArchive:
+			s.Archives = append(s.Archives, Item{Path: v.Path, Size: v.Size})
+		case plugin.KindRemote:
+			s.RemoteKeys = append(s.RemoteKeys, v.Path)
+		}
+	}
+	return s
+}
+
+// Subject 邮件的主题
+func (s *Summary) Subject() string {
+	return fmt.Sprintf("[bups] %s %s on %s", s.Job, s.Status, s.Host)
+}
+
+const textReport = `Job:      {{ .Job }}
+Run:      {{ .RunID }}
+Host:     {{ .Host }}
+Status:   {{ .Status }}
+Start:    {{ .StartTime.Format "2006-01-02 15:04:05" }}
+Duration: {{ .Duration }}
+
+Files:
+{{- range .Files }}
+  {{ .Name }}: {{ .Source }} ({{ .Size }} bytes)
+{{- else }}
+  none
+{{- end }}
+
+Databases:
+{{- range .Databases }}
+  {{ .Name }} ({{ .Source }}, {{ .Size }} bytes)
+{{- else }}
+  none
+{{- end }}
+
+Archives:
+{{- range .Archives }}
+  {{ .Path }} ({{ .Size }} bytes)
+{{- else }}
+  none
+{{- end }}
+{{- if .RemoteKeys }}
+
+Uploaded:
+{{- range .RemoteKeys }}
+  {{ . }}
+{{- end }}
+{{- end }}
+{{- if .Errors }}
+
+Errors:
+{{- range .Errors }}
+  {{ . }}
+{{- end }}
+{{- end }}
+`
+
+const htmlReport = `<html><body>
+<h3>{{ .Job }}: {{ .Status }}</h3>
+<table>
+<tr><td>Run</td><td>{{ .RunID }}</td></tr>
+<tr><td>Host</td><td>{{ .Host }}</td></tr>
+<tr><td>Start</td><td>{{ .StartTime.Format "2006-01-02 15:04:05" }}</td></tr>
+<tr><td>Duration</td><td>{{ .Duration }}</td></tr>
+</table>
+<h4>Files</h4>
+<ul>{{ range .Files }}<li>{{ .Name }}: {{ .Source }} ({{ .Size }} bytes)</li>{{ else }}<li>none</li>{{ end }}</ul>
+<h4>Databases</h4>
+<ul>{{ range .Databases }}<li>{{ .Name }} ({{ .Source }}, {{ .Size }} bytes)</li>{{ else }}<li>none</li>{{ end }}</ul>
+<h4>Archives</h4>
+<ul>{{ range .Archives }}<li>{{ .Path }} ({{ .Size }} bytes)</li>{{ else }}<li>none</li>{{ end }}</ul>
+{{- if .RemoteKeys }}
+<h4>Uploaded</h4>
+<ul>{{ range .RemoteKeys }}<li>{{ . }}</li>{{ end }}</ul>
+{{- end }}
+{{- if .Errors }}
+<h4>Errors</h4>
+<ul>{{ range .Errors }}<li>{{ . }}</li>{{ end }}</ul>
+{{- end }}
+</body></html>
+`
+
+var (
+	textTemplate = template.Must(template.New("text").Parse(textReport))
+	htmlTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(htmlReport))
+)
+
+// Message 生成multipart/alternative格式的邮件
+func Message(from string, to []string, s *Summary) ([]byte, error) {
+	text := new(bytes.Buffer)
+	if err := textTemplate.Execute(text, s); err != nil {
+		return nil, err
+	}
+	html := new(bytes.Buffer)
+	if err := htmlTemplate.Execute(html, s); err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+	header := []string{
+		"From: " + from,
+		"To: " + strings.Join(to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", s.Subject()),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + mw.Boundary(),
+	}
+	buf.WriteString(strings.Join(header, "\r\n") + "\r\n\r\n")
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write(part.body); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SMTP 发送邮件的选项
+type SMTP struct {
+	Host         string
+	Port         int
+	Username     string
+	Password     string
+	From         string
+	To           []string
+	Security     string
+	FailuresOnly bool
+	Timeout      time.Duration
+	// 只用于测试或者自签名证书的服务器
+	InsecureSkipVerify bool
+}
+
+// Send 连接服务器并发送邮件
+func (s *SMTP) Send(msg []byte) error {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	tlsConfig := &tls.Config{ServerName: s.Host, InsecureSkipVerify: s.InsecureSkipVerify}
+	dialer := &net.Dialer{Timeout: s.Timeout}
+	var conn net.Conn
+	var err error
+	if s.Security == SecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if s.Security == SecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("mail: server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(s.From); err != nil {
+		return err
+	}
+	for _, v := range s.To {
+		if err := client.Rcpt(v); err != nil {
+			return fmt.Errorf("mail: recipient %s: %w", v, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+type Mail struct {
+	cfg       *config.AutoGenerated
+	accessLog bilog.Logger
+	errorLog  bilog.Logger
+	stdLog    bilog.Logger
+}
+
+func (m *Mail) SetSource(source *plugin.Source) {
+	m.cfg = source.Config
+	m.accessLog = source.AccessLog
+	m.errorLog = source.ErrorLog
+	m.stdLog = source.StdLog
+}
+
+// ReportRun 失败的运行同样需要发送邮件
+func (m *Mail) ReportRun() bool {
+	return true
+}
+
+func (m *Mail) Exec(run *plugin.Run, args []string) error {
+	if run == nil {
+		m.errorLog.ErrorFromString("mail: no pipeline run to report")
+		return nil
+	}
+	s, err := m.smtp()
+	if err != nil {
+		return err
+	}
+	if s.FailuresOnly && run.Err() == nil {
+		return nil
+	}
+	msg, err := Message(s.From, s.To, NewSummary(run))
+	if err != nil {
+		return err
+	}
+	if err := s.Send(msg); err != nil {
+		return err
+	}
+	m.accessLog.Info(fmt.Sprintf("mail: %s reported to %s", run, strings.Join(s.To, ",")))
+	return nil
+}
+
+// 从配置中读取SMTP的选项，密码等字符串同样支持$ENV:
+func (m *Mail) smtp() (*SMTP, error) {
+	m.cfg.SetPluginName(Name)
+	m.cfg.SetPluginScope(ScopeSMTP)
+	s := &SMTP{Security: SecurityStartTLS, Timeout: defaultTimeout}
+	var err error
+	m.cfg.RangePluginData(func(k string, v interface{}) {
+		if err != nil {
+			return
+		}
+		switch k {
+		case "host":
+			s.Host = fmt.Sprint(v)
+		case "port":
+			s.Port, err = strconv.Atoi(fmt.Sprint(v))
+		case "username":
+			s.Username = fmt.Sprint(v)
+		case "password":
+			s.Password = fmt.Sprint(v)
+		case "from":
+			s.From = fmt.Sprint(v)
+		case "to":
+			switch to := v.(type) {
+			case []interface{}:
+				for _, v := range to {
+					s.To = append(s.To, fmt.Sprint(v))
+				}
+			case string:
+				s.To = append(s.To, to)
+			default:
+				err = errors.New("mail: to must be a string or an array")
+			}
+		case "security":
+			s.Security = strings.ToLower(fmt.Sprint(v))
+		case "failures_only":
+			s.FailuresOnly, _ = v.(bool)
+		case "insecure_skip_verify":
+			s.InsecureSkipVerify, _ = v.(bool)
+		case "timeout":
+			var timeout int
+			timeout, err = strconv.Atoi(fmt.Sprint(v))
+			s.Timeout = time.Duration(timeout) * time.Second
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch s.Security {
+	case SecurityNone, SecurityStartTLS, SecurityTLS:
+	default:
+		return nil, errors.New("mail: not support security " + s.Security)
+	}
+	if s.Host == "" || s.From == "" || len(s.To) == 0 {
+		return nil, errors.New("mail: host, from and to are required")
+	}
+	if s.Port == 0 {
+		s.Port = 587
+		if s.Security == SecurityTLS {
+			s.Port = 465
+		}
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = defaultTimeout
+	}
+	return s, nil
+}
+
+func (m *Mail) Caller(single plugin.Single) {
+	m.accessLog.Info(Name + ".Caller")
+}
+
+func (m *Mail) GetName() string {
+	return Name
+}
+
+func (m *Mail) GetType() plugin.Type {
+	return Type
+}
+
+func (m *Mail) GetSupport() []uint32 {
+	return support
+}
@@ -0,0 +1,354 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/zbh255/bilog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+	配置文件选项:plugin.notify.webhook
+	在每次运行结束时将运行的报告POST到配置的地址
+*/
+
+const (
+	Name          = "notify"
+	Type          = plugin.BCallBack
+	ScopeWebhook  = "webhook"
+	SignatureName = "X-Bups-Signature"
+)
+
+const (
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+)
+
+const (
+	defaultRetries       = 3
+	defaultTimeout       = 10 * time.Second
+	defaultRetryInterval = time.Second
+	defaultContentType   = "application/json"
+)
+
+var support = []uint32{plugin.SUPPORT_LOGGER, plugin.SUPPORT_CONFIG_OBJ}
+
+func New() plugin.Plugin {
+	return plugin.WrapV2(&Notify{})
+}
+
+// Report 发送给webhook的运行报告，也是模板的数据
+type Report struct {
+	RunID       string         `json:"run_id"`
+	Job         string         `json:"job"`
+	Host        string         `json:"host"`
+	Status      string         `json:"status"`
+	StartTime   time.Time      `json:"start_time"`
+	Duration    float64        `json:"duration"` // 以秒计算
+	ArchiveSize int64          `json:"archive_size"`
+	RemoteKeys  []string       `json:"remote_keys"`
+	Errors      []string       `json:"errors"`
+	Plugins     []PluginReport `json:"plugins"`
+}
+
+// PluginReport 单个插件的结果
+type PluginReport struct {
+	Plugin   string  `json:"plugin"`
+	Stage    string  `json:"stage"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// NewReport 根据运行的结果生成报告，运行还没有结束时以当前的时间计算耗时
+func NewReport(run *plugin.Run) *Report {
+	host, _ := os.Hostname()
+	report := &Report{
+		RunID:      run.ID,
+		Job:        run.Job,
+		Host:       host,
+		Status:     StatusSuccess,
+		StartTime:  run.StartTime,
+		RemoteKeys: make([]string, 0),
+		Errors:     make([]string, 0),
+		Plugins:    make([]PluginReport, 0),
+	}
+	end := run.EndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	report.Duration = end.Sub(run.StartTime).Seconds()
+	if run.Err() != nil {
+		report.Status = StatusFailed
+	}
+	for _, v := range run.Results() {
+		pr := PluginReport{
+			Plugin:   v.Plugin,
+			Stage:    v.Stage.String(),
+			Status:   StatusSuccess,
+			Duration: v.Duration.Seconds(),
+		}
+		switch {
+		case v.Skipped:
+			pr.Status = "skipped"
+		case v.Err != nil:
+			pr.Status = StatusFailed
+			pr.Error = v.Err.Error()
+			report.Errors = append(report.Errors, v.Plugin+": "+v.Err.Error())
+		}
+		report.Plugins = append(report.Plugins, pr)
+	}
+	for _, v := range run.ArtifactsByKind(plugin.KindArchive) {
+		report.ArchiveSize += v.Size
+	}
+	for _, v := range run.ArtifactsByKind(plugin.KindRemote) {
+		report.RemoteKeys = append(report.RemoteKeys, v.Path)
+	}
+	return report
+}
+
+// 模板中可以使用的函数
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join": strings.Join,
+}
+
+// Webhook 一组接收报告的地址及其发送的选项
+type Webhook struct {
+	URLs          []string
+	ContentType   string
+	Template      *template.Template
+	Secret        string
+	FailuresOnly  bool
+	Retries       int
+	RetryInterval time.Duration
+	Client        *http.Client
+}
+
+// Body 生成报告的请求体，没有配置模板时为报告的JSON
+func (w *Webhook) Body(report *Report) ([]byte, error) {
+	if w.Template == nil {
+		return json.Marshal(report)
+	}
+	buf := new(bytes.Buffer)
+	if err := w.Template.Execute(buf, report); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign 请求体的HMAC-SHA256签名
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send 将报告发送到所有的地址，返回所有发送失败的地址的错误
+func (w *Webhook) Send(report *Report) error {
+	body, err := w.Body(report)
+	if err != nil {
+		return err
+	}
+	msg := make([]string, 0)
+	for _, v := range w.URLs {
+		if err := w.post(v, body); err != nil {
+			msg = append(msg, err.Error())
+		}
+	}
+	if len(msg) > 0 {
+		return errors.New(strings.Join(msg, "; "))
+	}
+	return nil
+}
+
+// 每个地址最多尝试Retries+1次，非2xx的响应同样需要重试
+func (w *Webhook) post(url string, body []byte) error {
+	var err error
+	for i := 0; i <= w.Retries; i++ {
+		if i > 0 {
+			time.Sleep(w.RetryInterval * time.Duration(i))
+		}
+		if err = w.postOnce(url, body); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("post %s failed after %d attempts: %w", url, w.Retries+1, err)
+}
+
+func (w *Webhook) postOnce(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.ContentType)
+	req.Header.Set("User-Agent", "bups-"+Name)
+	if w.Secret != "" {
+		req.Header.Set(SignatureName, Sign(w.Secret, body))
+	}
+	res, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+type Notify struct {
+	cfg       *config.AutoGenerated
+	accessLog bilog.Logger
+	errorLog  bilog.Logger
+	stdLog    bilog.Logger
+}
+
+func (n *Notify) SetSource(source *plugin.Source) {
+	n.cfg = source.Config
+	n.accessLog = source.AccessLog
+	n.errorLog = source.ErrorLog
+	n.stdLog = source.StdLog
+}
+
+// ReportRun 失败的运行同样需要发送报告
+func (n *Notify) ReportRun() bool {
+	return true
+}
+
+func (n *Notify) Exec(run *plugin.Run, args []string) error {
+	if run == nil {
+		n.errorLog.ErrorFromString("notify: no pipeline run to report")
+		return nil
+	}
+	webhook, err := n.webhook()
+	if err != nil {
+		return err
+	}
+	if webhook.FailuresOnly && run.Err() == nil {
+		return nil
+	}
+	if err := webhook.Send(NewReport(run)); err != nil {
+		return err
+	}
+	n.accessLog.Info(fmt.Sprintf("notify: %s reported to %d webhook(s)", run, len(webhook.URLs)))
+	return nil
+}
+
+// 从配置中读取webhook的选项
+func (n *Notify) webhook() (*Webhook, error) {
+	n.cfg.SetPluginName(Name)
+	n.cfg.SetPluginScope(ScopeWebhook)
+	w := &Webhook{
+		ContentType:   defaultContentType,
+		Retries:       defaultRetries,
+		RetryInterval: defaultRetryInterval,
+	}
+	timeout := defaultTimeout
+	var tmpl, tmplFile string
+	var err error
+	n.cfg.RangePluginData(func(k string, v interface{}) {
+		if err != nil {
+			return
+		}
+		switch k {
+		case "url":
+			w.URLs = append(w.URLs, fmt.Sprint(v))
+		case "urls":
+			list, ok := v.([]interface{})
+			if !ok {
+				err = fmt.Errorf("notify: urls must be an array")
+				return
+			}
+			for _, u := range list {
+				w.URLs = append(w.URLs, fmt.Sprint(u))
+			}
+		case "content_type":
+			w.ContentType = fmt.Sprint(v)
+		case "template":
+			tmpl = fmt.Sprint(v)
+		case "template_file":
+			tmplFile = fmt.Sprint(v)
+		case "secret":
+			w.Secret = fmt.Sprint(v)
+		case "failures_only":
+			w.FailuresOnly, _ = v.(bool)
+		case "retries":
+			w.Retries = int(toInt(v))
+		case "retry_interval":
+			w.RetryInterval = time.Duration(toInt(v)) * time.Second
+		case "timeout":
+			timeout = time.Duration(toInt(v)) * time.Second
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(w.URLs) == 0 {
+		return nil, errors.New("notify: no webhook url configured")
+	}
+	if tmplFile != "" {
+		data, err := ioutil.ReadFile(tmplFile)
+		if err != nil {
+			return nil, err
+		}
+		tmpl = string(data)
+	}
+	if tmpl != "" {
+		w.Template, err = template.New(Name).Funcs(templateFuncs).Parse(tmpl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if w.Retries < 0 {
+		w.Retries = 0
+	}
+	w.Client = &http.Client{Timeout: timeout}
+	return w, nil
+}
+
+func toInt(v interface{}) int64 {
+	switch i := v.(type) {
+	case int64:
+		return i
+	case int:
+		return int64(i)
+	case float64:
+		return int64(i)
+	default:
+		return 0
+	}
+}
+
+func (n *Notify) Caller(single plugin.Single) {
+	n.accessLog.Info(Name + ".Caller")
+}
+
+func (n *Notify) GetName() string {
+	return Name
+}
+
+func (n *Notify) GetType() plugin.Type {
+	return Type
+}
+
+func (n *Notify) GetSupport() []uint32 {
+	return support
+}
@@ -1,25 +1,21 @@
 package upload
 
 import (
-	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/abingzo/bups/common/config"
-	"github.com/abingzo/bups/common/path"
 	"github.com/abingzo/bups/common/plugin"
-	"github.com/tencentyun/cos-go-sdk-v5"
+	"github.com/abingzo/bups/common/sign"
+	"github.com/abingzo/bups/common/storage"
 	"github.com/zbh255/bilog"
 	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
-	"time"
 )
 
 const (
 	Name           = "upload"
-	DownloadCached = path.DEFAULT_PATH_BACK_UPCACHE + "/download"
-	BackUpFilePath = path.DEFAULT_PATH_BACK_UPCACHE + "/encrypt/backup.zip"
+	DownloadCached = storage.DownloadDir
 	Type           = plugin.BCallBack
 )
 
@@ -30,92 +26,15 @@ var Support = []uint32{
 }
 
 func New() plugin.Plugin {
-	return &Upload{
+	return plugin.WrapV2(&Upload{
 		Name:       Name,
 		Type:       Type,
 		Support:    Support,
 		cosElement: nil,
-	}
-}
-
-func InitCosElement(u *Upload) {
-	// 初始化实例
-	u.cosElement = &CosElement{}
-	cfg := u.conf
-	cfg.SetPluginName(u.Name)
-	cfg.SetPluginScope("cos")
-	// 设置属性
-	u.cosElement.sId = cfg.PluginGetData("sId").(string)
-	u.cosElement.sKey = cfg.PluginGetData("sKey").(string)
-	u.cosElement.bucketUrl = cfg.PluginGetData("bucketUrl").(string)
-	u.cosElement.serviceUrl = cfg.PluginGetData("serviceUrl").(string)
-	// 连接服务端
-	bu, _ := url.Parse(u.cosElement.bucketUrl)
-	bsu, _ := url.Parse(u.cosElement.serviceUrl)
-	bucket := cos.BaseURL{
-		BucketURL:  bu,
-		ServiceURL: bsu,
-	}
-	client := cos.NewClient(&bucket, &http.Client{
-		Transport: &cos.AuthorizationTransport{
-			SecretID:  u.cosElement.sId,
-			SecretKey: u.cosElement.sKey,
-		},
 	})
-	u.cosElement.client = client
-}
-
-/*
-	配置文件选项:plugin.upload.cos
-	基础的上传至Cos的接口，提供上传，下载，检索
-*/
-
-type CosElement struct {
-	client     *cos.Client
-	sId        string
-	sKey       string
-	bucketUrl  string
-	serviceUrl string
-}
-
-func (c *CosElement) Push(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	// 根据备份的时间取名
-	fileName := time.Now().Format("2006-01-02-15-04") + ".zip"
-	_, err = c.client.Object.Put(context.Background(), fileName, file, nil)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (c *CosElement) Download(fileName string) ([]byte, error) {
-	res, err := c.client.Object.Get(context.Background(), fileName, nil)
-	if err != nil {
-		return nil, err
-	}
-	file, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-	return file, nil
-}
-
-func (c *CosElement) Delete(fileName string) error {
-	_, err := c.client.Object.Delete(context.Background(), fileName)
-	if err != nil {
-		return err
-	}
-	return nil
 }
 
-func (c *CosElement) Search() {}
-
 type Upload struct {
-	plugin.Plugin
 	Name       string
 	Type       plugin.Type
 	Support    []uint32
@@ -123,7 +42,7 @@ type Upload struct {
 	stdLog     bilog.Logger
 	accessLog  bilog.Logger
 	errorLog   bilog.Logger
-	cosElement *CosElement
+	cosElement *storage.Cos
 }
 
 func (u *Upload) SetSource(source *plugin.Source) {
@@ -149,27 +68,66 @@ func (u *Upload) Caller(s plugin.Single) {
 	u.accessLog.Info(Name + ".Caller")
 }
 
-// Start 启动函数
-func (u *Upload) Start(args []string) {
+// 返回归档的签名
+func signatures(run *plugin.Run, archive plugin.Artifact) []plugin.Artifact {
+	res := make([]plugin.Artifact, 0, 1)
+	for _, v := range run.ArtifactsByKind(plugin.KindSignature) {
+		if v.Meta["archive"] == archive.Path {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Exec 启动函数
+func (u *Upload) Exec(run *plugin.Run, args []string) error {
 	// 初始化实例
 	if u.cosElement == nil {
-		InitCosElement(u)
+		u.cosElement = storage.NewCos(u.conf)
 	}
 	if args == nil || len(args) == 0 {
-		// 上传尝试3次
-		for i := 0 ; i < 3; i++{
-			err := u.cosElement.Push(BackUpFilePath)
-			if err == nil {
-				break
-			} else if _,ok := err.(*os.PathError);ok {
-				panic(err)
-			} else {
-				u.errorLog.ErrorFromString(err.Error())
+		if run == nil {
+			return errors.New("upload: no pipeline run to upload")
+		}
+		archives := run.ArtifactsByKind(plugin.KindArchive)
+		if len(archives) == 0 {
+			return errors.New("no archive produced in run " + run.ID)
+		}
+		for _, v := range archives {
+			// 签名的归档使用签名中记录的对象键
+			key := v.Meta["object"]
+			if key == "" {
+				key = storage.ObjectName(run, v, len(archives))
+			}
+			if err := u.push(run, v.Path, key); err != nil {
+				return err
+			}
+			// 登记远端对象的键，供之后的插件报告
+			run.AddArtifact(plugin.Artifact{
+				Path:     key,
+				Kind:     plugin.KindRemote,
+				Size:     v.Size,
+				Checksum: v.Checksum,
+				Plugin:   Name,
+			})
+			// 归档的签名上传到同名加上.sig的对象
+			for _, sig := range signatures(run, v) {
+				sigKey := key + sign.Ext
+				if err := u.push(run, sig.Path, sigKey); err != nil {
+					return err
+				}
+				run.AddArtifact(plugin.Artifact{
+					Path:     sigKey,
+					Kind:     plugin.KindRemote,
+					Size:     sig.Size,
+					Checksum: sig.Checksum,
+					Plugin:   Name,
+				})
 			}
 		}
 		// 上传成功则打印日志
 		u.accessLog.Info("upload cos successfully")
-		return
+		return nil
 	} else {
 		os.Args = args
 	}
@@ -178,11 +136,11 @@ func (u *Upload) Start(args []string) {
 	if *downloadFileName != "" {
 		bytes, err := u.cosElement.Download(*downloadFileName)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		err = ioutil.WriteFile(DownloadCached+"/"+*downloadFileName, bytes, 0755)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		// 打印消息
 		u.stdLog.Debug(fmt.Sprintf("%s 下载成功\n", *downloadFileName))
@@ -190,4 +148,24 @@ func (u *Upload) Start(args []string) {
 	} else if *searchFileName != "" {
 
 	}
+	return nil
+}
+
+// 上传尝试3次，全部失败时返回最后一次的错误
+// 尝试和失败的次数记录在run的计数中
+func (u *Upload) push(run *plugin.Run, path string, fileName string) error {
+	var err error
+	for i := 0 ; i < 3; i++{
+		run.Count(plugin.CounterUploadAttempts, 1)
+		err = u.cosElement.Push(path, fileName)
+		if err == nil {
+			return nil
+		}
+		run.Count(plugin.CounterUploadFailures, 1)
+		if _,ok := err.(*os.PathError);ok {
+			return err
+		}
+		u.errorLog.ErrorFromString(err.Error())
+	}
+	return fmt.Errorf("upload %s failed after 3 attempts: %w", fileName, err)
 }
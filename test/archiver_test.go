@@ -0,0 +1,164 @@
+package test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/abingzo/bups/common/archiver"
+	"github.com/abingzo/bups/common/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 读取归档中所有文件的内容
+func readArchive(t *testing.T, path string, opts archiver.Options) map[string]string {
+	files := make(map[string]string)
+	if opts.Format == archiver.FormatZip {
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			files[f.Name] = string(data)
+		}
+		return files
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	switch opts.Compression {
+	case archiver.CompressionGzip:
+		if r, err = gzip.NewReader(file); err != nil {
+			t.Fatal(err)
+		}
+	case archiver.CompressionZstd:
+		decoder, err := zstd.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		r = decoder
+	case archiver.CompressionXz:
+		if r, err = xz.NewReader(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		files[header.Name] = string(data)
+	}
+	return files
+}
+
+func TestArchiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-archiver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "blog")
+	if err := os.MkdirAll(filepath.Join(src, "wp-content"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	index := strings.Repeat("<?php echo 'bups'; ?>\n", 100)
+	_ = ioutil.WriteFile(filepath.Join(src, "index.php"), []byte(index), 0644)
+	_ = ioutil.WriteFile(filepath.Join(src, "wp-content", "style.css"), []byte("body {}"), 0644)
+	for _, opts := range []archiver.Options{
+		{},
+		{Format: archiver.FormatZip, Compression: archiver.CompressionNone},
+		{Format: archiver.FormatZip, Level: 9},
+		{Format: archiver.FormatTar, Compression: archiver.CompressionGzip, Level: 1},
+		{Format: archiver.FormatTar, Compression: archiver.CompressionZstd, Level: 19},
+		{Format: archiver.FormatTar, Compression: archiver.CompressionXz},
+		{Format: archiver.FormatTar, Compression: archiver.CompressionNone},
+	} {
+		dst := filepath.Join(dir, "backup"+opts.Ext())
+		if err := archiver.ArchiveTree(src, dst, opts); err != nil {
+			t.Fatalf("%s: %s", opts, err)
+		}
+		if opts.Format == "" {
+			opts = archiver.Default
+		}
+		files := readArchive(t, dst, opts)
+		if files["blog/index.php"] != index || files["blog/wp-content/style.css"] != "body {}" {
+			t.Fatalf("%s: unexpected files %v", opts, files)
+		}
+		if _, ok := files["blog/wp-content/"]; !ok {
+			t.Fatalf("%s: directory entry is missing", opts)
+		}
+	}
+	// 归档写入备份的目录时跳过归档自身
+	for _, opts := range []archiver.Options{archiver.Default, {Format: archiver.FormatTar, Compression: archiver.CompressionNone}} {
+		dst := filepath.Join(src, "self"+opts.Ext())
+		if err := archiver.ArchiveTree(src, dst, opts); err != nil {
+			t.Fatalf("%s: %s", opts, err)
+		}
+		files := readArchive(t, dst, opts)
+		if _, ok := files["blog/self"+opts.Ext()]; ok || files["blog/index.php"] != index {
+			t.Fatalf("%s: archive contains itself", opts)
+		}
+		os.Remove(dst)
+	}
+	for _, opts := range []archiver.Options{
+		{Format: archiver.FormatZip, Compression: archiver.CompressionZstd},
+		{Format: "rar"},
+		{Format: archiver.FormatTar, Compression: archiver.CompressionXz, Level: 12},
+	} {
+		if err := archiver.ArchiveTree(src, filepath.Join(dir, "invalid"), opts); err == nil {
+			t.Fatalf("%+v is accepted", opts)
+		}
+	}
+	if ext := (archiver.Options{Format: archiver.FormatTar, Compression: archiver.CompressionZstd}).Ext(); ext != ".tar.zst" {
+		t.Fatalf("unexpected ext %s", ext)
+	}
+
+	// 任务继承或者覆盖project中的归档格式
+	cfg := config.Read(bytes.NewReader([]byte(`
+[project]
+install = ["backup"]
+[project.archive]
+format = "tar"
+compression = "zstd"
+
+[[job]]
+name = "blog_a"
+
+[[job]]
+name = "blog_b"
+[job.archive]
+format = "zip"
+`)))
+	jobs := cfg.Jobs()
+	if jobs[0].Archive.Compression != archiver.CompressionZstd || jobs[1].Archive.Format != archiver.FormatZip || jobs[1].Archive.Compression != "" {
+		t.Fatalf("unexpected archive config: %+v", jobs)
+	}
+	cfg.UseJob("blog_b")
+	if archiver.FromConfig(cfg.Project.Archive).Ext() != ".zip" {
+		t.Fatal("job archive config is not used")
+	}
+}
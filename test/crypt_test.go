@@ -0,0 +1,245 @@
+package test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"github.com/abingzo/bups/app"
+	"github.com/abingzo/bups/common/crypt"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/plugins/encrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func encryptBytes(t *testing.T, plain []byte, passphrase string, kdf string, chunkSize int) []byte {
+	buf := new(bytes.Buffer)
+	if err := crypt.EncryptWithPassphrase(buf, bytes.NewReader(plain), []byte(passphrase), "2022-01", kdf, chunkSize); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptBytes(data []byte, passphrase string) ([]byte, error) {
+	reader, err := crypt.NewReader(bytes.NewReader(data), crypt.PassphraseKey([]byte(passphrase)))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func TestCryptStream(t *testing.T) {
+	const chunkSize = 1024
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, 3 * chunkSize, 3*chunkSize + 7} {
+		plain := make([]byte, size)
+		if _, err := rand.Read(plain); err != nil {
+			t.Fatal(err)
+		}
+		// argon2id默认使用64MB内存，只在一种长度上测试
+		kdfs := []string{crypt.KDFScrypt}
+		if size == chunkSize {
+			kdfs = append(kdfs, crypt.KDFArgon2id)
+		}
+		for _, kdf := range kdfs {
+			data := encryptBytes(t, plain, "correct horse", kdf, chunkSize)
+			got, err := decryptBytes(data, "correct horse")
+			if err != nil {
+				t.Fatalf("size %d kdf %s: %s", size, kdf, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("size %d kdf %s: plaintext mismatch", size, kdf)
+			}
+		}
+	}
+	plain := bytes.Repeat([]byte("bups"), chunkSize)
+	data := encryptBytes(t, plain, "correct horse", crypt.KDFScrypt, chunkSize)
+	header, raw, err := crypt.ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.KeyID != "2022-01" || header.KDF.Name != crypt.KDFScrypt || header.KDF.N == 0 || header.ChunkSize != chunkSize {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+	chunk := chunkSize + 16
+	body := data[len(raw):]
+	// 满块的最后一块同样带有最后一块的标志，不需要额外的空块
+	if len(body) != 4*chunk {
+		t.Fatalf("unexpected ciphertext size: %d", len(body))
+	}
+	tampered := func(fn func(b []byte) []byte) []byte {
+		b := append([]byte{}, data...)
+		return fn(b)
+	}
+	for name, v := range map[string][]byte{
+		"wrong passphrase": nil,
+		// 截断在块的边界上
+		"truncated": tampered(func(b []byte) []byte { return b[:len(raw)+3*chunk] }),
+		"reordered": tampered(func(b []byte) []byte {
+			first := append([]byte{}, b[len(raw):len(raw)+chunk]...)
+			copy(b[len(raw):], b[len(raw)+chunk:len(raw)+2*chunk])
+			copy(b[len(raw)+chunk:], first)
+			return b
+		}),
+		"flipped": tampered(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }),
+		// 修改文件头中的密钥标识
+		"header": tampered(func(b []byte) []byte {
+			return bytes.Replace(b, []byte(`"2022-01"`), []byte(`"2022-02"`), 1)
+		}),
+	} {
+		passphrase := "correct horse"
+		if v == nil {
+			v, passphrase = data, "wrong horse"
+		}
+		if _, err := decryptBytes(v, passphrase); err == nil {
+			t.Fatalf("%s: decrypt does not fail", name)
+		}
+	}
+}
+
+const encryptConfig = `
+[project]
+install = ["encrypt"]
+lopp_time = 60
+
+[plugin.encrypt.cipher]
+key_file = "%s"
+key_id = "2022-01"
+kdf = "scrypt"
+chunk_size = 4096
+`
+
+func TestEncryptArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(encryptConfig, keyFile)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dump := filepath.Join(dir, "database.sql")
+	if err := ioutil.WriteFile(dump, bytes.Repeat([]byte("INSERT INTO posts VALUES (1);\n"), 1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	ctx := plugin.NewContext()
+	source := LoadPluginSource()
+	source.RawConfig = app.NewCFGBuffer(file)
+	ctx.RawSource = source
+	// 缓存目录在测试的目录下
+	ctx.RegisterJob("encrypt_test", encrypt.New())
+	defer os.RemoveAll("./cache/encrypt_test")
+	if err := os.MkdirAll(plugin.CacheDir("encrypt_test", encrypt.Name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	collector := &runPlugin{TestPlugin: TestPlugin{name: "backup", _type: plugin.BCollect}}
+	collector.onStart = func(run *plugin.Run) {
+		if _, err := run.Emit("backup", plugin.KindDatabase, dump); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx.RegisterJob("encrypt_test", collector)
+	run, err := ctx.RunJob("encrypt_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archives := run.ArtifactsByKind(plugin.KindArchive)
+	if len(archives) != 1 || !strings.HasSuffix(archives[0].Path, encrypt.EncryptedExt) {
+		t.Fatalf("unexpected archives: %+v", archives)
+	}
+	if _, err := os.Stat(strings.TrimSuffix(archives[0].Path, encrypt.EncryptedExt)); !os.IsNotExist(err) {
+		t.Fatal("plain archive is not removed")
+	}
+	// 通过参数解密
+	out := filepath.Join(dir, "backup.zip")
+	var p plugin.Plugin
+	ctx.RangeJobPlugin(func(k int, job string, v plugin.Plugin) {
+		if v.GetName() == encrypt.Name {
+			p = v
+		}
+	})
+	if err := plugin.Start(p, []string{"bups", "--decrypt", archives[0].Path, "--out", out}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil || !bytes.HasPrefix(data, []byte("PK")) {
+		t.Fatal("decrypted archive is not a zip file")
+	}
+	// 归档失败时不留下明文或者不完整的归档
+	if err := os.Remove(archives[0].Path); err != nil {
+		t.Fatal(err)
+	}
+	collector.onStart = func(run *plugin.Run) {
+		if _, err := run.Emit("backup", plugin.KindDatabase, dump); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(dump)
+	}
+	if _, err := ctx.RunJob("encrypt_test"); err == nil {
+		t.Fatal("archive of a missing artifact should fail")
+	}
+	if names, _ := filepath.Glob(filepath.Join(plugin.CacheDir("encrypt_test", encrypt.Name), "backup*")); len(names) != 0 {
+		t.Fatalf("archives are left in cache: %v", names)
+	}
+}
+
+func TestCryptRecipients(t *testing.T) {
+	alice, err := crypt.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := crypt.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eve, err := crypt.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 文本格式可以还原
+	recipient, err := crypt.ParseRecipient(alice.Recipient().String())
+	if err != nil || !strings.HasPrefix(recipient.String(), crypt.PublicKeyPrefix) {
+		t.Fatal("parse recipient failed:", err)
+	}
+	identity, err := crypt.ParseIdentity(bob.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("bups"), 3000)
+	buf := new(bytes.Buffer)
+	if err := crypt.EncryptToRecipients(buf, bytes.NewReader(plain), []*crypt.Recipient{recipient, bob.Recipient()}, "offline", 1024); err != nil {
+		t.Fatal(err)
+	}
+	header, _, err := crypt.ReadHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil || len(header.Recipients) != 2 || header.KDF != nil {
+		t.Fatalf("unexpected header: %+v %v", header, err)
+	}
+	for _, v := range []*crypt.Identity{alice, identity} {
+		reader, err := crypt.NewReader(bytes.NewReader(buf.Bytes()), crypt.IdentityKey(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(reader)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatal("plaintext mismatch:", err)
+		}
+	}
+	if _, err := crypt.NewReader(bytes.NewReader(buf.Bytes()), crypt.IdentityKey(eve)); err == nil {
+		t.Fatal("decrypt with other identity does not fail")
+	}
+	if _, err := crypt.NewReader(bytes.NewReader(buf.Bytes()), crypt.PassphraseKey([]byte("correct horse"))); err == nil {
+		t.Fatal("decrypt with passphrase does not fail")
+	}
+}
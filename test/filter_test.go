@@ -0,0 +1,136 @@
+package test
+
+import (
+	"github.com/abingzo/bups/common/archiver"
+	"github.com/abingzo/bups/common/filter"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilterRules(t *testing.T) {
+	f, err := filter.New([]string{
+		"# 注释",
+		"*.log",
+		"node_modules/",
+		"/wp-content/cache",
+		"uploads/**/*-150x150.*",
+		"re:^tmp/[0-9]+$",
+		"a/**/b",
+	}, []string{"important.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		rel      string
+		isDir    bool
+		excluded bool
+	}{
+		{"error.log", false, true},
+		{"logs/access.log", false, true},
+		{"important.log", false, false},
+		{"logs/important.log", false, false},
+		{"node_modules", true, true},
+		{"theme/node_modules", true, true},
+		{"node_modules", false, false},
+		{"wp-content/cache", true, true},
+		{"blog/wp-content/cache", true, false},
+		{"uploads/2022/01/cat-150x150.jpg", false, true},
+		{"uploads/cat-150x150.jpg", false, true},
+		{"uploads/2022/01/cat.jpg", false, false},
+		{"tmp/123", false, true},
+		{"tmp/abc", false, false},
+		{"a/b", true, true},
+		{"a/x/y/b", true, true},
+		{"index.php", false, false},
+	}
+	for _, c := range cases {
+		if got := f.Excluded(c.rel, c.isDir); got != c.excluded {
+			t.Errorf("%s: excluded = %v, want %v", c.rel, got, c.excluded)
+		}
+	}
+	if _, err := filter.New([]string{"re:("}, nil); err == nil {
+		t.Fatal("invalid regexp should fail")
+	}
+	for text, size := range map[string]int64{"100": 100, "1KB": 1000, "2MiB": 2 << 20, "1.5G": 3 << 29} {
+		if got, err := filter.ParseSize(text); err != nil || got != size {
+			t.Fatalf("ParseSize(%s) = %d %v", text, got, err)
+		}
+	}
+}
+
+// 使用过滤器归档目录，检查忽略文件、大小和修改时间的限制以及跳过的统计
+func TestFilterArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "blog")
+	files := map[string]string{
+		"index.php":                      "<?php",
+		"debug.log":                      "0123456789",
+		"node_modules/lib/index.js":      "module",
+		"wp-content/cache/page.html":     "cache",
+		"wp-content/uploads/big.bin":     "0123456789abcdefghij",
+		"wp-content/uploads/.bupsignore": "*.tmp\n!keep.tmp\n",
+		"wp-content/uploads/a.tmp":       "tmp",
+		"wp-content/uploads/keep.tmp":    "keep",
+		"wp-content/uploads/photo.jpg":   "jpg",
+		"a.tmp":                          "root tmp",
+	}
+	old := time.Now().Add(-time.Hour)
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 刚刚写入的文件
+	if err := ioutil.WriteFile(filepath.Join(src, "writing.sql"), []byte("insert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := filter.New([]string{"*.log", "node_modules/", "wp-content/cache/"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.MaxSize = 16
+	f.SkipNewer = time.Minute
+	opts := archiver.Options{Format: archiver.FormatTar, Compression: archiver.CompressionGzip}
+	dst := filepath.Join(dir, "blog.tar.gz")
+	w, err := archiver.Create(dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Filter = f
+	if err := w.AddTree(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readArchive(t, dst, opts)
+	for _, name := range []string{"index.php", "a.tmp", "wp-content/uploads/keep.tmp", "wp-content/uploads/photo.jpg", "wp-content/uploads/.bupsignore"} {
+		if _, ok := got["blog/"+name]; !ok {
+			t.Errorf("%s should be archived", name)
+		}
+	}
+	for _, name := range []string{"debug.log", "node_modules/lib/index.js", "node_modules/", "wp-content/cache/page.html",
+		"wp-content/uploads/big.bin", "wp-content/uploads/a.tmp", "writing.sql"} {
+		if _, ok := got["blog/"+name]; ok {
+			t.Errorf("%s should be skipped", name)
+		}
+	}
+	// debug.log node_modules/lib/index.js wp-content/cache/page.html big.bin a.tmp writing.sql
+	if f.SkippedFiles != 6 || f.SkippedBytes != 10+6+5+20+3+6 {
+		t.Fatalf("skipped %d files %d bytes", f.SkippedFiles, f.SkippedBytes)
+	}
+}
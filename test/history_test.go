@@ -0,0 +1,84 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/abingzo/bups/common/history"
+	"github.com/abingzo/bups/common/plugin"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := history.NewStore(filepath.Join(dir, "history.jsonl"))
+	// 不存在的历史文件返回空记录
+	if entries, err := store.List("", 0); err != nil || len(entries) != 0 {
+		t.Fatal("empty history is not empty")
+	}
+	archive := filepath.Join(dir, "backup.zip")
+	if err := ioutil.WriteFile(archive, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range []string{"blog_a", "blog_b", "blog_a"} {
+		run := plugin.NewRun()
+		run.Job = job
+		run.AddResult(plugin.Result{Plugin: "backup", Stage: plugin.BCollect, Duration: time.Second})
+		if job == "blog_b" {
+			run.AddResult(plugin.Result{Plugin: "upload", Stage: plugin.BCallBack, Err: errors.New("network is unreachable")})
+		} else if _, err := run.Emit("encrypt", plugin.KindArchive, archive); err != nil {
+			t.Fatal(err)
+		}
+		run.EndTime = run.StartTime.Add(2 * time.Second)
+		if err := store.Append(history.FromRun(run)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := store.List("blog_a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Outcome != history.OutcomeSuccess || entries[0].ArchiveSize() != int64(len("archive")) {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	entries, err = store.List("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Job != "blog_a" {
+		t.Fatal("history is not listed from newest to oldest")
+	}
+	entries, err = store.List("blog_b", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Outcome != history.OutcomeFailed || !strings.Contains(entries[0].Error, "network is unreachable") ||
+		entries[0].Plugins[1].Outcome != history.OutcomeFailed || entries[0].Duration() != 2*time.Second {
+		t.Fatalf("unexpected failed entry: %+v", entries[0])
+	}
+	// 输出格式
+	buf := new(bytes.Buffer)
+	if err := history.WriteTable(buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), entries[0].RunID) {
+		t.Fatal("table output does not contain run id")
+	}
+	buf.Reset()
+	if err := history.WriteJSON(buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []history.Entry
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded) != 1 {
+		t.Fatal("json output is not a history array")
+	}
+}
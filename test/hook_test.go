@@ -0,0 +1,76 @@
+package test
+
+import (
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/plugin"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook test uses sh")
+	}
+	dir, err := ioutil.TempDir("", "bups-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, "env")
+	failureFile := filepath.Join(dir, "failure")
+
+	ctx := plugin.NewContext()
+	ctx.RawSource = LoadPluginSource()
+	collector := &runPlugin{TestPlugin: TestPlugin{name: "collector", _type: plugin.BCollect}}
+	handler := &v2Plugin{TestPlugin: TestPlugin{name: "handler", _type: plugin.BHandle}}
+	collector.onStart = func(run *plugin.Run) {
+		if _, err := run.Emit(collector.name, plugin.KindFile, envFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx.RegisterRaw(collector)
+	ctx.RegisterV2(handler)
+	ctx.SetHooks(plugin.DefaultJob, []config.Hook{
+		{Stage: config.HookBeforeCollect, Command: "echo $BUPS_RUN_ID $BUPS_STAGE > " + envFile},
+		{Stage: config.HookAfterCollect, Command: "test -n \"$BUPS_ARTIFACTS\" && exit 3", Abort: true},
+		{Stage: config.HookOnFailure, Command: "echo \"$BUPS_ERROR\" > " + failureFile},
+	})
+	run, err := ctx.RunJob(plugin.DefaultJob)
+	if err == nil {
+		t.Fatal("abort hook does not fail the run")
+	}
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(env)) != run.ID+" "+config.HookBeforeCollect {
+		t.Fatalf("unexpected hook env: %s", env)
+	}
+	if handler.called {
+		t.Fatal("aborted run does not skip handle stage")
+	}
+	failure, err := ioutil.ReadFile(failureFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(failure), "exit status 3") {
+		t.Fatalf("on_failure hook does not receive error: %s", failure)
+	}
+
+	// 超时的钩子被杀死
+	ctx.SetHooks(plugin.DefaultJob, []config.Hook{
+		{Stage: config.HookBeforeHandle, Command: "sleep 5", Timeout: 1, Abort: true},
+	})
+	start := time.Now()
+	if _, err := ctx.RunJob(plugin.DefaultJob); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("timeout hook does not fail the run: %v", err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Fatal("timeout hook is not killed")
+	}
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/abingzo/bups/common/archiver"
+	"github.com/abingzo/bups/common/incremental"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 与backup插件相同的方式创建一次增量备份，返回新的清单
+func incrementalBackup(t *testing.T, src string, dst string, prev *incremental.Manifest, full bool) (*incremental.Manifest, *incremental.Tracker) {
+	opts := archiver.Options{Format: archiver.FormatTar, Compression: archiver.CompressionZstd}
+	tracker := incremental.NewTracker(prev, src, full, filepath.Base(dst))
+	w, err := archiver.Create(dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Filter = tracker
+	if err := w.AddTree(src); err != nil {
+		t.Fatal(err)
+	}
+	info := filepath.Join(filepath.Dir(dst), "info.json")
+	raw, err := json.Marshal(tracker.Info(archiver.TreeRoot(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(info, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddFile(incremental.InfoName, info); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tracker.Manifest(), tracker
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-incremental")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "static")
+	writeTree(t, src, map[string]string{
+		"index.html":       "v1",
+		"css/site.css":     "body{}",
+		"img/logo.png":     "png",
+		"old/removed.html": "removed",
+	})
+	full, tracker := incrementalBackup(t, src, filepath.Join(dir, "0.tar.zst"), nil, false)
+	if !tracker.Full() || tracker.Changed != 4 || full.Sequence != 0 {
+		t.Fatalf("first backup should be full: %+v", tracker)
+	}
+
+	// 修改、新增、删除文件，只修改时间的文件不应该被写入
+	writeTree(t, src, map[string]string{"index.html": "v2", "js/app.js": "app"})
+	if err := os.RemoveAll(filepath.Join(src, "old")); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "css/site.css"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	inc1, tracker := incrementalBackup(t, src, filepath.Join(dir, "1.tar.zst"), full, false)
+	if tracker.Full() || tracker.Changed != 2 || tracker.Unchanged != 2 || inc1.Sequence != 1 || inc1.Chain != full.Chain {
+		t.Fatalf("incremental backup: changed %d unchanged %d manifest %+v", tracker.Changed, tracker.Unchanged, inc1)
+	}
+	files := readArchive(t, filepath.Join(dir, "1.tar.zst"), archiver.Options{Format: archiver.FormatTar, Compression: archiver.CompressionZstd})
+	if files["static/index.html"] != "v2" || files["static/js/app.js"] != "app" {
+		t.Fatalf("incremental archive: %v", files)
+	}
+	if _, ok := files["static/img/logo.png"]; ok {
+		t.Fatal("unchanged file should not be archived")
+	}
+	info, err := incremental.ReadInfo(filepath.Join(dir, "1.tar.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != incremental.TypeIncremental || len(info.Deleted) != 2 || info.Deleted[0] != "old" || info.Root != "static" {
+		t.Fatalf("info: %+v", info)
+	}
+
+	writeTree(t, src, map[string]string{"img/logo.png": "png2"})
+	incrementalBackup(t, src, filepath.Join(dir, "2.tar.zst"), inc1, false)
+
+	// 以任意的顺序给出归档，恢复到最后一次备份时的目录
+	target := filepath.Join(dir, "restore")
+	chain := []string{filepath.Join(dir, "2.tar.zst"), filepath.Join(dir, "0.tar.zst"), filepath.Join(dir, "1.tar.zst")}
+	if err := incremental.Restore(chain, target, archiver.ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"index.html": "v2", "css/site.css": "body{}", "img/logo.png": "png2", "js/app.js": "app"}
+	for name, content := range want {
+		data, err := ioutil.ReadFile(filepath.Join(target, "static", filepath.FromSlash(name)))
+		if err != nil || string(data) != content {
+			t.Fatalf("%s: %q %v", name, data, err)
+		}
+	}
+	for _, name := range []string{"static/old", incremental.InfoName} {
+		if _, err := os.Lstat(filepath.Join(target, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should not exist after restore", name)
+		}
+	}
+	// 缺少增量备份或者完整备份的链不能恢复
+	if err := incremental.Restore(chain[:2], filepath.Join(dir, "broken"), archiver.ExtractOptions{}); err == nil {
+		t.Fatal("restore without incremental backup 1 should fail")
+	}
+	if err := incremental.Restore(chain[2:], filepath.Join(dir, "broken"), archiver.ExtractOptions{}); err == nil {
+		t.Fatal("restore without full backup should fail")
+	}
+}
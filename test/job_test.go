@@ -0,0 +1,172 @@
+package test
+
+import (
+	"errors"
+	"github.com/abingzo/bups/app"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/plugin"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const jobConfig = `
+[project]
+install = ["collector"]
+lopp_time = 60
+
+[project.log]
+access_log = "./access.log"
+error_log = "./error.log"
+
+[plugin.collector.file_path]
+root = "/var/www/global"
+
+[[job]]
+name = "blog_a"
+[job.schedule]
+cron = "0 3 * * *"
+[job.plugin.collector.file_path]
+root = "/var/www/a"
+
+[[job]]
+name = "blog_b"
+install = ["collector", "handler"]
+`
+
+func TestJobConfig(t *testing.T) {
+	cfg := config.Read(strings.NewReader(jobConfig))
+	jobs := cfg.Jobs()
+	if len(jobs) != 2 || jobs[0].Name != "blog_a" || jobs[1].Name != "blog_b" {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+	// 未配置的字段从project继承
+	if jobs[0].Schedule.Cron != "0 3 * * *" || jobs[0].LoppTime != 0 || len(jobs[0].Install) != 1 {
+		t.Fatalf("job blog_a is not inherited: %+v", jobs[0])
+	}
+	if jobs[1].LoppTime != 60 || len(jobs[1].Install) != 2 {
+		t.Fatalf("job blog_b is not inherited: %+v", jobs[1])
+	}
+	// 任务中的插件配置覆盖全局配置
+	cfg.UseJob("blog_a")
+	cfg.SetPluginName("collector")
+	cfg.SetPluginScope("file_path")
+	if cfg.PluginGetData("root") != "/var/www/a" || cfg.JobName() != "blog_a" {
+		t.Fatal("job plugin config does not override global config")
+	}
+	cfg = config.Read(strings.NewReader(jobConfig))
+	cfg.UseJob("blog_b")
+	cfg.SetPluginName("collector")
+	cfg.SetPluginScope("file_path")
+	if cfg.PluginGetData("root") != "/var/www/global" {
+		t.Fatal("job without plugin config does not use global config")
+	}
+	// 没有配置任务时使用project作为默认任务
+	cfg = config.Read(strings.NewReader(strings.Split(jobConfig, "[[job]]")[0]))
+	if jobs := cfg.Jobs(); len(jobs) != 1 || jobs[0].Name != config.DefaultJob {
+		t.Fatalf("unexpected default job: %+v", jobs)
+	}
+}
+
+type jobPlugin struct {
+	TestPlugin
+	source *plugin.Source
+}
+
+func (j *jobPlugin) SetSource(source *plugin.Source) {
+	j.source = source
+}
+
+func TestJobPipeline(t *testing.T) {
+	file, err := ioutil.TempFile("", "bups-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(jobConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx := plugin.NewContext()
+	source := LoadPluginSource()
+	source.RawConfig = app.NewCFGBuffer(file)
+	ctx.RawSource = source
+	support := []uint32{plugin.SUPPORT_LOGGER, plugin.SUPPORT_CONFIG_OBJ}
+	a := &jobPlugin{TestPlugin: TestPlugin{name: "collector", _type: plugin.BCollect, support: support}}
+	b := &jobPlugin{TestPlugin: TestPlugin{name: "collector", _type: plugin.BCollect, support: support}}
+	ctx.RegisterJob("blog_a", a)
+	ctx.RegisterJob("blog_b", b)
+	if jobs := ctx.Jobs(); len(jobs) != 2 {
+		t.Fatalf("unexpected jobs: %v", jobs)
+	}
+	if a.source.CacheDir != "./cache/blog_a/collector" || a.source.Job != "blog_a" {
+		t.Fatalf("unexpected cache dir: %s", a.source.CacheDir)
+	}
+	a.source.Config.SetPluginName("collector")
+	a.source.Config.SetPluginScope("file_path")
+	if a.source.Config.PluginGetData("root") != "/var/www/a" {
+		t.Fatal("plugin config is not switched to job")
+	}
+	runA, err := ctx.RunJob("blog_a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runA.Job != "blog_a" || ctx.GetJobRun("blog_b") != nil {
+		t.Fatal("job pipelines are not independent")
+	}
+}
+
+// 一个任务的插件阻塞时，其他任务的流水线和上下文的查询不受影响
+func TestJobIndependent(t *testing.T) {
+	ctx := plugin.NewContext()
+	ctx.RawSource = LoadPluginSource()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := &runPlugin{TestPlugin: TestPlugin{name: "slow", _type: plugin.BCollect}}
+	slow.onStart = func(run *plugin.Run) {
+		close(started)
+		<-release
+	}
+	fast := &runPlugin{TestPlugin: TestPlugin{name: "fast", _type: plugin.BCollect}}
+	fast.onStart = func(run *plugin.Run) {}
+	ctx.RegisterJob("slow", slow)
+	ctx.RegisterJob("fast", fast)
+	slowDone := make(chan error)
+	go func() {
+		_, err := ctx.RunJob("slow")
+		slowDone <- err
+	}()
+	<-started
+	done := make(chan error)
+	go func() {
+		if ctx.GetJobRun("slow") == nil {
+			done <- errors.New("run of the blocked job is not visible")
+			return
+		}
+		_, err := ctx.RunJob("fast")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job fast is blocked by job slow")
+	}
+	close(release)
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+	// 不支持的状态返回错误，之后的任务依然可以运行
+	if err := ctx.SetJobState("fast", plugin.Type(9)); err == nil {
+		t.Fatal("unknown state is accepted")
+	}
+	if _, err := ctx.RunJob("fast"); err != nil {
+		t.Fatal(err)
+	}
+}
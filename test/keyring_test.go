@@ -0,0 +1,193 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/crypt"
+	"github.com/abingzo/bups/common/sign"
+	"github.com/abingzo/bups/plugins/encrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const keyringConfig = `
+[project]
+install = ["encrypt"]
+lopp_time = 60
+
+[plugin.encrypt.cipher]
+kdf = "scrypt"
+chunk_size = 4096
+
+[plugin.encrypt.keyring.2022-01]
+created = 2022-01-01
+status = "decrypt-only"
+passphrase = "old horse"
+
+[plugin.encrypt.keyring.2023-01]
+created = "2023-01-01"
+status = "active"
+passphrase = "$ENV:BUPS_TEST_PASSPHRASE"
+
+[plugin.encrypt.sign]
+key_file = "%s"
+trusted = ["%s"]
+`
+
+// 内存中的远端存储
+type memoryStorage map[string][]byte
+
+func (m memoryStorage) Push(path string, name string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	m[name] = data
+	return nil
+}
+
+func (m memoryStorage) Download(name string) ([]byte, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+// 上传指定的对象时失败的远端存储
+type failingStorage struct {
+	memoryStorage
+	fail string
+}
+
+func (f failingStorage) Push(path string, name string) error {
+	if name == f.fail {
+		return errors.New("push failed")
+	}
+	return f.memoryStorage.Push(path, name)
+}
+
+func TestKeyringRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := sign.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "sign.key")
+	if err := ioutil.WriteFile(keyFile, []byte(key.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("BUPS_TEST_PASSPHRASE", "new horse")
+	defer os.Unsetenv("BUPS_TEST_PASSPHRASE")
+	cfg := config.Read(strings.NewReader(fmt.Sprintf(keyringConfig, keyFile, key.Public())))
+	c, err := encrypt.ReadCipher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := encrypt.ReadSigner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Keys) != 2 || c.Active() == nil || c.Active().ID != "2023-01" || string(c.Active().Passphrase) != "new horse" ||
+		c.Lookup("2022-01").Status != encrypt.KeyDecryptOnly || c.Lookup("2022-01").Created.Year() != 2022 {
+		t.Fatalf("unexpected keyring: %+v", c.Keys)
+	}
+	// 旧的密钥加密并签名的归档
+	plain := bytes.Repeat([]byte("bups"), 5000)
+	old := filepath.Join(dir, "old.zip.enc")
+	buf := new(bytes.Buffer)
+	if err := crypt.EncryptWithPassphrase(buf, bytes.NewReader(plain), []byte("old horse"), "2022-01", crypt.KDFScrypt, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(old, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := sign.Sign(key, old, sign.Metadata{Object: "blog/2022-01-01-00-00.enc", Job: "blog", Version: "v0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sig.WriteFile(old + sign.Ext); err != nil {
+		t.Fatal(err)
+	}
+	// 按照文件头中的标识选择密钥
+	if err := c.DecryptFile(old, filepath.Join(dir, "old.zip")); err != nil {
+		t.Fatal(err)
+	}
+	storage := memoryStorage{}
+	_ = storage.Push(old, "blog/2022-01-01-00-00.enc")
+	_ = storage.Push(old+sign.Ext, "blog/2022-01-01-00-00.enc"+sign.Ext)
+	rotator := &encrypt.Rotator{Storage: storage, Cipher: c, Signer: signer, Dir: dir}
+	if rotated, err := rotator.Rotate("blog/2022-01-01-00-00.enc"); err != nil || !rotated {
+		t.Fatal("rotate failed:", rotated, err)
+	}
+	rotated := filepath.Join(dir, "rotated.enc")
+	_ = ioutil.WriteFile(rotated, storage["blog/2022-01-01-00-00.enc"], 0600)
+	header, _, err := crypt.ReadHeader(bytes.NewReader(storage["blog/2022-01-01-00-00.enc"]))
+	if err != nil || header.KeyID != "2023-01" {
+		t.Fatalf("archive is not rotated: %+v %v", header, err)
+	}
+	_ = ioutil.WriteFile(rotated+sign.Ext, storage["blog/2022-01-01-00-00.enc"+sign.Ext], 0600)
+	newSig, err := signer.Verify(rotated, "", "blog/2022-01-01-00-00.enc")
+	if err != nil || newSig.Metadata.Job != "blog" {
+		t.Fatal("signature is not updated:", err)
+	}
+	got := filepath.Join(dir, "rotated.zip")
+	if err := c.DecryptFile(rotated, got); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(got); !bytes.Equal(data, plain) {
+		t.Fatal("plaintext mismatch after rotation")
+	}
+	// 已经使用启用的密钥加密
+	if again, err := rotator.Rotate("blog/2022-01-01-00-00.enc"); err != nil || again {
+		t.Fatal("archive is rotated twice:", err)
+	}
+	// 篡改的归档不会被重新加密
+	storage["blog/evil.enc"] = append(storage["blog/2022-01-01-00-00.enc"], 'x')
+	storage["blog/evil.enc"+sign.Ext] = storage["blog/2022-01-01-00-00.enc"+sign.Ext]
+	if _, err := rotator.Rotate("blog/evil.enc"); err == nil {
+		t.Fatal("tampered archive is rotated")
+	}
+	// 配置了信任的公钥但没有签名的私钥时不进行轮换
+	unsigned := &encrypt.Rotator{Storage: storage, Cipher: c, Signer: &encrypt.Signer{Trusted: signer.Trusted}, Dir: dir}
+	before := string(storage["blog/2022-01-01-00-00.enc"])
+	if _, err := unsigned.Rotate("blog/2022-01-01-00-00.enc"); err == nil || string(storage["blog/2022-01-01-00-00.enc"]) != before {
+		t.Fatal("archive is rotated without a signing key:", err)
+	}
+	// 上传归档失败时远端的归档和签名仍然匹配
+	_ = storage.Push(old, "blog/fail.enc")
+	_ = storage.Push(old+sign.Ext, "blog/fail.enc"+sign.Ext)
+	oldSig, _ := sign.ReadFile(old + sign.Ext)
+	oldSig.Metadata.Object = "blog/fail.enc"
+	resigned, err := sign.Sign(key, old, oldSig.Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resigned.WriteFile(old + sign.Ext)
+	_ = storage.Push(old+sign.Ext, "blog/fail.enc"+sign.Ext)
+	failing := &encrypt.Rotator{Storage: failingStorage{storage, "blog/fail.enc"}, Cipher: c, Signer: signer, Dir: dir}
+	if rotated, err := failing.Rotate("blog/fail.enc"); err == nil || rotated {
+		t.Fatal("failed push is reported as rotated:", err)
+	}
+	check := filepath.Join(dir, "fail.enc")
+	_ = ioutil.WriteFile(check, storage["blog/fail.enc"], 0600)
+	_ = ioutil.WriteFile(check+sign.Ext, storage["blog/fail.enc"+sign.Ext], 0600)
+	if _, err := signer.Verify(check, "", "blog/fail.enc"); err != nil {
+		t.Fatal("archive and signature mismatch after failed rotation:", err)
+	}
+
+	// 只能有一个启用的密钥
+	invalid := strings.Replace(keyringConfig, `status = "decrypt-only"`, `status = "active"`, 1)
+	if _, err := encrypt.ReadCipher(config.Read(strings.NewReader(fmt.Sprintf(invalid, keyFile, key.Public())))); err == nil {
+		t.Fatal("two active keys are accepted")
+	}
+}
@@ -0,0 +1,157 @@
+package test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/abingzo/bups/app"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/plugins/mail"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+const mailConfig = `
+[project]
+install = ["mail"]
+lopp_time = 60
+
+[plugin.mail.smtp]
+host = "127.0.0.1"
+port = %d
+security = "none"
+username = "bups"
+password = "$ENV:BUPS_TEST_SMTP_PASSWORD"
+from = "bups@example.com"
+to = ["ops@example.com", "dba@example.com"]
+`
+
+// 只实现发送邮件需要的命令的SMTP服务器
+type smtpServer struct {
+	listener net.Listener
+	auth     string
+	rcpt     []string
+	data     string
+	done     chan struct{}
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{listener: listener, done: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) serve() {
+	defer close(s.done)
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			s.auth = line
+			reply("235 OK")
+		case "MAIL":
+			reply("250 OK")
+		case "RCPT":
+			s.rcpt = append(s.rcpt, line)
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			data := new(strings.Builder)
+			for {
+				l, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.data = data.String()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestMailReport(t *testing.T) {
+	os.Setenv("BUPS_TEST_SMTP_PASSWORD", "secret")
+	defer os.Unsetenv("BUPS_TEST_SMTP_PASSWORD")
+	server := newSMTPServer(t)
+	defer server.listener.Close()
+
+	file, err := ioutil.TempFile("", "bups-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := fmt.Fprintf(file, mailConfig, server.listener.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx := plugin.NewContext()
+	source := LoadPluginSource()
+	source.RawConfig = app.NewCFGBuffer(file)
+	ctx.RawSource = source
+	collector := &runPlugin{TestPlugin: TestPlugin{name: "backup", _type: plugin.BCollect}}
+	collector.onStart = func(run *plugin.Run) {
+		if _, err := run.EmitMeta("backup", plugin.KindFile, file.Name(), map[string]string{"key": "root", "source": "/var/www/html"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := run.EmitMeta("backup", plugin.KindDatabase, file.Name(), map[string]string{"driver": "mysql", "databases": "youyu"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx.RegisterRaw(collector)
+	ctx.RegisterRaw(mail.New())
+	if _, err := ctx.RunJob(plugin.DefaultJob); err != nil {
+		t.Fatal(err)
+	}
+	<-server.done
+	// 凭据从环境变量中读取
+	if server.auth != "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00bups\x00secret")) {
+		t.Fatalf("unexpected auth: %s", server.auth)
+	}
+	if len(server.rcpt) != 2 {
+		t.Fatalf("unexpected recipients: %v", server.rcpt)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(server.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"text/plain", "text/html", "root: /var/www/html", "youyu (mysql", "<li>root: /var/www/html"} {
+		if !strings.Contains(string(body), v) {
+			t.Fatalf("mail does not contain %q:\n%s", v, body)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"errors"
+	"github.com/abingzo/bups/common/history"
+	"github.com/abingzo/bups/common/metrics"
+	"github.com/abingzo/bups/common/plugin"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	start := time.Unix(1600000000, 0)
+	registry.Seed([]history.Entry{{Job: "blog_a", EndTime: start.Add(-time.Hour), Outcome: history.OutcomeSuccess}})
+
+	run := plugin.NewRun()
+	run.Job = "blog_a"
+	run.StartTime = start
+	run.EndTime = start.Add(3 * time.Second)
+	run.AddResult(plugin.Result{Plugin: "backup", Stage: plugin.BCollect, Duration: time.Second})
+	run.AddResult(plugin.Result{Plugin: "upload", Stage: plugin.BCallBack, Duration: 2 * time.Second, Err: errors.New("timeout")})
+	run.AddArtifact(plugin.Artifact{Path: "backup.zip", Kind: plugin.KindArchive, Size: 1024})
+	run.Count(plugin.CounterUploadAttempts, 3)
+	run.Count(plugin.CounterUploadFailures, 3)
+	registry.Observe(run)
+	registry.SetNextRun("blog_a", start.Add(time.Hour))
+	registry.SetNextRun(`blog_"b"`, start.Add(2*time.Hour))
+
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	res, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != metrics.ContentType {
+		t.Fatalf("unexpected content type: %s", res.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{
+		"# TYPE bups_runs_total counter",
+		// 失败的运行不会覆盖历史中最近一次成功的时间
+		`bups_last_success_timestamp_seconds{job="blog_a"} 1599996400`,
+		`bups_last_run_timestamp_seconds{job="blog_a"} 1600000003`,
+		`bups_next_run_timestamp_seconds{job="blog_a"} 1600003600`,
+		`bups_next_run_timestamp_seconds{job="blog_\"b\""} 1600007200`,
+		`bups_runs_total{job="blog_a",outcome="failed"} 1`,
+		`bups_stage_duration_seconds{job="blog_a",stage="Callback"} 2`,
+		`bups_plugin_duration_seconds{job="blog_a",stage="Collect",plugin="backup"} 1`,
+		`bups_archive_bytes{job="blog_a"} 1024`,
+		`bups_upload_attempts_total{job="blog_a"} 3`,
+		`bups_upload_failures_total{job="blog_a"} 3`,
+	} {
+		if !strings.Contains(string(body), v+"\n") {
+			t.Fatalf("metrics do not contain %q:\n%s", v, body)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/app"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/plugins/notify"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const notifyConfig = `
+[project]
+install = ["notify"]
+lopp_time = 60
+
+[plugin.notify.webhook]
+urls = ["%s"]
+secret = "bups-secret"
+retries = 2
+retry_interval = 0
+failures_only = %v
+template = '''%s'''
+`
+
+type receiver struct {
+	mu       sync.Mutex
+	bodies   [][]byte
+	failures int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	// 前几次请求返回错误以测试重试
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if req.Header.Get(notify.SignatureName) != notify.Sign("bups-secret", body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.bodies = append(r.bodies, body)
+}
+
+func notifyContext(t *testing.T, url string, failuresOnly bool, tmpl string, collectErr error) *plugin.Context {
+	file, err := ioutil.TempFile("", "bups-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(file.Name()) })
+	if _, err := fmt.Fprintf(file, notifyConfig, url, failuresOnly, tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx := plugin.NewContext()
+	source := LoadPluginSource()
+	source.RawConfig = app.NewCFGBuffer(file)
+	ctx.RawSource = source
+	// notify在upload之前注册，仍然需要在其之后调用
+	ctx.RegisterRaw(notify.New())
+	ctx.RegisterV2(&v2Plugin{TestPlugin: TestPlugin{name: "collector", _type: plugin.BCollect}, err: collectErr})
+	upload := &runPlugin{TestPlugin: TestPlugin{name: "upload", _type: plugin.BCallBack}}
+	upload.onStart = func(run *plugin.Run) {
+		run.AddArtifact(plugin.Artifact{Path: "2022-01-01-03-00.zip", Kind: plugin.KindRemote, Plugin: "upload"})
+	}
+	ctx.RegisterRaw(upload)
+	return ctx
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	recv := &receiver{failures: 2}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+
+	// 成功的运行发送默认的JSON报告，失败的请求会被重试
+	ctx := notifyContext(t, server.URL, false, "", nil)
+	run, err := ctx.RunJob(plugin.DefaultJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recv.bodies) != 1 {
+		t.Fatalf("unexpected requests: %d", len(recv.bodies))
+	}
+	var report notify.Report
+	if err := json.Unmarshal(recv.bodies[0], &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.RunID != run.ID || report.Status != notify.StatusSuccess || report.Host == "" ||
+		len(report.RemoteKeys) != 1 || report.RemoteKeys[0] != "2022-01-01-03-00.zip" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// 只报告失败时成功的运行不发送
+	recv.bodies = nil
+	ctx = notifyContext(t, server.URL, true, `{"text": {{ json (printf "%s failed: %s" .Job (join .Errors ", ")) }}}`, nil)
+	if _, err := ctx.RunJob(plugin.DefaultJob); err != nil {
+		t.Fatal(err)
+	}
+	if len(recv.bodies) != 0 {
+		t.Fatal("successful run is reported in failures only mode")
+	}
+
+	// 收集阶段失败时仍然发送模板生成的报告
+	ctx = notifyContext(t, server.URL, true, `{"text": {{ json (printf "%s failed: %s" .Job (join .Errors ", ")) }}}`, errors.New("disk full"))
+	if _, err := ctx.RunJob(plugin.DefaultJob); err == nil {
+		t.Fatal("collect error is not returned")
+	}
+	if len(recv.bodies) != 1 || !strings.Contains(string(recv.bodies[0]), "default failed: collector: disk full") {
+		t.Fatalf("unexpected failure report: %q", recv.bodies)
+	}
+
+	// 重试次数用完时插件失败，但是通知失败不会让备份失败
+	recv.failures = 3
+	ctx = notifyContext(t, server.URL, false, "", nil)
+	run, err = ctx.RunJob(plugin.DefaultJob)
+	if run.ReportErr() == nil {
+		t.Fatal("notify does not fail after retries")
+	}
+	if err != nil || run.Failed(plugin.BCallBack) {
+		t.Fatalf("notify failure fails the run: %v", err)
+	}
+}
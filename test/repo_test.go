@@ -0,0 +1,296 @@
+package test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/repo"
+	"github.com/abingzo/bups/plugins/backup"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 在数据中间插入内容之后，大部分的块保持不变
+func TestChunker(t *testing.T) {
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	chunks := func(data []byte) map[string]int {
+		res := make(map[string]int)
+		c := repo.NewChunker(bytes.NewReader(data), 64<<10, 256<<10, 1<<20)
+		total := 0
+		for {
+			chunk, err := c.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunk) > 1<<20 {
+				t.Fatalf("chunk size %d is larger than max", len(chunk))
+			}
+			total += len(chunk)
+			res[string(chunk)]++
+		}
+		if total != len(data) {
+			t.Fatalf("chunks total %d, want %d", total, len(data))
+		}
+		return res
+	}
+	before := chunks(data)
+	modified := append(append(append([]byte{}, data[:4<<20]...), []byte("inserted")...), data[4<<20:]...)
+	after := chunks(modified)
+	same := 0
+	for k := range after {
+		if _, ok := before[k]; ok {
+			same++
+		}
+	}
+	if len(before) < 16 || same < len(after)-2 {
+		t.Fatalf("%d chunks before, %d after, only %d are the same", len(before), len(after), same)
+	}
+}
+
+func TestRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "blog")
+	big := make([]byte, 3<<20)
+	rand.New(rand.NewSource(2)).Read(big)
+	writeTree(t, src, map[string]string{
+		"index.php":       "<?php echo 1;",
+		"static/big.bin":  string(big),
+		"static/copy.bin": string(big),
+	})
+	if err := os.Symlink("index.php", filepath.Join(src, "home.php")); err != nil {
+		t.Fatal(err)
+	}
+	backend := &repo.Local{Dir: filepath.Join(dir, "repo")}
+	r, err := repo.Init(backend, []byte("password"), "scrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func(r *repo.Repository, id string) *repo.Snapshot {
+		w, err := r.NewSnapshot(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddTree(src, "blog->root"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return w.Snapshot
+	}
+	snapshot(r, "first")
+	stats := r.Stats()
+	// 两个相同的文件只保存一次
+	if stats.NewBytes >= stats.Bytes || stats.NewBytes < int64(len(big)) {
+		t.Fatalf("duplicate file is not deduplicated: %+v", stats)
+	}
+
+	if _, err := repo.Open(backend, []byte("wrong")); err != repo.ErrWrongPassword {
+		t.Fatalf("open with wrong password: %v", err)
+	}
+	r, err = repo.Open(backend, []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, src, map[string]string{"index.php": "<?php echo 2;"})
+	snapshot(r, "second")
+	if stats := r.Stats(); stats.NewChunks != 1 {
+		t.Fatalf("only the modified file should be stored: %+v", stats)
+	}
+	list, err := r.ListSnapshots()
+	if err != nil || len(list) != 2 || list[0].ID != "first" || list[1].Files() != 3 {
+		t.Fatalf("snapshots: %v %v", list, err)
+	}
+
+	// 恢复第一个快照
+	first, err := r.LoadSnapshot("fir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "restore")
+	if err := r.Restore(first, target); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(target, "blog->root", "index.php"))
+	if err != nil || string(data) != "<?php echo 1;" {
+		t.Fatalf("restored index.php: %q %v", data, err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(target, "blog->root", "static", "copy.bin"))
+	if err != nil || !bytes.Equal(data, big) {
+		t.Fatalf("restored copy.bin is not equal: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "blog->root", "home.php")); err != nil || link != "index.php" {
+		t.Fatalf("restored symlink: %q %v", link, err)
+	}
+
+	// 有正在写入的快照时不能回收
+	w, err := r.NewSnapshot("running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GC(false); err == nil {
+		t.Fatal("gc should fail while a snapshot is running")
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	// 回收期间不能开始新的快照，中断的回收遗留的锁使用force清除
+	if err := backend.Put("gc/interrupted", []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.NewSnapshot("during-gc"); !errors.Is(err, repo.ErrGCRunning) {
+		t.Fatalf("snapshot should fail while gc is running: %v", err)
+	}
+	if locks, _ := backend.List("locks/"); len(locks) != 0 {
+		t.Fatalf("lock of the rejected snapshot is left: %v", locks)
+	}
+	if _, err := r.GC(false); !errors.Is(err, repo.ErrGCRunning) {
+		t.Fatalf("gc should fail while another gc is running: %v", err)
+	}
+	if _, err := r.GC(true); err != nil {
+		t.Fatal(err)
+	}
+	if running, _ := backend.List("gc/"); len(running) != 0 {
+		t.Fatalf("gc locks are left: %v", running)
+	}
+	// 删除第一个快照之后回收只被它引用的块
+	if err := r.DeleteSnapshot("first"); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := r.GC(false)
+	if err != nil || removed != 1 {
+		t.Fatalf("gc removed %d chunks: %v", removed, err)
+	}
+	second, err := r.LoadSnapshot("latest")
+	if err != nil || second.ID != "second" {
+		t.Fatalf("latest snapshot: %v %v", second, err)
+	}
+	if err := r.Restore(second, filepath.Join(dir, "restore2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 内存中的存储桶，实现仓库使用的COS接口
+type fakeCos struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeCos) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		type object struct {
+			Key string
+		}
+		res := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Contents    []object
+			IsTruncated bool
+		}{}
+		prefix := r.URL.Query().Get("prefix")
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				res.Contents = append(res.Contents, object{Key: k})
+			}
+		}
+		_ = xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+		// SDK使用响应中的CRC64校验上传的内容
+		w.Header().Set("x-cos-hash-crc64ecma", strconv.FormatUint(crc64.Checksum(data, crc64.MakeTable(crc64.ECMA)), 10))
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// 仓库放在存储桶中时，连续的两次备份都写入完整的快照
+func TestBackupCosRepository(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "blog")
+	writeTree(t, src, map[string]string{"index.php": "<?php echo 1;"})
+	bucket := &fakeCos{objects: make(map[string][]byte)}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+	cfg := config.Read(strings.NewReader(fmt.Sprintf(`
+[project]
+install = ["backup", "upload"]
+
+[plugin.backup.file_path]
+root = %q
+
+[plugin.backup.repository]
+enable = true
+backend = "cos"
+password = "password"
+kdf = "scrypt"
+
+[plugin.upload.cos]
+sId = "id"
+sKey = "key"
+bucketUrl = %q
+serviceUrl = %q
+`, src, server.URL, server.URL)))
+	source := LoadPluginSource()
+	source.Config = cfg
+	source.CacheDir = filepath.Join(dir, "cache")
+	if err := os.MkdirAll(source.CacheDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := &backup.Backup{}
+	b.SetSource(source)
+	for i := 0; i < 2; i++ {
+		run := plugin.NewRun()
+		run.ID = fmt.Sprintf("run-%d", i)
+		if err := b.Exec(run, nil); err != nil {
+			t.Fatal(err)
+		}
+		remote := run.ArtifactsByKind(plugin.KindRemote)
+		if len(remote) != 1 || remote[0].Meta["size"] == "0" {
+			t.Fatalf("run %d saved nothing: %+v", i, remote)
+		}
+		// 上传等其它插件读取配置之后，备份插件依然读取自己的配置
+		cfg.SetPluginName("upload")
+	}
+	snapshots := 0
+	for k := range bucket.objects {
+		if strings.HasPrefix(k, "repo/snapshots/") {
+			snapshots++
+		}
+	}
+	if snapshots != 2 {
+		t.Fatalf("want 2 snapshots in the bucket, got %d", snapshots)
+	}
+}
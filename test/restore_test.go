@@ -0,0 +1,323 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package test
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/abingzo/bups/common/archiver"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/repo"
+	"github.com/abingzo/bups/common/sign"
+	"github.com/abingzo/bups/plugins/backup"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 归档再解压之后符号链接、硬链接、权限和修改时间保持不变，命名管道被跳过
+func TestArchiverRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "blog")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(src, "bin", "run.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho hello\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 6, 1, 12, 30, 15, 123456789, time.UTC)
+	if err := os.Chtimes(script, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/run.sh", filepath.Join(src, "start")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(script, filepath.Join(src, "run.sh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(src, "pipe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "bin"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []archiver.Options{
+		{Format: archiver.FormatTar, Compression: archiver.CompressionGzip},
+		{Format: archiver.FormatTar, Compression: archiver.CompressionZstd},
+		{Format: archiver.FormatZip, Compression: archiver.CompressionGzip},
+	} {
+		dst := filepath.Join(dir, "blog"+opts.Ext())
+		w, err := archiver.Create(dst, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		skipped := make([]string, 0)
+		w.OnSkip = func(path string, info os.FileInfo) {
+			skipped = append(skipped, filepath.Base(path))
+		}
+		if err := w.AddTree(src); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(skipped) != 1 || skipped[0] != "pipe" {
+			t.Fatalf("%s: skipped %v", opts, skipped)
+		}
+
+		target := filepath.Join(dir, "restore-"+opts.Compression+"-"+opts.Format)
+		err = archiver.Extract(dst, target, archiver.ExtractOptions{OnWarn: func(name string, err error) {
+			t.Logf("%s: %s: %s", opts, name, err)
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := filepath.Join(target, "blog")
+		link, err := os.Readlink(filepath.Join(restored, "start"))
+		if err != nil || link != "bin/run.sh" {
+			t.Fatalf("%s: symlink %q %v", opts, link, err)
+		}
+		info, err := os.Stat(filepath.Join(restored, "bin", "run.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0750 {
+			t.Fatalf("%s: mode %v", opts, info.Mode())
+		}
+		// zip的修改时间精度为秒
+		if info.ModTime().Unix() != mtime.Unix() {
+			t.Fatalf("%s: mtime %v", opts, info.ModTime())
+		}
+		dirInfo, err := os.Stat(filepath.Join(restored, "bin"))
+		if err != nil || dirInfo.ModTime().Unix() != mtime.Unix() {
+			t.Fatalf("%s: dir mtime %v %v", opts, dirInfo, err)
+		}
+		if _, err := os.Lstat(filepath.Join(restored, "pipe")); !os.IsNotExist(err) {
+			t.Fatalf("%s: fifo should not be restored", opts)
+		}
+		hard, err := os.Stat(filepath.Join(restored, "run.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.Format == archiver.FormatTar {
+			if !os.SameFile(info, hard) {
+				t.Fatalf("%s: hardlink is not restored", opts)
+			}
+			if !info.ModTime().Equal(mtime) {
+				t.Fatalf("%s: mtime %v is not nanosecond precision", opts, info.ModTime())
+			}
+		}
+	}
+}
+
+// 归档中的..路径不能写到目标目录之外
+func TestArchiverExtractTraversal(t *testing.T) {
+	if _, err := archiver.Detect("backup.rar"); err != archiver.ErrUnknownFormat {
+		t.Fatal("rar should be unknown")
+	}
+	dir, err := ioutil.TempDir("", "bups-traversal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "evil.txt")
+	if err := ioutil.WriteFile(src, []byte("evil"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "evil.tar")
+	w, err := archiver.Create(dst, archiver.Options{Format: archiver.FormatTar, Compression: archiver.CompressionNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddFile("../evil.txt", src); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.Extract(dst, filepath.Join(dir, "out"), archiver.ExtractOptions{}); err == nil {
+		t.Fatal("extract should reject ../evil.txt")
+	}
+}
+
+// 目录条目本身是符号链接时，不会修改符号链接指向的目录
+func TestArchiverExtractSymlinkDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-symlink-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	checkOutside := func(name string) {
+		info, err := os.Stat(outside)
+		if err != nil || info.Mode().Perm() != 0755 {
+			t.Fatalf("%s: outside directory is modified: %v %v", name, info.Mode(), err)
+		}
+	}
+	src := filepath.Join(dir, "evil.tar")
+	file, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(file)
+	for _, h := range []*tar.Header{
+		// 解压之前已经存在的符号链接
+		{Name: "link/", Typeflag: tar.TypeDir, Mode: 0777},
+		// 之后的条目将目录替换为符号链接
+		{Name: "swap/", Typeflag: tar.TypeDir, Mode: 0777},
+		{Name: "swap", Typeflag: tar.TypeSymlink, Linkname: outside},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	file.Close()
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(out, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.Extract(src, out, archiver.ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkOutside("tar")
+	if info, err := os.Lstat(filepath.Join(out, "link")); err != nil || !info.IsDir() {
+		t.Fatal("symlink is not replaced by the directory")
+	}
+
+	// 快照的恢复使用相同的检查
+	r, err := repo.Init(&repo.Local{Dir: filepath.Join(dir, "repo")}, []byte("password"), "scrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := filepath.Join(dir, "restore")
+	if err := os.Mkdir(restore, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(restore, "link")); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &repo.Snapshot{Nodes: []*repo.Node{
+		{Name: "link", Type: repo.NodeDir, Mode: os.ModeDir | 0777, ModTime: time.Now()},
+		{Name: "link/evil.txt", Type: repo.NodeFile, Mode: 0644, ModTime: time.Now()},
+	}}
+	if err := r.Restore(snapshot, restore); err != nil {
+		t.Fatal(err)
+	}
+	checkOutside("repo")
+	if _, err := os.Lstat(filepath.Join(outside, "evil.txt")); !os.IsNotExist(err) {
+		t.Fatal("file is restored through a symlink")
+	}
+	// 父目录是符号链接时拒绝恢复
+	snapshot.Nodes = []*repo.Node{{Name: "escape/evil.txt", Type: repo.NodeFile, Mode: 0644}}
+	if err := os.Symlink(outside, filepath.Join(restore, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Restore(snapshot, restore); err == nil {
+		t.Fatal("restore through a symlink is accepted")
+	}
+}
+
+// 配置了信任的公钥时，恢复之前验证归档或者外层归档的签名
+func TestBackupRestoreSignature(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "blog")
+	writeTree(t, src, map[string]string{"index.php": "<?php echo 1;"})
+	archive := filepath.Join(dir, "blog->root.tar.gz")
+	w, err := archiver.Create(archive, archiver.Options{Format: archiver.FormatTar, Compression: archiver.CompressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddTree(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := sign.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := LoadPluginSource()
+	source.Config = config.Read(strings.NewReader(fmt.Sprintf(`
+[project]
+install = ["backup", "encrypt"]
+
+[plugin.encrypt.sign]
+trusted = [%q]
+`, key.Public())))
+	source.CacheDir = filepath.Join(dir, "cache")
+	b := &backup.Backup{}
+	b.SetSource(source)
+	restore := func(args ...string) error {
+		target := t.TempDir()
+		args = append([]string{"backup", "--target", target}, args...)
+		err := b.Exec(nil, args)
+		_, sErr := os.Stat(filepath.Join(target, "blog", "index.php"))
+		if (err == nil) != (sErr == nil) {
+			t.Fatalf("restore %v returns %v but index.php stat returns %v", args, err, sErr)
+		}
+		return err
+	}
+	if err := restore("--restore", archive); err == nil {
+		t.Fatal("archive without signature is restored")
+	}
+	sig, err := sign.Sign(key, archive, sign.Metadata{Object: filepath.Base(archive)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sig.WriteFile(archive + sign.Ext); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore("--restore", archive); err != nil {
+		t.Fatal(err)
+	}
+	// 签名中的对象键与归档不一致
+	renamed := filepath.Join(dir, "other.tar.gz")
+	if err := os.Link(archive, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(archive+sign.Ext, renamed+sign.Ext); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore("--restore", renamed); err == nil {
+		t.Fatal("archive signed for another object is restored")
+	}
+	// 从签名的外层归档中取出的归档
+	outer := filepath.Join(dir, "2022-01-01-00-00.zip.enc")
+	if err := ioutil.WriteFile(outer, []byte("outer"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if sig, err = sign.Sign(key, outer, sign.Metadata{Object: filepath.Base(outer)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sig.WriteFile(outer + sign.Ext); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore("--restore", renamed, "--from", outer); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(outer, []byte("evil"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore("--restore", renamed, "--from", outer); err == nil {
+		t.Fatal("archive from a tampered outer archive is restored")
+	}
+}
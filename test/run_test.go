@@ -0,0 +1,214 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/abingzo/bups/common/plugin"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// 测试流水线在各个阶段之间传递产物
+func TestRunArtifacts(t *testing.T) {
+	data := []byte("hello bups")
+	file, err := ioutil.TempFile("", "bups-artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	ctx := plugin.NewContext()
+	ctx.RawSource = LoadPluginSource()
+	collector := &runPlugin{TestPlugin: TestPlugin{name: "collector", _type: plugin.BCollect}}
+	handler := &runPlugin{TestPlugin: TestPlugin{name: "handler", _type: plugin.BHandle}}
+	collector.onStart = func(run *plugin.Run) {
+		if _, err := run.Emit(collector.name, plugin.KindFile, file.Name()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler.onStart = func(run *plugin.Run) {
+		artifacts := run.ArtifactsByKind(plugin.KindFile)
+		if len(artifacts) != 1 {
+			t.Fatalf("handler got %d artifacts", len(artifacts))
+		}
+		sum := sha256.Sum256(data)
+		if artifacts[0].Checksum != hex.EncodeToString(sum[:]) || artifacts[0].Size != int64(len(data)) {
+			t.Fatal("artifact checksum or size is not equal")
+		}
+		if artifacts[0].Plugin != collector.name {
+			t.Fatal("artifact plugin name is not equal")
+		}
+	}
+	ctx.RegisterRaw(collector)
+	ctx.RegisterRaw(handler)
+	ctx.SetState(plugin.BCollect)
+	first := ctx.GetRun()
+	ctx.SetState(plugin.BHandle)
+	if ctx.GetRun() != first || handler.run != first {
+		t.Fatal("run is not passed between stages")
+	}
+	// 下一次收集数据时创建新的流水线
+	ctx.SetState(plugin.BCollect)
+	if ctx.GetRun() == first {
+		t.Fatal("BCollect did not create a new run")
+	}
+}
+
+type runPlugin struct {
+	TestPlugin
+	run     *plugin.Run
+	onStart func(run *plugin.Run)
+}
+
+func (r *runPlugin) SetRun(run *plugin.Run) {
+	r.run = run
+}
+
+func (r *runPlugin) Start(args []string) {
+	r.onStart(r.run)
+}
+
+type v2Plugin struct {
+	TestPlugin
+	called bool
+	err    error
+}
+
+func (v *v2Plugin) Exec(run *plugin.Run, args []string) error {
+	v.called = true
+	return v.err
+}
+
+// 测试收集阶段失败时跳过后续阶段
+func TestStageAbort(t *testing.T) {
+	ctx := plugin.NewContext()
+	ctx.RawSource = LoadPluginSource()
+	collector := &v2Plugin{TestPlugin: TestPlugin{name: "collector", _type: plugin.BCollect}, err: errors.New("collect failed")}
+	handler := &v2Plugin{TestPlugin: TestPlugin{name: "handler", _type: plugin.BHandle}}
+	callback := &runPlugin{TestPlugin: TestPlugin{name: "callback", _type: plugin.BCallBack}}
+	callback.onStart = func(run *plugin.Run) {
+		t.Fatal("callback plugin should be skipped")
+	}
+	ctx.RegisterV2(collector)
+	ctx.RegisterV2(handler)
+	ctx.RegisterRaw(callback)
+	if err := ctx.SetState(plugin.BCollect); err == nil {
+		t.Fatal("collect stage error is not returned")
+	}
+	_ = ctx.SetState(plugin.BHandle)
+	_ = ctx.SetState(plugin.BCallBack)
+	if handler.called {
+		t.Fatal("handle plugin should be skipped")
+	}
+	results := ctx.GetRun().Results()
+	if len(results) != 3 || !results[1].Skipped || !results[2].Skipped {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if ctx.GetRun().Err() == nil {
+		t.Fatal("run error is nil")
+	}
+	// 第一版插件通过适配器运行
+	if plugin.VersionOf(callback) != plugin.VersionV1 || plugin.VersionOf(plugin.WrapV2(handler)) != plugin.VersionV2 {
+		t.Fatal("plugin version is not equal")
+	}
+}
+
+// 测试插件的panic被隔离为运行结果中的错误
+func TestPanicIsolation(t *testing.T) {
+	ctx := plugin.NewContext()
+	ctx.RawSource = LoadPluginSource()
+	collector := &runPlugin{TestPlugin: TestPlugin{name: "collector", _type: plugin.BCollect}}
+	collector.onStart = func(run *plugin.Run) {
+		var m map[string]string
+		m["panic"] = "assignment to entry in nil map"
+	}
+	ctx.RegisterRaw(collector)
+	err := ctx.SetState(plugin.BCollect)
+	if err == nil {
+		t.Fatal("panic is not converted to error")
+	}
+	results := ctx.GetRun().Results()
+	pErr, ok := results[0].Err.(*plugin.PanicError)
+	if !ok {
+		t.Fatalf("result error is not a panic error: %v", results[0].Err)
+	}
+	if pErr.Plugin != collector.name || len(pErr.Stack) == 0 {
+		t.Fatal("panic error is missing plugin name or stack")
+	}
+	// 下一个周期依然可以运行
+	collector.onStart = func(run *plugin.Run) {}
+	if err := ctx.SetState(plugin.BCollect); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试OnEnd注册的函数在所有阶段之后调用，并且可以看到运行的结果
+func TestRunOnEnd(t *testing.T) {
+	ctx := plugin.NewContext()
+	ctx.RawSource = LoadPluginSource()
+	collector := &runPlugin{TestPlugin: TestPlugin{name: "collector", _type: plugin.BCollect}}
+	handler := &v2Plugin{TestPlugin: TestPlugin{name: "handler", _type: plugin.BHandle}, err: errors.New("upload failed")}
+	var ended []error
+	collector.onStart = func(run *plugin.Run) {
+		run.OnEnd(func(run *plugin.Run) {
+			ended = append(ended, run.Err())
+		})
+	}
+	ctx.RegisterRaw(collector)
+	ctx.RegisterV2(handler)
+	if _, err := ctx.RunJob(plugin.DefaultJob); err == nil {
+		t.Fatal("handler error is not returned")
+	}
+	if len(ended) != 1 || ended[0] == nil {
+		t.Fatalf("OnEnd should be called once with the run error: %v", ended)
+	}
+	handler.err = nil
+	if _, err := ctx.RunJob(plugin.DefaultJob); err != nil {
+		t.Fatal(err)
+	}
+	if len(ended) != 2 || ended[1] != nil {
+		t.Fatalf("OnEnd of a successful run: %v", ended)
+	}
+}
+
+type reporterPlugin struct {
+	v2Plugin
+}
+
+func (r *reporterPlugin) ReportRun() bool {
+	return true
+}
+
+// 测试Reporter的错误不会让运行失败
+func TestReporterErr(t *testing.T) {
+	ctx := plugin.NewContext()
+	ctx.RawSource = LoadPluginSource()
+	collector := &v2Plugin{TestPlugin: TestPlugin{name: "collector", _type: plugin.BCollect}}
+	reporter := &reporterPlugin{v2Plugin{TestPlugin: TestPlugin{name: "reporter", _type: plugin.BCallBack}, err: errors.New("smtp unavailable")}}
+	var ended []error
+	ctx.RegisterV2(collector)
+	ctx.RegisterV2(reporter)
+	ctx.OnRunComplete(func(run *plugin.Run) {
+		ended = append(ended, run.Err())
+	})
+	run, err := ctx.RunJob(plugin.DefaultJob)
+	if err != nil || !reporter.called {
+		t.Fatalf("reporter error fails the run: %v", err)
+	}
+	if len(ended) != 1 || ended[0] != nil {
+		t.Fatalf("observers see a failed run: %v", ended)
+	}
+	if run.ReportErr() == nil {
+		t.Fatal("reporter error is not recorded")
+	}
+	results := run.Results()
+	if len(results) != 2 || !results[1].Report || results[1].Err == nil {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+}
@@ -0,0 +1,59 @@
+package test
+
+import (
+	"github.com/abingzo/bups/common/schedule"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	from := time.Date(2021, 12, 31, 23, 30, 0, 0, loc)
+	table := []struct {
+		expr string
+		next time.Time
+	}{
+		{"0 3 * * *", time.Date(2022, 1, 1, 3, 0, 0, 0, loc)},
+		{"*/15 * * * *", time.Date(2021, 12, 31, 23, 45, 0, 0, loc)},
+		{"30 2 * * mon", time.Date(2022, 1, 3, 2, 30, 0, 0, loc)},
+		{"0 0 1 * *", time.Date(2022, 1, 1, 0, 0, 0, 0, loc)},
+		{"15 30 4 * * *", time.Date(2022, 1, 1, 4, 30, 15, 0, loc)},
+		{"0 4 15 * 0", time.Date(2022, 1, 2, 4, 0, 0, 0, loc)},
+		{"0 4 * 2-3 7", time.Date(2022, 2, 6, 4, 0, 0, 0, loc)},
+		{"@daily", time.Date(2022, 1, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, v := range table {
+		c, err := schedule.ParseCron(v.expr, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := c.Next(from); !next.Equal(v.next) {
+			t.Errorf("%s: next is %s, want %s", v.expr, next, v.next)
+		}
+	}
+	for _, v := range []string{"* * * *", "60 * * * *", "* * * * 8", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := schedule.ParseCron(v, loc); err == nil {
+			t.Errorf("%s: invalid expression is parsed", v)
+		}
+	}
+}
+
+func TestScheduleFallback(t *testing.T) {
+	sched, err := schedule.New("", "", 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if !sched.Next(now).Equal(now.Add(10 * time.Minute)) {
+		t.Fatal("lopp_time fallback interval is not equal")
+	}
+	if _, err := schedule.New("", "", 0); err == nil {
+		t.Fatal("empty schedule is accepted")
+	}
+	if _, err := schedule.New("0 3 * * *", "Not/AZone", 0); err == nil {
+		t.Fatal("invalid timezone is accepted")
+	}
+}
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"bytes"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/crypt"
+	"github.com/abingzo/bups/common/shamir"
+	"github.com/abingzo/bups/plugins/encrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShamir(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	shares, err := shamir.Split(secret, "2023-01", 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 任意3份都可以还原
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				got, err := shamir.Combine([]*shamir.Share{shares[i], shares[j], shares[k]})
+				if err != nil || !bytes.Equal(got, secret) {
+					t.Fatalf("combine %d %d %d failed: %v", i, j, k, err)
+				}
+			}
+		}
+	}
+	if _, err := shamir.Combine(shares[:2]); err == nil {
+		t.Fatal("2 shares recover the secret")
+	}
+	// 重复的份额不计数
+	if _, err := shamir.Combine([]*shamir.Share{shares[0], shares[0], shares[1]}); err == nil {
+		t.Fatal("duplicate shares are counted")
+	}
+	// 文本格式可以还原
+	parsed, err := shamir.ParseShare(strings.ToLower(shares[4].String()))
+	if err != nil || parsed.Name != "2023-01" || parsed.X != 5 || parsed.Threshold != 3 {
+		t.Fatalf("unexpected share: %+v %v", parsed, err)
+	}
+	corrupted := *parsed
+	corrupted.Data = append([]byte{}, parsed.Data...)
+	corrupted.Data[0] ^= 1
+	if _, err := shamir.Combine([]*shamir.Share{shares[0], shares[1], &corrupted}); err == nil {
+		t.Fatal("corrupted share is accepted")
+	}
+	// 不同次拆分的份额不能混用
+	other, err := shamir.Split(secret, "2023-01", 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other[0].ID, shares[0].ID) {
+		t.Fatal("split id is reused")
+	}
+	if _, err := shamir.Combine([]*shamir.Share{shares[0], shares[1], other[2]}); err == nil {
+		t.Fatal("shares of different splits are combined")
+	}
+	if _, err := shamir.Split(secret, "", 2, 3); err == nil {
+		t.Fatal("threshold larger than shares is accepted")
+	}
+}
+
+const escrowConfig = `
+[project]
+install = ["encrypt"]
+lopp_time = 60
+
+[plugin.encrypt.cipher]
+kdf = "scrypt"
+
+[plugin.encrypt.keyring.2023-01]
+status = "active"
+passphrase = "correct horse"
+`
+
+func TestKeyEscrow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-escrow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := encrypt.ReadCipher(config.Read(strings.NewReader(escrowConfig)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("bups"), 1000)
+	src := filepath.Join(dir, "backup.zip")
+	if err := ioutil.WriteFile(src, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EncryptFile(src, src+encrypt.EncryptedExt); err != nil {
+		t.Fatal(err)
+	}
+	shares, err := c.SplitKey("", 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := encrypt.WriteShares(out, dir, shares); err != nil {
+		t.Fatal(err)
+	}
+	files := strings.Fields(out.String())
+	if len(files) != 5 || filepath.Base(files[0]) != "2023-01-share-1.txt" {
+		t.Fatalf("unexpected share files: %v", files)
+	}
+	// 没有配置任何密钥的离线机器
+	offline, err := encrypt.ReadCipher(config.Read(strings.NewReader("[project]\ninstall = []\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := encrypt.ReadShares([]string{files[4], files[0], files[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := offline.RecoverKey(read)
+	if err != nil || key.ID != "2023-01" {
+		t.Fatal("recover key failed:", err)
+	}
+	dst := filepath.Join(dir, "recovered.zip")
+	if err := offline.DecryptFile(src+encrypt.EncryptedExt, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(dst); !bytes.Equal(data, plain) {
+		t.Fatal("plaintext mismatch")
+	}
+
+	// 公钥密钥拆分私钥
+	identity, err := crypt.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(dir, "identity.txt")
+	if err := ioutil.WriteFile(identityFile, []byte(identity.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	recipientConfig := "[plugin.encrypt.keyring.offline]\nrecipients = [\"" + identity.Recipient().String() + "\"]\nidentity_file = \"" + identityFile + "\"\n"
+	c, err = encrypt.ReadCipher(config.Read(strings.NewReader(recipientConfig)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EncryptFile(src, src+encrypt.EncryptedExt); err != nil {
+		t.Fatal(err)
+	}
+	shares, err = c.SplitKey("offline", 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := []string{shares[2].String(), shares[1].String()}
+	read, err = encrypt.ReadShares(texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := offline.RecoverKey(read); err != nil {
+		t.Fatal(err)
+	}
+	if err := offline.DecryptFile(src+encrypt.EncryptedExt, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(dst); !bytes.Equal(data, plain) {
+		t.Fatal("plaintext mismatch")
+	}
+}
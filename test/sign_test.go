@@ -0,0 +1,153 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/abingzo/bups/app"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/sign"
+	"github.com/abingzo/bups/plugins/encrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const signConfig = `
+[project]
+install = ["encrypt"]
+lopp_time = 60
+
+[plugin.encrypt.sign]
+key_file = "%s"
+trusted = ["%s"]
+`
+
+func TestSignArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bups-sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := sign.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := sign.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 文本格式可以还原
+	public, err := sign.ParsePublicKey(key.Public().String())
+	if err != nil || public.KeyID() != key.Public().KeyID() {
+		t.Fatal("parse public key failed:", err)
+	}
+	keyFile := filepath.Join(dir, "sign.key")
+	if err := ioutil.WriteFile(keyFile, []byte("# comment\n"+key.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(signConfig, keyFile, public)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dump := filepath.Join(dir, "database.sql")
+	if err := ioutil.WriteFile(dump, bytes.Repeat([]byte("INSERT INTO posts VALUES (1);\n"), 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	ctx := plugin.NewContext()
+	ctx.Version = "v0.0.1-test"
+	source := LoadPluginSource()
+	source.RawConfig = app.NewCFGBuffer(file)
+	ctx.RawSource = source
+	ctx.RegisterJob("sign_test", encrypt.New())
+	defer os.RemoveAll("./cache/sign_test")
+	if err := os.MkdirAll(plugin.CacheDir("sign_test", encrypt.Name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	collector := &runPlugin{TestPlugin: TestPlugin{name: "backup", _type: plugin.BCollect}}
+	collector.onStart = func(run *plugin.Run) {
+		if _, err := run.Emit("backup", plugin.KindDatabase, dump); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx.RegisterJob("sign_test", collector)
+	run, err := ctx.RunJob("sign_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := run.ArtifactsByKind(plugin.KindArchive)[0].Path
+	object := run.ArtifactsByKind(plugin.KindArchive)[0].Meta["object"]
+	if !strings.HasPrefix(object, "sign_test/") {
+		t.Fatalf("unexpected object name %q", object)
+	}
+	signatures := run.ArtifactsByKind(plugin.KindSignature)
+	if len(signatures) != 1 || signatures[0].Path != archive+sign.Ext || signatures[0].Meta["archive"] != archive {
+		t.Fatalf("unexpected signatures: %+v", signatures)
+	}
+	sig, err := sign.ReadFile(signatures[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := os.Hostname()
+	if sig.Metadata.Job != "sign_test" || sig.Metadata.Version != "v0.0.1-test" || sig.Metadata.Host != host ||
+		sig.Metadata.Archive != filepath.Base(archive) || sig.Metadata.Object != object || sig.Metadata.Timestamp == "" {
+		t.Fatalf("unexpected metadata: %+v", sig.Metadata)
+	}
+	if err := sig.Verify(archive, object, []*sign.PublicKey{other.Public()}); err == nil {
+		t.Fatal("signature is trusted by other key")
+	}
+	// 通过参数验证和解密
+	var p plugin.Plugin
+	ctx.RangeJobPlugin(func(k int, job string, v plugin.Plugin) {
+		if v.GetName() == encrypt.Name {
+			p = v
+		}
+	})
+	if err := plugin.Start(p, []string{"bups", "--verify", archive, "--object", object}); err != nil {
+		t.Fatal(err)
+	}
+	// 有效的签名不能用于其它的对象，比如用旧的归档替换新的对象
+	if err := plugin.Start(p, []string{"bups", "--verify", archive, "--object", "sign_test/2099-01-01-00-00.zip"}); err == nil {
+		t.Fatal("signature is accepted for another object")
+	}
+	if err := plugin.Start(p, []string{"bups", "--verify", archive}); err == nil {
+		t.Fatal("signature is accepted for the local file name")
+	}
+	// 篡改的签名和归档都拒绝解密
+	data, err := ioutil.ReadFile(signatures[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := filepath.Join(dir, "forged.sig")
+	if err := ioutil.WriteFile(forged, bytes.Replace(data, []byte("sign_test"), []byte("sign_evil"), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Start(p, []string{"bups", "--verify", archive, "--object", object, "--signature", forged}); err == nil {
+		t.Fatal("forged signature is accepted")
+	}
+	f, err := os.OpenFile(archive, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("tampered"))
+	f.Close()
+	out := filepath.Join(dir, "backup.zip")
+	if err := plugin.Start(p, []string{"bups", "--decrypt", archive, "--object", object, "--out", out}); err == nil {
+		t.Fatal("tampered archive is decrypted")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatal("output of tampered archive exists")
+	}
+	if err := os.Remove(archive + sign.Ext); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Start(p, []string{"bups", "--verify", archive, "--object", object}); err == nil {
+		t.Fatal("archive without signature is accepted")
+	}
+}
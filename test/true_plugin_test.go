@@ -49,7 +49,12 @@ func TestEncryptPlugin(t *testing.T) {
 	ctx.SetState(encrypt.Type)
 	// Single
 	ep.Caller(plugin.Exit)
-	// 重新生成文件，给测试Upload的代码使用
+	// 没有流水线时归档阶段失败，而不是什么都不做
+	defer func() {
+		if err := recover(); err == nil {
+			t.Fatal("start without a pipeline run should fail")
+		}
+	}()
 	ep.Start(nil)
 }
 
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/abingzo/bups/common/config"
+	"github.com/abingzo/bups/common/history"
+	"github.com/abingzo/bups/common/plugin"
+	"github.com/abingzo/bups/common/watchdog"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const watchdogConfig = `
+[project]
+install = ["backup"]
+lopp_time = 60
+
+[project.watchdog]
+threshold = "26h"
+url = "http://127.0.0.1/alert"
+
+[[job]]
+name = "blog_a"
+
+[[job]]
+name = "blog_b"
+[job.watchdog]
+threshold = "2h"
+
+[[job]]
+name = "blog_c"
+`
+
+func TestWatchdog(t *testing.T) {
+	cfg := config.Read(strings.NewReader(watchdogConfig))
+	jobs := cfg.Jobs()
+	if jobs[0].Watchdog.ThresholdDuration() != 26*time.Hour || jobs[0].Watchdog.URL == "" ||
+		jobs[1].Watchdog.ThresholdDuration() != 2*time.Hour || jobs[1].Watchdog.URL != "" {
+		t.Fatalf("unexpected watchdog config: %+v", jobs)
+	}
+	// blog_c不检查
+	jobs[2].Watchdog = config.Watchdog{}
+
+	fired := make([]watchdog.Alert, 0)
+	w := watchdog.New(jobs, func(alert watchdog.Alert, cfg config.Watchdog) {
+		fired = append(fired, alert)
+	})
+	now := time.Unix(1600000000, 0)
+	w.SetClock(func() time.Time { return now })
+	w.SetStart(now)
+	w.Seed([]history.Entry{
+		{Job: "blog_a", EndTime: now.Add(-25 * time.Hour), Outcome: history.OutcomeSuccess},
+		{Job: "blog_a", EndTime: now.Add(-time.Hour), Outcome: history.OutcomeFailed},
+	})
+	if alerts := w.Check(); len(alerts) != 0 {
+		t.Fatalf("unexpected alerts: %v", alerts)
+	}
+	now = now.Add(3 * time.Hour)
+	alerts := w.Check()
+	if len(alerts) != 2 || alerts[0].Job != "blog_a" || alerts[1].Job != "blog_b" || len(fired) != 2 {
+		t.Fatalf("unexpected alerts: %v", alerts)
+	}
+	// 同一次中断只告警一次
+	if w.Check(); len(fired) != 2 {
+		t.Fatal("alert is fired twice")
+	}
+	// 成功的运行重新开始计算
+	run := plugin.NewRun()
+	run.Job = "blog_b"
+	run.EndTime = now
+	w.Observe(run)
+	if alerts := w.Check(); len(alerts) != 1 || alerts[0].Job != "blog_a" {
+		t.Fatalf("success does not reset watchdog: %v", alerts)
+	}
+	now = now.Add(3 * time.Hour)
+	if w.Check(); len(fired) != 3 || fired[2].Job != "blog_b" {
+		t.Fatal("alert is not fired again after success")
+	}
+
+	// HTTP回调
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		_ = json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+	if err := watchdog.Post(server.Client(), server.URL, fired[0]); err != nil {
+		t.Fatal(err)
+	}
+	if received["job"] != "blog_a" || !strings.Contains(received["message"].(string), "no successful backup") {
+		t.Fatalf("unexpected callback body: %v", received)
+	}
+}